@@ -45,6 +45,7 @@ func init() {
 func NewCmdRoot(in io.Reader, out, err io.Writer, cmd *cobra.Command) *cobra.Command {
 
 	cmd.AddCommand(webhook.NewWebhookCmd())
+	cmd.AddCommand(webhook.NewGCCmd())
 	cmd.AddCommand(common.NewVersionCmd())
 
 	return cmd
@@ -0,0 +1,211 @@
+package webhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// tokenReviewCacheTTL bounds how long a TokenReview verdict is reused for the same bearer token
+	tokenReviewCacheTTL = time.Minute
+	// tokenReviewCacheSize bounds the number of cached verdicts; when it is reached, an arbitrary
+	// one makes room for the next
+	tokenReviewCacheSize = 1024
+	// tokenReviewRate and tokenReviewBurst limit the TokenReviews of tokens that are not cached,
+	// so that callers presenting ever new tokens cannot flood the API server
+	tokenReviewRate  = rate.Limit(10)
+	tokenReviewBurst = 20
+)
+
+// tokenReviewFunc asks the cluster who a bearer token belongs to
+type tokenReviewFunc func(ctx context.Context, token string) (*authenticationv1.TokenReviewStatus, error)
+
+// callerAuthenticator decides whether an admission request came from the kube-apiserver, either
+// by a client certificate verified against WebhookConfig.Authentication.ClientCAFile or by a
+// bearer token accepted by the TokenReview API
+type callerAuthenticator struct {
+	clientCerts        bool
+	allowedCommonNames []string
+	tokenReview        bool
+	allowedUsers       []string
+	review             tokenReviewFunc
+	limiter            *rate.Limiter
+
+	mu      sync.Mutex
+	reviews map[[sha256.Size]byte]cachedReview
+}
+
+type cachedReview struct {
+	user    string
+	err     error
+	expires time.Time
+}
+
+// newCallerAuthenticator returns nil when no caller authentication is configured
+func newCallerAuthenticator(cfg *WebhookConfig, review tokenReviewFunc) *callerAuthenticator {
+	if cfg.Authentication.ClientCAFile == "" && !cfg.Authentication.TokenReview {
+		return nil
+	}
+	return &callerAuthenticator{
+		clientCerts:        cfg.Authentication.ClientCAFile != "",
+		allowedCommonNames: cfg.Authentication.AllowedCommonNames,
+		tokenReview:        cfg.Authentication.TokenReview,
+		allowedUsers:       cfg.Authentication.AllowedUsers,
+		review:             review,
+		limiter:            rate.NewLimiter(tokenReviewRate, tokenReviewBurst),
+		reviews:            map[[sha256.Size]byte]cachedReview{},
+	}
+}
+
+// authenticate returns the name of the caller, or an error if the request must be rejected. A
+// nil authenticator accepts every caller.
+func (a *callerAuthenticator) authenticate(r *http.Request) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+
+	var reasons []string
+	if a.clientCerts {
+		user, err := a.authenticateCertificate(r)
+		if err == nil {
+			return user, nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	if a.tokenReview {
+		user, err := a.authenticateToken(r)
+		if err == nil {
+			return user, nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	return "", errors.New(strings.Join(reasons, "; "))
+}
+
+func (a *callerAuthenticator) authenticateCertificate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", errors.New("no verified client certificate")
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(a.allowedCommonNames) > 0 && !slices.Contains(a.allowedCommonNames, cn) {
+		return "", fmt.Errorf("client certificate %q is not allowed", cn)
+	}
+	return cn, nil
+}
+
+func (a *callerAuthenticator) authenticateToken(r *http.Request) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", errors.New("no bearer token")
+	}
+
+	digest := sha256.Sum256([]byte(token))
+	a.mu.Lock()
+	cached, ok := a.reviews[digest]
+	a.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.user, cached.err
+	}
+
+	if !a.limiter.Allow() {
+		return "", errors.New("too many token reviews, bearer token not checked")
+	}
+	status, err := a.review(r.Context(), token)
+	if err != nil {
+		// an unreachable API server says nothing about the token, so this is not cached
+		return "", fmt.Errorf("token review failed: %w", err)
+	}
+
+	cached = cachedReview{user: status.User.Username, expires: time.Now().Add(tokenReviewCacheTTL)}
+	switch {
+	case !status.Authenticated:
+		cached.err = fmt.Errorf("bearer token not authenticated: %s", status.Error)
+	case len(a.allowedUsers) > 0 && !slices.Contains(a.allowedUsers, status.User.Username):
+		cached.err = fmt.Errorf("user %q is not allowed", status.User.Username)
+	}
+
+	a.mu.Lock()
+	if _, ok := a.reviews[digest]; !ok && len(a.reviews) >= tokenReviewCacheSize {
+		for key := range a.reviews {
+			delete(a.reviews, key)
+			break
+		}
+	}
+	a.reviews[digest] = cached
+	a.mu.Unlock()
+
+	return cached.user, cached.err
+}
+
+// run drops expired TokenReview verdicts every cache TTL until ctx is done
+func (a *callerAuthenticator) run(ctx context.Context) {
+	if a == nil || !a.tokenReview {
+		return
+	}
+	ticker := time.NewTicker(tokenReviewCacheTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		a.evictExpired(time.Now())
+	}
+}
+
+// evictExpired drops the verdicts that expired before now
+func (a *callerAuthenticator) evictExpired(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, review := range a.reviews {
+		if now.After(review.expires) {
+			delete(a.reviews, key)
+		}
+	}
+}
+
+// reviewToken submits a TokenReview with the shared clientset
+func reviewToken(ctx context.Context, token string) (*authenticationv1.TokenReviewStatus, error) {
+	kc, err := clients.kubeClient()
+	if err != nil {
+		return nil, err
+	}
+	review, err := kc.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &review.Status, nil
+}
+
+// require serves next only to authenticated callers; a nil authenticator accepts every caller
+func (a *callerAuthenticator) require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := a.authenticate(r); err != nil {
+			rejectUnauthenticated(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectUnauthenticated answers 401 and logs why the caller was turned away
+func rejectUnauthenticated(w http.ResponseWriter, r *http.Request, err error) {
+	klog.Warningf("rejected unauthenticated admission request to %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
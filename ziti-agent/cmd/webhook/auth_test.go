@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+func newTestTokenAuthenticator(reviews *atomic.Int32) *callerAuthenticator {
+	cfg := &WebhookConfig{}
+	cfg.Authentication.TokenReview = true
+	return newCallerAuthenticator(cfg, func(ctx context.Context, token string) (*authenticationv1.TokenReviewStatus, error) {
+		reviews.Add(1)
+		return &authenticationv1.TokenReviewStatus{
+			Authenticated: true,
+			User:          authenticationv1.UserInfo{Username: "system:apiserver"},
+		}, nil
+	})
+}
+
+func authenticateBearer(a *callerAuthenticator, token string) (string, error) {
+	r := httptest.NewRequest("POST", "/ziti-tunnel", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return a.authenticate(r)
+}
+
+func TestTokenReviewCache(t *testing.T) {
+	var reviews atomic.Int32
+	a := newTestTokenAuthenticator(&reviews)
+
+	for range 3 {
+		if user, err := authenticateBearer(a, "apiserver"); err != nil || user != "system:apiserver" {
+			t.Fatalf("authenticated %q, %v", user, err)
+		}
+	}
+	if reviews.Load() != 1 {
+		t.Errorf("%d token reviews, want the verdict cached after the first", reviews.Load())
+	}
+
+	// expired verdicts are dropped by the sweep, not by the requests
+	a.evictExpired(time.Now().Add(tokenReviewCacheTTL + time.Second))
+	if len(a.reviews) != 0 {
+		t.Errorf("%d verdicts left after they expired", len(a.reviews))
+	}
+}
+
+func TestTokenReviewLimits(t *testing.T) {
+	var reviews atomic.Int32
+	a := newTestTokenAuthenticator(&reviews)
+
+	// callers presenting ever new tokens are reviewed up to the burst, then turned away
+	var limited int
+	for i := range tokenReviewBurst * 2 {
+		if _, err := authenticateBearer(a, fmt.Sprintf("token-%d", i)); err != nil {
+			limited++
+		}
+	}
+	if int(reviews.Load()) > tokenReviewBurst+1 || limited < tokenReviewBurst-1 {
+		t.Errorf("%d token reviews and %d rejected, want the reviews limited to a burst of %d", reviews.Load(), limited, tokenReviewBurst)
+	}
+	// a cached token is not held up by the limit
+	if _, err := authenticateBearer(a, "token-0"); err != nil {
+		t.Errorf("cached token rejected: %v", err)
+	}
+
+	a.limiter.SetLimit(1 << 20)
+	a.limiter.SetBurst(1 << 20)
+	for i := range tokenReviewCacheSize * 2 {
+		if _, err := authenticateBearer(a, fmt.Sprintf("other-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(a.reviews) != tokenReviewCacheSize {
+		t.Errorf("%d cached verdicts, want at most %d", len(a.reviews), tokenReviewCacheSize)
+	}
+}
+
+func TestRequireCaller(t *testing.T) {
+	var reviews atomic.Int32
+	a := newTestTokenAuthenticator(&reviews)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name  string
+		auth  *callerAuthenticator
+		token string
+		want  int
+	}{
+		{name: "no authentication configured", want: http.StatusOK},
+		{name: "no token", auth: a, want: http.StatusUnauthorized},
+		{name: "reviewed token", auth: a, token: "apiserver", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, debugClientsPath, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			tt.auth.require(ok).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	k "github.com/netfoundry/ziti-k8s-agent/ziti-agent/pkg/kubernetes"
+	zitiedge "github.com/netfoundry/ziti-k8s-agent/ziti-agent/pkg/ziti-edge"
+	idcfg "github.com/openziti/identity"
+	"github.com/openziti/sdk-golang/ziti"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// clientManager owns the API clients shared by every admission handler in the webhook process.
+// The Kubernetes clientset is built on first use and then reused, and the Ziti management API
+// session is kept alive by zitiedge.Edge, which logs in again when the session expires.
+type clientManager struct {
+	kubeMu  sync.Mutex
+	kube    *kubernetes.Clientset
+	kubeErr error
+
+	edge *zitiedge.Edge
+	// cluster is the configured cluster id, or else resolved on first use
+	clusterMu sync.Mutex
+	cluster   string
+	// events is nil unless controller.events.enabled is set
+	events *zitiedge.EventStream
+}
+
+// clientManagerStatus is served on the debug endpoint
+type clientManagerStatus struct {
+	Kubernetes struct {
+		Initialized bool   `json:"initialized"`
+		Error       string `json:"error,omitempty"`
+	} `json:"kubernetes"`
+	Ziti   zitiedge.EdgeStatus `json:"ziti"`
+	Events *eventStreamStatus  `json:"events,omitempty"`
+}
+
+// eventStreamStatus is reported when the controller event stream is enabled
+type eventStreamStatus struct {
+	Connected bool   `json:"connected"`
+	Endpoint  string `json:"endpoint,omitempty"`
+}
+
+// newClientManager parses the admin credentials once and prepares a shared management API session
+// that fails over between the configured endpoints
+func newClientManager(identity *ZitiIdentityConfig, cfg *WebhookConfig) (*clientManager, error) {
+	edgeCfg, err := zitiEdgeConfig(identity, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &clientManager{
+		edge:    zitiedge.NewEdge(*edgeCfg, cfg.Controller.MgmtAPIEndpoints, edgeOptions(cfg)),
+		cluster: cfg.Controller.PodIdentities.ClusterID,
+	}
+	if cfg.Controller.Events.Enabled {
+		m.events = zitiedge.NewEventStream(m.edge)
+	}
+	return m, nil
+}
+
+// edgeOptions translates the controller section of the webhook configuration
+func edgeOptions(cfg *WebhookConfig) zitiedge.Options {
+	opts := zitiedge.Options{
+		Failover: zitiedge.FailoverConfig{
+			MinBackoff:    cfg.Controller.Failover.MinBackoff.Duration,
+			MaxBackoff:    cfg.Controller.Failover.MaxBackoff.Duration,
+			CheckInterval: cfg.Controller.Failover.CheckInterval.Duration,
+		},
+		Timeouts: zitiedge.Timeouts{
+			Default:    cfg.Controller.Timeouts.Default.Duration,
+			Operations: map[string]time.Duration{},
+		},
+		Retry: zitiedge.RetryPolicy{
+			MaxAttempts:    cfg.Controller.Retry.MaxAttempts,
+			InitialBackoff: cfg.Controller.Retry.InitialBackoff.Duration,
+			MaxBackoff:     cfg.Controller.Retry.MaxBackoff.Duration,
+		},
+	}
+	if !cfg.Controller.Discovery.Disabled && cfg.Controller.Overlay.Service == "" {
+		opts.Failover.DiscoveryInterval = cfg.Controller.Discovery.Interval.Duration
+	}
+	for function, timeout := range cfg.Controller.Timeouts.Operations {
+		opts.Timeouts.Operations[function] = timeout.Duration
+	}
+	return opts
+}
+
+// kubeClient returns the shared in-cluster clientset
+func (m *clientManager) kubeClient() (*kubernetes.Clientset, error) {
+	m.kubeMu.Lock()
+	defer m.kubeMu.Unlock()
+
+	if m.kube == nil {
+		m.kube, m.kubeErr = k.Client()
+	}
+	return m.kube, m.kubeErr
+}
+
+// clusterID returns the id identities are tagged with. Unless configured, it is the uid of the
+// kube-system namespace, which lives as long as the cluster.
+func (m *clientManager) clusterID(ctx context.Context, kube kubernetes.Interface) (string, error) {
+	m.clusterMu.Lock()
+	defer m.clusterMu.Unlock()
+
+	if m.cluster == "" {
+		ns, err := kube.CoreV1().Namespaces().Get(ctx, metav1.NamespaceSystem, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to read the cluster id: %w", err)
+		}
+		m.cluster = string(ns.UID)
+		klog.Infof("Tagging Ziti identities with cluster id %s", m.cluster)
+	}
+	return m.cluster, nil
+}
+
+func (m *clientManager) status() clientManagerStatus {
+	var status clientManagerStatus
+
+	m.kubeMu.Lock()
+	status.Kubernetes.Initialized = m.kube != nil
+	if m.kubeErr != nil {
+		status.Kubernetes.Error = m.kubeErr.Error()
+	}
+	m.kubeMu.Unlock()
+	status.Ziti = m.edge.Status()
+	if m.events != nil {
+		connected, endpoint := m.events.Connected()
+		status.Events = &eventStreamStatus{Connected: connected, Endpoint: endpoint}
+	}
+
+	return status
+}
+
+// serveStatus reports the state of the shared clients, such as the active management API
+// endpoint, the age of the API session and which endpoints are being skipped
+func (m *clientManager) serveStatus(w http.ResponseWriter, r *http.Request) {
+	body, err := json.MarshalIndent(m.status(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(body); err != nil {
+		klog.Errorf("failed to write client status: %v", err)
+	}
+}
+
+// zitiEdgeConfig builds the management API client configuration for the configured
+// authentication method
+func zitiEdgeConfig(identity *ZitiIdentityConfig, cfg *WebhookConfig) (*zitiedge.Config, error) {
+	if identity == nil {
+		return nil, fmt.Errorf("ziti identity not loaded")
+	}
+
+	edgeCfg := &zitiedge.Config{
+		AuthMethod: cfg.Controller.Auth.Method,
+		TLS: zitiedge.TLSVerification{
+			VerifyURL:     cfg.Controller.TLS.VerifyURL,
+			ServerName:    cfg.Controller.TLS.ServerName,
+			CAFingerprint: cfg.Controller.TLS.CAFingerprint,
+		},
+	}
+	if cfg.Controller.TLS.Preset != tlsPresetNone {
+		edgeCfg.TLS.Preset = cfg.Controller.TLS.Preset
+	}
+	switch cfg.Controller.Auth.Method {
+	case zitiedge.AuthMethodUpdb:
+		password, err := os.ReadFile(cfg.Controller.Auth.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read management API password: %w", err)
+		}
+		edgeCfg.Username = cfg.Controller.Auth.Username
+		edgeCfg.Password = strings.TrimSpace(string(password))
+	case zitiedge.AuthMethodExtJWT:
+		edgeCfg.JWTFile = cfg.Controller.Auth.JWTFile
+	default:
+		if err := loadAdminCertificate(identity, edgeCfg); err != nil {
+			return nil, err
+		}
+	}
+
+	zitiCtrlCaBundle := []byte(identity.ID.CA)
+	if cfg.Controller.Auth.CAFile != "" {
+		bundle, err := os.ReadFile(cfg.Controller.Auth.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read controller CA bundle: %w", err)
+		}
+		zitiCtrlCaBundle = bundle
+	}
+	if len(zitiCtrlCaBundle) == 0 && cfg.Controller.Overlay.Service != "" {
+		return nil, fmt.Errorf("controller.overlay requires id.ca in the identity or controller.auth.caFile")
+	}
+	if len(zitiCtrlCaBundle) == 0 {
+		klog.Infof("No controller CA bundle configured, fetching it from the controller")
+		bundle, err := zitiedge.LoadControllerCAs(cfg.Controller.MgmtAPIEndpoints, edgeCfg.TLS, cfg.Controller.CABootstrap.Fingerprint, cfg.Controller.CABootstrap.CacheFile, cfg.Controller.CABootstrap.AllowUnpinned)
+		if errors.Is(err, zitiedge.ErrUnpinnedCAs) {
+			return nil, fmt.Errorf("cannot fetch the controller CA bundle: %w; set controller.caBootstrap.fingerprint, or controller.caBootstrap.allowUnpinned to trust it on first use", err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		zitiCtrlCaBundle = bundle
+	}
+	klog.V(4).Infof("Loading CA bundle, size: %d bytes", len(zitiCtrlCaBundle))
+	klog.V(5).Infof("CA bundle content: %s", string(zitiCtrlCaBundle))
+
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(zitiCtrlCaBundle) {
+		err := fmt.Errorf("failed to append CA certificates from PEM")
+		return nil, err
+	}
+	edgeCfg.CAS = *certPool
+	edgeCfg.CABundle = zitiCtrlCaBundle
+
+	if cfg.Controller.Overlay.Service != "" {
+		overlay, err := newOverlay(identity, cfg)
+		if err != nil {
+			return nil, err
+		}
+		edgeCfg.Overlay = overlay
+	}
+
+	return edgeCfg, nil
+}
+
+// newOverlay loads the identity that dials the management API service into a ziti.Context
+func newOverlay(identity *ZitiIdentityConfig, cfg *WebhookConfig) (*zitiedge.Overlay, error) {
+	var (
+		zitiCfg *ziti.Config
+		err     error
+	)
+	if cfg.Controller.Overlay.IdentityFile != "" {
+		zitiCfg, err = ziti.NewConfigFromFile(cfg.Controller.Overlay.IdentityFile)
+	} else {
+		zitiCfg, err = overlayConfig(identity)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load overlay identity: %w", err)
+	}
+
+	zitiCtx, err := ziti.NewContext(zitiCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create overlay context: %w", err)
+	}
+	klog.Infof("Reaching the management API over the Ziti service %s", cfg.Controller.Overlay.Service)
+	return &zitiedge.Overlay{Context: zitiCtx, Service: cfg.Controller.Overlay.Service}, nil
+}
+
+// overlayConfig turns the identity from ZITI_IDENTITY_JSON into an SDK configuration
+func overlayConfig(identity *ZitiIdentityConfig) (*ziti.Config, error) {
+	if identity.ID.Cert == "" || identity.ID.Key == "" {
+		return nil, fmt.Errorf("ZITI_IDENTITY_JSON has no certificate to dial with - set controller.overlay.identityFile")
+	}
+	zitiCfg := ziti.NewConfig(identity.ZtAPI, idcfg.Config{
+		Cert: identity.ID.Cert,
+		Key:  identity.ID.Key,
+		CA:   identity.ID.CA,
+	})
+	zitiCfg.ZtAPIs = identity.ZtAPIs
+	return zitiCfg, nil
+}
+
+// loadAdminCertificate parses the client certificate and key of the admin identity
+func loadAdminCertificate(identity *ZitiIdentityConfig, edgeCfg *zitiedge.Config) error {
+	// Debug certificate and key data
+	klog.V(4).Infof("Certificate data length: %d bytes", len(identity.ID.Cert))
+	klog.V(4).Infof("Private key data length: %d bytes", len(identity.ID.Key))
+	if len(identity.ID.Cert) > 100 {
+		klog.V(5).Infof("Certificate data preview: %s...", identity.ID.Cert[:100])
+	} else {
+		klog.V(5).Infof("Certificate data preview: %s", identity.ID.Cert)
+	}
+	if len(identity.ID.Key) > 100 {
+		klog.V(5).Infof("Private key data preview: %s...", identity.ID.Key[:100])
+	} else {
+		klog.V(5).Infof("Private key data preview: %s", identity.ID.Key)
+	}
+
+	// Clean certificate and key data by removing "pem:" prefix if present
+	certData := identity.ID.Cert
+	keyData := identity.ID.Key
+
+	if strings.HasPrefix(certData, "pem:") {
+		certData = strings.TrimPrefix(certData, "pem:")
+		klog.V(4).Infof("Removed 'pem:' prefix from certificate data")
+	}
+	if strings.HasPrefix(keyData, "pem:") {
+		keyData = strings.TrimPrefix(keyData, "pem:")
+		klog.V(4).Infof("Removed 'pem:' prefix from private key data")
+	}
+
+	// parse ziti admin certs to synchronously (blocking) create a ziti identity
+	zitiAdminIdentity, err := tls.X509KeyPair([]byte(certData), []byte(keyData))
+	if err != nil {
+		return fmt.Errorf("failed to parse X509 key pair: %w", err)
+	}
+
+	if len(zitiAdminIdentity.Certificate) == 0 {
+		err := fmt.Errorf("no certificates found in TLS key pair")
+		return err
+	}
+
+	parsedCert, err := x509.ParseCertificate(zitiAdminIdentity.Certificate[0])
+	if err != nil {
+		return err
+	}
+	edgeCfg.Cert = parsedCert
+	edgeCfg.PrivateKey = zitiAdminIdentity.PrivateKey
+
+	// Log certificate details and analyze key usage compatibility
+	klog.V(4).Infof("Client certificate Subject: %v", parsedCert.Subject)
+	klog.V(4).Infof("Client certificate Issuer: %v", parsedCert.Issuer)
+	klog.V(4).Infof("Client certificate Valid from: %v to %v", parsedCert.NotBefore, parsedCert.NotAfter)
+
+	return nil
+}
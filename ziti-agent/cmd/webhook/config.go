@@ -1,14 +1,18 @@
 package webhook
 
 import (
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
+	zitiedge "github.com/netfoundry/ziti-k8s-agent/ziti-agent/pkg/ziti-edge"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/yaml"
 )
@@ -26,12 +30,92 @@ type ZitiIdentityConfig struct {
 
 type WebhookConfig struct {
 	Server struct {
-		Port int `yaml:"port"`
+		Port             int             `yaml:"port"`
+		ShutdownDelay    metav1.Duration `yaml:"shutdownDelay"`    // Optional - time to keep serving after SIGTERM while the pod is removed from the service endpoints
+		ShutdownTimeout  metav1.Duration `yaml:"shutdownTimeout"`  // How long to wait for in-flight admissions to finish on shutdown
+		AdmissionTimeout metav1.Duration `yaml:"admissionTimeout"` // Webhook timeout assumed when the kube-apiserver does not pass one
+		CertFile         string          `yaml:"certFile"`         // Optional - if empty, TLS_CERT and TLS_PRIVATE_KEY are read from the environment
+		KeyFile          string          `yaml:"keyFile"`
+		MinTLSVersion    string          `yaml:"minTLSVersion"` // "1.2" (default) or "1.3"
+		CipherSuites     []string        `yaml:"cipherSuites"`  // Optional - IANA names, only used for TLS 1.2
 	} `yaml:"server"`
 
+	Authentication struct {
+		ClientCAFile       string   `yaml:"clientCAFile"`       // Optional - verify kube-apiserver client certificates against this CA bundle
+		AllowedCommonNames []string `yaml:"allowedCommonNames"` // Optional - accepted client certificate common names, any verified one if empty
+		TokenReview        bool     `yaml:"tokenReview"`        // Authenticate bearer tokens with the TokenReview API
+		AllowedUsers       []string `yaml:"allowedUsers"`       // Optional - accepted TokenReview usernames, any authenticated one if empty
+	} `yaml:"authentication"`
+
 	Controller struct {
 		MgmtAPI string `yaml:"mgmtApi"` // Optional - if empty, will be inferred from identity
 		RoleKey string `yaml:"roleKey"`
+		// Auth selects how the webhook logs in to the management API. With cert, the admin identity
+		// from ZITI_IDENTITY_JSON is used; updb and ext-jwt read their secrets from files so that
+		// rotated credentials are picked up at the next login.
+		Auth struct {
+			Method       string `yaml:"method"`       // cert (default), updb or ext-jwt
+			Username     string `yaml:"username"`     // updb only
+			PasswordFile string `yaml:"passwordFile"` // updb only
+			JWTFile      string `yaml:"jwtFile"`      // ext-jwt only
+			CAFile       string `yaml:"caFile"`       // Optional - controller CA bundle, defaults to id.ca of the identity
+		} `yaml:"auth"`
+		// CABootstrap fetches the controller CA bundle from /.well-known/est/cacerts when neither
+		// id.ca nor controller.auth.caFile provide one
+		CABootstrap struct {
+			Fingerprint   string `yaml:"fingerprint"`   // Optional - SHA-256 fingerprint of the controller root CA to pin
+			CacheFile     string `yaml:"cacheFile"`     // Optional - where the fetched bundle is kept across restarts
+			AllowUnpinned bool   `yaml:"allowUnpinned"` // Trust the first bundle fetched when no fingerprint is set, which an attacker on the path to the controller can substitute
+		} `yaml:"caBootstrap"`
+		// TLS adjusts how the controller certificate is verified before logging in
+		TLS struct {
+			Preset        string `yaml:"preset"`        // netfoundry (default) maps <id>-p.<env>.netfoundry.io to the certificate host; none turns presets off
+			VerifyURL     string `yaml:"verifyUrl"`     // Optional - base URL of the controller to verify instead of the management API endpoint
+			ServerName    string `yaml:"serverName"`    // Optional - name the controller certificate must be valid for, also sent as SNI
+			CAFingerprint string `yaml:"caFingerprint"` // Optional - SHA-256 fingerprint of a CA the controller certificate must chain to
+		} `yaml:"tls"`
+		// Overlay reaches the management API through the Ziti service that fronts it, for
+		// controllers that do not expose the management port. Discovery is skipped with it.
+		Overlay struct {
+			Service      string `yaml:"service"`      // Optional - Ziti service name; the management API is reached directly if empty
+			IdentityFile string `yaml:"identityFile"` // Optional - identity dialing the service, defaults to the one in ZITI_IDENTITY_JSON
+		} `yaml:"overlay"`
+		// PodIdentities sets optional fields of the identities created for pods; fields the
+		// controller does not support are skipped with a warning
+		PodIdentities struct {
+			AuthPolicy string `yaml:"authPolicy"` // Optional - id of the auth policy, controllers since v0.22
+			ClusterID  string `yaml:"clusterId"`  // Optional - tags identities with the cluster they belong to, defaults to the uid of the kube-system namespace
+			// PendingGracePeriod is how long an identity handed to a pod may wait for the pod to be
+			// created before it is deleted, e.g. when the apiserver rejected the mutated pod
+			PendingGracePeriod metav1.Duration `yaml:"pendingGracePeriod"`
+		} `yaml:"podIdentities"`
+		// Failover tunes how calls move between management API endpoints when one cannot be reached
+		Failover struct {
+			MinBackoff    metav1.Duration `yaml:"minBackoff"`    // How long a failing endpoint is skipped, doubling with each consecutive failure
+			MaxBackoff    metav1.Duration `yaml:"maxBackoff"`    // Upper bound on how long a failing endpoint is skipped
+			CheckInterval metav1.Duration `yaml:"checkInterval"` // How often skipped endpoints are probed in the background
+		} `yaml:"failover"`
+		// Discovery adds the management API addresses advertised by the members of an HA
+		// controller cluster to the endpoints inferred or configured here
+		Discovery struct {
+			Disabled bool            `yaml:"disabled"`
+			Interval metav1.Duration `yaml:"interval"` // How often the controller cluster members are listed
+		} `yaml:"discovery"`
+		// Events follows the controller event stream to log edge routers going online or offline
+		Events struct {
+			Enabled bool `yaml:"enabled"`
+		} `yaml:"events"`
+		// Timeouts bound each management API request; the admission deadline bounds them all
+		Timeouts struct {
+			Default    metav1.Duration            `yaml:"default"`
+			Operations map[string]metav1.Duration `yaml:"operations"` // Optional - by zitiedge function, e.g. CreateIdentity
+		} `yaml:"timeouts"`
+		// Retry repeats management API calls that failed transiently, such as on a 503
+		Retry struct {
+			MaxAttempts    int             `yaml:"maxAttempts"` // Including the first try; 1 turns retries off
+			InitialBackoff metav1.Duration `yaml:"initialBackoff"`
+			MaxBackoff     metav1.Duration `yaml:"maxBackoff"`
+		} `yaml:"retry"`
 		// Runtime fields populated during config loading
 		MgmtAPIEndpoints []string `yaml:"-"` // List of management API endpoints to try
 	} `yaml:"controller"`
@@ -58,6 +142,48 @@ type WebhookConfig struct {
 		Zone string `yaml:"zone"`
 	} `yaml:"clusterDns"`
 
+	Shadow struct {
+		Enabled bool `yaml:"enabled"` // Only log and record what admissions would do; namespaces can override with an annotation
+	} `yaml:"shadow"`
+
+	// GC removes the identities and edge routers left behind by pods whose DELETE admission never
+	// reached the webhook, e.g. after a force delete or while the webhook was down
+	GC struct {
+		Enabled       bool            `yaml:"enabled"` // Run the collector on the replica holding the lease
+		Interval      metav1.Duration `yaml:"interval"`
+		GracePeriod   metav1.Duration `yaml:"gracePeriod"`   // How old an identity or edge router without a pod must be before it is collected
+		Action        string          `yaml:"action"`        // delete (default) or disable
+		AdoptUntagged bool            `yaml:"adoptUntagged"` // Also collect objects with the prefix but no cluster tag, e.g. created by earlier releases; unsafe when clusters share a network and prefix
+		Lease         leaseConfig     `yaml:"lease"`
+	} `yaml:"gc"`
+
+	// PodController reconciles the role attributes and deletion of tunnel pod identities from a
+	// pod informer instead of in UPDATE and DELETE admissions, which are then admitted untouched
+	// and can be left out of the webhook rules
+	PodController struct {
+		Enabled      bool            `yaml:"enabled"`
+		Workers      int             `yaml:"workers"`      // Pods reconciled at the same time
+		ResyncPeriod metav1.Duration `yaml:"resyncPeriod"` // Optional - how often every pod is reconciled again, never if zero
+		Lease        leaseConfig     `yaml:"lease"`
+	} `yaml:"podController"`
+
+	Metrics struct {
+		Port int    `yaml:"port"` // Optional - if zero or the server port, metrics are served on the webhook TLS server
+		Path string `yaml:"path"`
+	} `yaml:"metrics"`
+
+	// Debug exposes /debug/clients with the management API endpoints, API session age and circuit
+	// breaker state, next to the metrics
+	Debug struct {
+		Clients bool `yaml:"clients"`
+	} `yaml:"debug"`
+
+	Health struct {
+		ReadinessWindow metav1.Duration `yaml:"readinessWindow"` // How long the pod stays ready after the last successful management API login check
+		CheckInterval   metav1.Duration `yaml:"checkInterval"`
+		CheckTimeout    metav1.Duration `yaml:"checkTimeout"`
+	} `yaml:"health"`
+
 }
 
 func loadConfig(path string) (*WebhookConfig, error) {
@@ -71,6 +197,7 @@ func loadConfig(path string) (*WebhookConfig, error) {
 		return nil, fmt.Errorf("parse config: %w", err)
 	}
 
+	applyConfigEnv(&cfg)
 	applyConfigDefaults(&cfg)
 	
 	// If mgmtApi is not specified, infer from identity configuration
@@ -90,11 +217,27 @@ func loadConfig(path string) (*WebhookConfig, error) {
 	return &cfg, nil
 }
 
+// applyConfigEnv fills settings the config file leaves empty from the environment variables the
+// operator sets on the webhook deployment
+func applyConfigEnv(cfg *WebhookConfig) {
+	if value, ok := os.LookupEnv("ZITI_MGMT_API_SERVICE"); ok && value != "" && cfg.Controller.Overlay.Service == "" {
+		cfg.Controller.Overlay.Service = value
+	}
+}
+
 func applyConfigDefaults(cfg *WebhookConfig) {
 	if cfg.Server.Port == 0 {
 		cfg.Server.Port = 9443
 	}
 
+	if cfg.Server.ShutdownTimeout.Duration == 0 {
+		cfg.Server.ShutdownTimeout.Duration = 20 * time.Second
+	}
+
+	if cfg.Server.AdmissionTimeout.Duration == 0 {
+		cfg.Server.AdmissionTimeout.Duration = 30 * time.Second
+	}
+
 	if cfg.Sidecar.ImagePullPolicy == "" {
 		cfg.Sidecar.ImagePullPolicy = defaultImagePullPolicy
 	}
@@ -119,10 +262,94 @@ func applyConfigDefaults(cfg *WebhookConfig) {
 		cfg.Controller.RoleKey = defaultZitiRoleAttributesKey
 	}
 
+	if cfg.Controller.Auth.Method == "" {
+		cfg.Controller.Auth.Method = zitiedge.AuthMethodCert
+	}
+
+	if cfg.Controller.TLS.Preset == "" {
+		cfg.Controller.TLS.Preset = zitiedge.TLSPresetNetFoundry
+	}
+
+	if cfg.Controller.Failover.MinBackoff.Duration == 0 {
+		cfg.Controller.Failover.MinBackoff.Duration = time.Second
+	}
+
+	if cfg.Controller.Failover.MaxBackoff.Duration == 0 {
+		cfg.Controller.Failover.MaxBackoff.Duration = 2 * time.Minute
+	}
+
+	if cfg.Controller.Failover.CheckInterval.Duration == 0 {
+		cfg.Controller.Failover.CheckInterval.Duration = 15 * time.Second
+	}
+
+	if cfg.Controller.Timeouts.Default.Duration == 0 {
+		cfg.Controller.Timeouts.Default.Duration = 30 * time.Second
+	}
+
+	if cfg.Controller.Retry.MaxAttempts == 0 {
+		cfg.Controller.Retry.MaxAttempts = 3
+	}
+
+	if cfg.Controller.Retry.InitialBackoff.Duration == 0 {
+		cfg.Controller.Retry.InitialBackoff.Duration = 200 * time.Millisecond
+	}
+
+	if cfg.Controller.Retry.MaxBackoff.Duration == 0 {
+		cfg.Controller.Retry.MaxBackoff.Duration = 2 * time.Second
+	}
+
+	if cfg.Controller.PodIdentities.PendingGracePeriod.Duration == 0 {
+		cfg.Controller.PodIdentities.PendingGracePeriod.Duration = 10 * time.Minute
+	}
+
+	if cfg.GC.Interval.Duration == 0 {
+		cfg.GC.Interval.Duration = time.Hour
+	}
+
+	if cfg.GC.GracePeriod.Duration == 0 {
+		cfg.GC.GracePeriod.Duration = time.Hour
+	}
+
+	if cfg.GC.Action == "" {
+		cfg.GC.Action = gcActionDelete
+	}
+
+	if cfg.GC.Lease.Name == "" {
+		cfg.GC.Lease.Name = "ziti-agent-gc"
+	}
+
+	if cfg.PodController.Workers == 0 {
+		cfg.PodController.Workers = 4
+	}
+
+	if cfg.PodController.Lease.Name == "" {
+		cfg.PodController.Lease.Name = "ziti-agent-pod-controller"
+	}
+
+	if cfg.Controller.Discovery.Interval.Duration == 0 {
+		cfg.Controller.Discovery.Interval.Duration = 5 * time.Minute
+	}
+
 	if cfg.ClusterDns.Zone == "" {
 		cfg.ClusterDns.Zone = "cluster.local"
 	}
 
+	if cfg.Metrics.Path == "" {
+		cfg.Metrics.Path = "/metrics"
+	}
+
+	if cfg.Health.ReadinessWindow.Duration == 0 {
+		cfg.Health.ReadinessWindow.Duration = 2 * time.Minute
+	}
+
+	if cfg.Health.CheckInterval.Duration == 0 {
+		cfg.Health.CheckInterval.Duration = 30 * time.Second
+	}
+
+	if cfg.Health.CheckTimeout.Duration == 0 {
+		cfg.Health.CheckTimeout.Duration = 10 * time.Second
+	}
+
 }
 
 func validateConfig(cfg *WebhookConfig) error {
@@ -140,21 +367,101 @@ func validateConfig(cfg *WebhookConfig) error {
 		return errors.New("sidecar.imageVersion is required")
 	}
 
+	if (cfg.Server.CertFile == "") != (cfg.Server.KeyFile == "") {
+		return errors.New("server.certFile and server.keyFile must be set together")
+	}
+
+	if len(cfg.Authentication.AllowedCommonNames) > 0 && cfg.Authentication.ClientCAFile == "" {
+		return errors.New("authentication.allowedCommonNames requires authentication.clientCAFile")
+	}
+
+	if len(cfg.Authentication.AllowedUsers) > 0 && !cfg.Authentication.TokenReview {
+		return errors.New("authentication.allowedUsers requires authentication.tokenReview")
+	}
+
+	switch cfg.Controller.Auth.Method {
+	case zitiedge.AuthMethodCert:
+	case zitiedge.AuthMethodUpdb:
+		if cfg.Controller.Auth.Username == "" || cfg.Controller.Auth.PasswordFile == "" {
+			return errors.New("controller.auth.method updb requires controller.auth.username and controller.auth.passwordFile")
+		}
+	case zitiedge.AuthMethodExtJWT:
+		if cfg.Controller.Auth.JWTFile == "" {
+			return errors.New("controller.auth.method ext-jwt requires controller.auth.jwtFile")
+		}
+	default:
+		return fmt.Errorf("controller.auth.method must be one of cert, updb or ext-jwt, got %q", cfg.Controller.Auth.Method)
+	}
+
+	if !validFingerprint(cfg.Controller.CABootstrap.Fingerprint) {
+		return errors.New("controller.caBootstrap.fingerprint must be a hex encoded SHA-256 fingerprint")
+	}
+
+	if !validFingerprint(cfg.Controller.TLS.CAFingerprint) {
+		return errors.New("controller.tls.caFingerprint must be a hex encoded SHA-256 fingerprint")
+	}
+
+	switch cfg.Controller.TLS.Preset {
+	case zitiedge.TLSPresetNetFoundry, tlsPresetNone:
+	default:
+		return fmt.Errorf("controller.tls.preset must be netfoundry or none, got %q", cfg.Controller.TLS.Preset)
+	}
+
+	if verifyURL := cfg.Controller.TLS.VerifyURL; verifyURL != "" {
+		if parsed, err := url.Parse(verifyURL); err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			return fmt.Errorf("controller.tls.verifyUrl must be an https URL, got %q", verifyURL)
+		}
+	}
+
+	if cfg.Controller.Failover.MaxBackoff.Duration < cfg.Controller.Failover.MinBackoff.Duration {
+		return errors.New("controller.failover.maxBackoff must not be shorter than controller.failover.minBackoff")
+	}
+
+	if cfg.Controller.Retry.MaxAttempts < 0 {
+		return errors.New("controller.retry.maxAttempts must not be negative")
+	}
+
+	switch cfg.GC.Action {
+	case gcActionDelete, gcActionDisable:
+	default:
+		return fmt.Errorf("gc.action must be delete or disable, got %q", cfg.GC.Action)
+	}
+
+	if cfg.GC.GracePeriod.Duration < cfg.Controller.PodIdentities.PendingGracePeriod.Duration {
+		return errors.New("gc.gracePeriod must not be shorter than controller.podIdentities.pendingGracePeriod")
+	}
+
+	if cfg.PodController.Workers < 0 {
+		return errors.New("podController.workers must not be negative")
+	}
+
+	if cfg.Health.ReadinessWindow.Duration < cfg.Health.CheckInterval.Duration {
+		return errors.New("health.readinessWindow must not be shorter than health.checkInterval")
+	}
+
 	return nil
 }
 
-func configTLS(cert, key []byte) *tls.Config {
-	sCert, err := tls.X509KeyPair(cert, key)
-	if err != nil {
-		klog.Fatalf("failed to load webhook server TLS key pair: %v", err)
+// validFingerprint accepts an empty fingerprint or a SHA-256 one in hex, optionally colon separated
+func validFingerprint(fingerprint string) bool {
+	if fingerprint == "" {
+		return true
 	}
-	return &tls.Config{Certificates: []tls.Certificate{sCert}}
+	decoded, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	return err == nil && len(decoded) == sha256.Size
 }
 
-// loadZitiIdentityFromEnv loads the Ziti identity configuration from ZITI_IDENTITY_JSON environment variable
-func loadZitiIdentityFromEnv() (*ZitiIdentityConfig, error) {
+// loadZitiIdentityFromEnv loads the Ziti identity configuration from ZITI_IDENTITY_JSON environment variable.
+// The identity is only required for cert authentication; with other methods an empty identity is
+// returned when the variable is not set.
+func loadZitiIdentityFromEnv(cfg *WebhookConfig) (*ZitiIdentityConfig, error) {
+	certAuth := cfg.Controller.Auth.Method == zitiedge.AuthMethodCert
+
 	identityJSON, ok := os.LookupEnv("ZITI_IDENTITY_JSON")
 	if !ok || identityJSON == "" {
+		if !certAuth {
+			return &ZitiIdentityConfig{}, nil
+		}
 		return nil, errors.New("ZITI_IDENTITY_JSON environment variable is required and must contain valid JSON")
 	}
 
@@ -163,14 +470,11 @@ func loadZitiIdentityFromEnv() (*ZitiIdentityConfig, error) {
 		return nil, fmt.Errorf("failed to parse Ziti identity JSON from environment variable: %w", err)
 	}
 
-	// Validate required fields
-	if identity.ID.CA == "" {
-		return nil, errors.New("ziti identity missing required field: id.ca")
-	}
-	if identity.ID.Cert == "" {
+	// Validate required fields; without id.ca the controller CA bundle is fetched from the controller
+	if certAuth && identity.ID.Cert == "" {
 		return nil, errors.New("ziti identity missing required field: id.cert")
 	}
-	if identity.ID.Key == "" {
+	if certAuth && identity.ID.Key == "" {
 		return nil, errors.New("ziti identity missing required field: id.key")
 	}
 
@@ -179,8 +483,10 @@ func loadZitiIdentityFromEnv() (*ZitiIdentityConfig, error) {
 }
 
 // inferMgmtAPIEndpoints infers management API endpoints from the Ziti identity configuration
+// These are the starting point; members of an HA controller cluster are added at runtime unless
+// controller.discovery.disabled is set.
 func inferMgmtAPIEndpoints(cfg *WebhookConfig) error {
-	identity, err := loadZitiIdentityFromEnv()
+	identity, err := loadZitiIdentityFromEnv(cfg)
 	if err != nil {
 		return fmt.Errorf("failed to load Ziti identity for endpoint inference: %w", err)
 	}
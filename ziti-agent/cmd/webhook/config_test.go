@@ -0,0 +1,41 @@
+package webhook
+
+import (
+	"os"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestApplyConfigEnv(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// env is the value of ZITI_MGMT_API_SERVICE, which is unset unless envSet
+		env    string
+		envSet bool
+		want   string
+	}{
+		{name: "unset", config: `{}`},
+		{name: "environment", config: `{}`, env: "env-mgmt", envSet: true, want: "env-mgmt"},
+		{name: "empty environment", config: `{}`, envSet: true},
+		{name: "config file", config: `{controller: {overlay: {service: file-mgmt}}}`, want: "file-mgmt"},
+		{name: "config file over environment", config: `{controller: {overlay: {service: file-mgmt}}}`, env: "env-mgmt", envSet: true, want: "file-mgmt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ZITI_MGMT_API_SERVICE", tt.env)
+			if !tt.envSet {
+				os.Unsetenv("ZITI_MGMT_API_SERVICE")
+			}
+			var cfg WebhookConfig
+			if err := yaml.Unmarshal([]byte(tt.config), &cfg); err != nil {
+				t.Fatal(err)
+			}
+			applyConfigEnv(&cfg)
+			if got := cfg.Controller.Overlay.Service; got != tt.want {
+				t.Errorf("management API service %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
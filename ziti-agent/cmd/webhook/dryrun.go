@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"context"
+
+	"github.com/openziti/edge-api/rest_management_api_client/edge_router"
+	rest_model_edge "github.com/openziti/edge-api/rest_model"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// dryRunIdentityName and dryRunToken stand in for the identity a real admission would create
+	dryRunIdentityName = "dry-run"
+	dryRunToken        = "dry-run-placeholder-enrollment-token"
+
+	dryRunWarning = "dry run: no Ziti identities, routers or volumes were created, changed or deleted; the enrollment token is a placeholder"
+)
+
+// forDryRun returns a copy of the handler whose Ziti and cluster clients perform no writes, so a
+// server-side dry run produces the same patch shape without side effects
+func (zh *zitiHandler) forDryRun() *zitiHandler {
+	return &zitiHandler{
+		KC:         &dryRunClusterClient{clusterClientIntf: zh.KC},
+		ZC:         dryRunZitiClient{},
+		Config:     zh.Config,
+		dryRun:     true,
+		createOnly: zh.createOnly,
+	}
+}
+
+// identityName names the identity or router for a pod, or returns a placeholder during a dry run
+func (zh *zitiHandler) identityName(podMeta *metav1.ObjectMeta, uid types.UID) (string, error) {
+	if zh.dryRun {
+		return zh.Config.Prefix + "-" + dryRunIdentityName, nil
+	}
+	return buildZitiIdentityName(zh.Config.Prefix, podMeta, uid)
+}
+
+// dryRunClusterClient passes reads through to the cluster and drops writes
+type dryRunClusterClient struct {
+	clusterClientIntf
+}
+
+func (c *dryRunClusterClient) deletePvc(ctx context.Context, namespace string, name string) error {
+	return nil
+}
+
+func (c *dryRunClusterClient) recordEvent(ctx context.Context, namespace string, pod *corev1.Pod, reason string, message string) error {
+	return nil
+}
+
+// dryRunZitiClient answers every management API call without contacting the controller
+type dryRunZitiClient struct{}
+
+func (dryRunZitiClient) createIdentity(ctx context.Context, name string, roles []string, podMeta *metav1.ObjectMeta) (string, bool, error) {
+	return dryRunIdentityName, false, nil
+}
+
+func (dryRunZitiClient) deleteIdentity(ctx context.Context, id string) error {
+	return nil
+}
+
+func (dryRunZitiClient) deleteZitiRouter(ctx context.Context, name string) error {
+	return nil
+}
+
+func (dryRunZitiClient) getIdentityToken(ctx context.Context, name string, id string) (string, error) {
+	return dryRunToken, nil
+}
+
+func (dryRunZitiClient) getZitiRouterToken(ctx context.Context, name string) (string, error) {
+	return dryRunToken, nil
+}
+
+func (dryRunZitiClient) findIdentityId(ctx context.Context, name string) (string, error) {
+	return dryRunIdentityName, nil
+}
+
+func (dryRunZitiClient) syncIdentityRoles(ctx context.Context, name string, roles []string) error {
+	return nil
+}
+
+func (dryRunZitiClient) updateZitiRouter(ctx context.Context, name string, podMeta *metav1.ObjectMeta, options *rest_model_edge.EdgeRouterCreate) (*edge_router.CreateEdgeRouterCreated, error) {
+	return nil, nil
+}
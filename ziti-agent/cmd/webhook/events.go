@@ -0,0 +1,35 @@
+package webhook
+
+import (
+	"context"
+	"time"
+
+	zitiedge "github.com/netfoundry/ziti-k8s-agent/ziti-agent/pkg/ziti-edge"
+	"k8s.io/klog/v2"
+)
+
+// routerEventBuffer absorbs bursts of router events, e.g. when the controller restarts
+const routerEventBuffer = 64
+
+// logRouterEvents logs edge routers going online or offline until ctx is done, so that sidecars
+// failing to connect can be related to the routers they depend on
+func logRouterEvents(ctx context.Context, events *zitiedge.EventStream) {
+	routerEvents, unsubscribe := events.Subscribe(routerEventBuffer, zitiedge.EventNamespaceRouter)
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-routerEvents:
+			switch event.Type {
+			case zitiedge.EventTypeRouterOnline:
+				klog.Infof("Edge router %s is online", event.RouterID)
+			case zitiedge.EventTypeRouterOffline:
+				klog.Warningf("Edge router %s is offline", event.RouterID)
+			case zitiedge.EventTypeResumed:
+				klog.Infof("Controller event stream resumed, router changes since %s were missed", event.Since.Format(time.RFC3339))
+			}
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	k "github.com/netfoundry/ziti-k8s-agent/ziti-agent/pkg/kubernetes"
+	zitiedge "github.com/netfoundry/ziti-k8s-agent/ziti-agent/pkg/ziti-edge"
+	rest_model_edge "github.com/openziti/edge-api/rest_model"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// What the garbage collector does with an orphan
+const (
+	gcActionDelete  = "delete"
+	gcActionDisable = "disable"
+)
+
+// collector removes the identities and edge routers this agent created for pods that no longer
+// exist. They are recognized by the sidecar prefix in their name and by the cluster tag; objects
+// tagged for another cluster are never touched, and untagged ones only with adoptUntagged. An
+// object is an orphan when no pod refers to it and it is older than the grace period, which
+// covers pods that were admitted but not created yet.
+type collector struct {
+	edge          *zitiedge.Edge
+	prefix        string
+	cluster       string
+	grace         time.Duration
+	action        string
+	adoptUntagged bool
+}
+
+func newCollector(edge *zitiedge.Edge, cfg *WebhookConfig, cluster string) *collector {
+	return &collector{
+		edge:          edge,
+		prefix:        cfg.Sidecar.Prefix,
+		cluster:       cluster,
+		grace:         cfg.GC.GracePeriod.Duration,
+		action:        cfg.GC.Action,
+		adoptUntagged: cfg.GC.AdoptUntagged,
+	}
+}
+
+// gcObject is an identity or edge router of this agent
+type gcObject struct {
+	kind      string
+	id        string
+	name      string
+	createdAt time.Time
+	disabled  bool
+}
+
+// gcOrphan is an object without a pod and the outcome of collecting it
+type gcOrphan struct {
+	gcObject
+	result string
+	err    error
+}
+
+// gcReport summarizes one collection
+type gcReport struct {
+	checked  int // objects of this agent and cluster
+	untagged int // objects with the prefix but no cluster tag, left alone
+	orphans  []gcOrphan
+}
+
+// owns reports whether an object with this name and tags belongs to this agent and cluster, and
+// whether it carries no cluster tag
+func (c *collector) owns(name string, tags *rest_model_edge.Tags) (owned bool, untagged bool) {
+	if !strings.HasPrefix(name, c.prefix+"-") {
+		return false, false
+	}
+	var cluster string
+	if tags != nil {
+		cluster, _ = tags.SubTags[tagCluster].(string)
+	}
+	if cluster == "" {
+		return c.adoptUntagged, true
+	}
+	return cluster == c.cluster, false
+}
+
+// list returns the identities and edge routers of this agent and cluster, and how many untagged
+// ones were skipped
+func (c *collector) list(ctx context.Context) ([]gcObject, int, error) {
+	var (
+		objects  []gcObject
+		skipped  int
+		byPrefix = zitiedge.Contains("name", c.prefix+"-")
+	)
+	add := func(kind string, entity rest_model_edge.BaseEntity, name *string, disabled *bool) {
+		if entity.ID == nil || name == nil {
+			return
+		}
+		owned, untagged := c.owns(*name, entity.Tags)
+		if !owned {
+			if untagged {
+				skipped++
+			}
+			return
+		}
+		object := gcObject{kind: kind, id: *entity.ID, name: *name, disabled: disabled != nil && *disabled}
+		if entity.CreatedAt != nil {
+			object.createdAt = time.Time(*entity.CreatedAt)
+		}
+		objects = append(objects, object)
+	}
+
+	for identity, err := range zitiedge.ListIdentities(ctx, byPrefix, c.edge) {
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to list identities: %w", err)
+		}
+		// the identity of an edge router is removed along with the router
+		if identity.TypeID != nil && *identity.TypeID == string(rest_model_edge.IdentityTypeRouter) {
+			continue
+		}
+		add(rollbackIdentity, identity.BaseEntity, identity.Name, identity.Disabled)
+	}
+	for router, err := range zitiedge.ListEdgeRouters(ctx, byPrefix, c.edge) {
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to list edge routers: %w", err)
+		}
+		add(rollbackRouter, router.BaseEntity, router.Name, router.Disabled)
+	}
+	return objects, skipped, nil
+}
+
+// orphans picks the objects that no pod refers to and that are older than the grace period.
+// Disabled objects are left out when orphans are disabled, as there is nothing left to do.
+func (c *collector) orphans(objects []gcObject, pods []*corev1.Pod, now time.Time) []gcObject {
+	claimed := map[string]bool{}
+	for _, pod := range pods {
+		for _, name := range podIdentityNames(pod) {
+			claimed[name] = true
+		}
+	}
+
+	var orphans []gcObject
+	for _, object := range objects {
+		if claimed[object.name] || now.Sub(object.createdAt) < c.grace {
+			continue
+		}
+		if object.disabled && c.action == gcActionDisable {
+			continue
+		}
+		orphans = append(orphans, object)
+	}
+	return orphans
+}
+
+// collect removes or disables the orphans among the objects of this agent, given every pod of the
+// cluster. With dryRun nothing is changed.
+func (c *collector) collect(ctx context.Context, pods []*corev1.Pod, dryRun bool) (gcReport, error) {
+	objects, untagged, err := c.list(ctx)
+	if err != nil {
+		return gcReport{}, err
+	}
+
+	report := gcReport{checked: len(objects), untagged: untagged}
+	for _, object := range c.orphans(objects, pods, time.Now()) {
+		orphan := gcOrphan{gcObject: object, result: "would " + c.action}
+		if !dryRun {
+			orphan.result, orphan.err = c.remove(ctx, object)
+			if orphan.err != nil {
+				klog.Errorf("Failed to %s %s %s, which has no pod: %v", c.action, object.kind, object.name, orphan.err)
+			} else {
+				klog.Infof("Garbage collected %s %s, which has no pod: %s", object.kind, object.name, orphan.result)
+			}
+			gcOrphans.WithLabelValues(object.kind, orphan.result).Inc()
+		}
+		report.orphans = append(report.orphans, orphan)
+	}
+	return report, nil
+}
+
+// remove applies the configured action to an orphan and returns the result
+func (c *collector) remove(ctx context.Context, object gcObject) (string, error) {
+	var (
+		err    error
+		result = "deleted"
+	)
+	switch {
+	case c.action == gcActionDisable && object.kind == rollbackRouter:
+		result = "disabled"
+		err = zitiedge.DisableEdgeRouter(ctx, object.id, c.edge)
+	case c.action == gcActionDisable:
+		result = "disabled"
+		err = zitiedge.DisableIdentity(ctx, object.id, c.edge)
+	case object.kind == rollbackRouter:
+		err = zitiedge.DeleteEdgeRouter(ctx, object.id, c.edge)
+	default:
+		err = zitiedge.DeleteIdentity(ctx, object.id, c.edge)
+	}
+	// an object deleted meanwhile, e.g. by a late DELETE admission, is just as good
+	if err != nil && !errors.Is(err, zitiedge.ErrNotFound) {
+		return "error", err
+	}
+	return result, nil
+}
+
+// failed counts the orphans that could not be collected
+func (r gcReport) failed() int {
+	failed := 0
+	for _, orphan := range r.orphans {
+		if orphan.err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// write prints the orphans as a table followed by a summary
+func (r gcReport) write(out io.Writer, c *collector, now time.Time) error {
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "KIND\tNAME\tID\tAGE\tRESULT")
+	for _, orphan := range r.orphans {
+		result := orphan.result
+		if orphan.err != nil {
+			result = orphan.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", orphan.kind, orphan.name, orphan.id, duration.HumanDuration(now.Sub(orphan.createdAt)), result)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "\n%d of %d objects of cluster %s have no pod and are older than %s\n", len(r.orphans), r.checked, c.cluster, c.grace)
+	if r.untagged > 0 {
+		fmt.Fprintf(out, "%d objects named %s-* carry no cluster tag and were skipped, see gc.adoptUntagged\n", r.untagged, c.prefix)
+	}
+	return nil
+}
+
+// runGC collects orphans every interval while this replica holds the lease, so that replicas do
+// not collect at the same time. Pods are followed by an informer that only runs on the leader.
+func runGC(ctx context.Context, cfg *WebhookConfig, m *clientManager) {
+	kube, err := m.kubeClient()
+	if err != nil {
+		klog.Errorf("Garbage collection is off: failed to initialize kube-apiserver client: %v", err)
+		return
+	}
+	cluster, err := m.clusterID(ctx, kube)
+	if err != nil {
+		klog.Errorf("Garbage collection is off: %v", err)
+		return
+	}
+	c := newCollector(m.edge, cfg, cluster)
+
+	err = whileLeading(ctx, kube, cfg.GC.Lease, func(ctx context.Context) {
+		klog.Infof("Collecting orphaned Ziti objects every %s", cfg.GC.Interval.Duration)
+		c.run(ctx, kube, cfg.GC.Interval.Duration)
+	})
+	if err != nil {
+		klog.Errorf("Garbage collection is off: %v", err)
+	}
+}
+
+// run collects orphans every interval until ctx is done, starting once the pod informer synced
+func (c *collector) run(ctx context.Context, kube kubernetes.Interface, interval time.Duration) {
+	factory := informers.NewSharedInformerFactory(kube, 0)
+	pods := factory.Core().V1().Pods()
+	informer := pods.Informer()
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		live, err := pods.Lister().List(labels.Everything())
+		if err != nil {
+			klog.Errorf("Cannot list pods to collect orphaned Ziti objects: %v", err)
+		} else if report, err := c.collect(ctx, live, false); err != nil {
+			klog.Errorf("Cannot collect orphaned Ziti objects: %v", err)
+		} else {
+			gcLastRun.SetToCurrentTime()
+			klog.V(2).Infof("Checked %d Ziti objects, %d orphans collected, %d failed", report.checked, len(report.orphans)-report.failed(), report.failed())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// NewGCCmd runs the garbage collector once, with the configuration file of the webhook
+func NewGCCmd() *cobra.Command {
+	var (
+		configFile string
+		kubeconfig string
+		dryRun     bool
+	)
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Removes the Ziti identities and edge routers of pods that no longer exist",
+		Long: `
+Lists the Ziti identities and edge routers the webhook created for pods of this cluster,
+compares them with the pods that exist, and deletes or disables those that have no pod and
+are older than the grace period, as configured in the gc section of the webhook configuration. The admin
+identity is read from ZITI_IDENTITY_JSON, as for the webhook. With --dry-run only the report
+is printed.`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return gcOnce(cmd.Context(), cmd.OutOrStdout(), configFile, kubeconfig, dryRun)
+		},
+	}
+
+	gcCmd.Flags().StringVar(&configFile, "config", "",
+		"Path to the webhook configuration file")
+	gcCmd.Flags().StringVar(&kubeconfig, "kubeconfig", "",
+		"Path to the kubeconfig file, the in-cluster configuration is used if none is found")
+	gcCmd.Flags().BoolVar(&dryRun, "dry-run", false,
+		"Only print the orphans that would be removed")
+	_ = gcCmd.MarkFlagRequired("config")
+
+	return gcCmd
+}
+
+func gcOnce(ctx context.Context, out io.Writer, configFile, kubeconfig string, dryRun bool) error {
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+	identity, err := loadZitiIdentityFromEnv(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to load Ziti identity: %w", err)
+	}
+	m, err := newClientManager(identity, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize ziti client: %w", err)
+	}
+	kube, err := k.ClientFromKubeconfig(kubeconfig)
+	if err != nil {
+		return fmt.Errorf("failed to initialize kube-apiserver client: %w", err)
+	}
+	cluster, err := m.clusterID(ctx, kube)
+	if err != nil {
+		return err
+	}
+
+	list, err := kube.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+	pods := make([]*corev1.Pod, len(list.Items))
+	for i := range list.Items {
+		pods[i] = &list.Items[i]
+	}
+
+	c := newCollector(m.edge, cfg, cluster)
+	report, err := c.collect(ctx, pods, dryRun)
+	if err != nil {
+		return err
+	}
+	if err := report.write(out, c, time.Now()); err != nil {
+		return err
+	}
+	if failed := report.failed(); failed > 0 {
+		return fmt.Errorf("%d orphans could not be collected", failed)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package webhook
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	rest_model_edge "github.com/openziti/edge-api/rest_model"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCollectorOwns(t *testing.T) {
+	tagged := func(cluster string) *rest_model_edge.Tags {
+		return &rest_model_edge.Tags{SubTags: rest_model_edge.SubTags{tagCluster: cluster}}
+	}
+
+	tests := []struct {
+		name          string
+		object        string
+		tags          *rest_model_edge.Tags
+		adoptUntagged bool
+		wantOwned     bool
+		wantUntagged  bool
+	}{
+		{name: "this cluster", object: "zt-web-shop-aaaa", tags: tagged("c1"), wantOwned: true},
+		{name: "another cluster", object: "zt-web-shop-aaaa", tags: tagged("c2")},
+		{name: "another prefix", object: "admin", tags: tagged("c1")},
+		{name: "untagged", object: "zt-web-shop-aaaa", wantUntagged: true},
+		{name: "untagged adopted", object: "zt-web-shop-aaaa", adoptUntagged: true, wantOwned: true, wantUntagged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &collector{prefix: "zt", cluster: "c1", adoptUntagged: tt.adoptUntagged}
+			owned, untagged := c.owns(tt.object, tt.tags)
+			if owned != tt.wantOwned || untagged != tt.wantUntagged {
+				t.Errorf("owned %v untagged %v, want %v %v", owned, untagged, tt.wantOwned, tt.wantUntagged)
+			}
+		})
+	}
+}
+
+func TestCollectorOrphans(t *testing.T) {
+	now := time.Now()
+	objects := []gcObject{
+		{kind: rollbackIdentity, name: "zt-web-shop-aaaa", createdAt: now.Add(-2 * time.Hour)},
+		{kind: rollbackIdentity, name: "zt-web-shop-bbbb", createdAt: now.Add(-2 * time.Hour)},
+		{kind: rollbackIdentity, name: "zt-web-shop-cccc", createdAt: now.Add(-time.Minute)},
+		{kind: rollbackIdentity, name: "zt-web-shop-dddd", createdAt: now.Add(-2 * time.Hour), disabled: true},
+		{kind: rollbackRouter, name: "zt-router-edge-eeee", createdAt: now.Add(-2 * time.Hour)},
+		{kind: rollbackRouter, name: "zt-router-edge-ffff", createdAt: now.Add(-2 * time.Hour)},
+	}
+	pods := []*corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annotationIdentityName: "zt-web-shop-aaaa"}}},
+		{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "router", Env: []corev1.EnvVar{{Name: envRouterName, Value: "zt-router-edge-eeee"}}}}}},
+	}
+
+	names := func(objects []gcObject) []string {
+		var names []string
+		for _, object := range objects {
+			names = append(names, object.name)
+		}
+		return names
+	}
+
+	c := &collector{grace: time.Hour, action: gcActionDelete}
+	want := []string{"zt-web-shop-bbbb", "zt-web-shop-dddd", "zt-router-edge-ffff"}
+	if got := names(c.orphans(objects, pods, now)); !slices.Equal(got, want) {
+		t.Errorf("orphans %v, want %v", got, want)
+	}
+
+	c.action = gcActionDisable
+	want = []string{"zt-web-shop-bbbb", "zt-router-edge-ffff"}
+	if got := names(c.orphans(objects, pods, now)); !slices.Equal(got, want) {
+		t.Errorf("orphans to disable %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,127 @@
+package webhook
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	zitiedge "github.com/netfoundry/ziti-k8s-agent/ziti-agent/pkg/ziti-edge"
+	"k8s.io/klog/v2"
+)
+
+// healthChecker periodically logs in to the management API and tracks when that last succeeded.
+// The webhook is ready while a login succeeded within the readiness window and its serving
+// certificate is still valid.
+type healthChecker struct {
+	edge        *zitiedge.Edge
+	window      time.Duration
+	interval    time.Duration
+	timeout     time.Duration
+	certificate func() (*x509.Certificate, error)
+
+	// draining is set once the process received SIGTERM, so that the pod leaves the service
+	// endpoints while in-flight admissions finish
+	draining atomic.Bool
+
+	mu                sync.RWMutex
+	lastAuthenticated time.Time
+	lastError         error
+}
+
+func newHealthChecker(edge *zitiedge.Edge, cfg *WebhookConfig, certificate func() (*x509.Certificate, error)) *healthChecker {
+	return &healthChecker{
+		edge:        edge,
+		window:      cfg.Health.ReadinessWindow.Duration,
+		interval:    cfg.Health.CheckInterval.Duration,
+		timeout:     cfg.Health.CheckTimeout.Duration,
+		certificate: certificate,
+	}
+}
+
+// run checks the management API immediately and then every interval until ctx is done
+func (h *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		h.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *healthChecker) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	err := h.edge.Ping(ctx)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastError = err
+	if err != nil {
+		klog.Warningf("management API health check failed: %v", err)
+		return
+	}
+	h.lastAuthenticated = time.Now()
+}
+
+// ready returns nil if the webhook can currently serve admissions, otherwise the reason it cannot
+func (h *healthChecker) ready() error {
+	if h.draining.Load() {
+		return errors.New("shutting down")
+	}
+
+	cert, err := h.certificate()
+	if err != nil {
+		return fmt.Errorf("serving certificate: %w", err)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return fmt.Errorf("serving certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.lastAuthenticated.IsZero() {
+		if h.lastError != nil {
+			return fmt.Errorf("management API not yet authenticated: %w", h.lastError)
+		}
+		return errors.New("management API not yet authenticated")
+	}
+	if since := time.Since(h.lastAuthenticated); since > h.window {
+		return fmt.Errorf("no management API endpoint authenticated in the last %s: %v", since.Round(time.Second), h.lastError)
+	}
+	return nil
+}
+
+// serveHealthz answers the liveness probe; the process is alive as long as it is serving
+func (h *healthChecker) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := w.Write([]byte("ok")); err != nil {
+		klog.Errorf("failed to write healthz response: %v", err)
+	}
+}
+
+// serveReadyz answers the readiness probe
+func (h *healthChecker) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := h.ready(); err != nil {
+		klog.V(2).Infof("readiness check failed: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	body := "ok"
+	if caps := h.edge.Capabilities(); caps.Known {
+		body += ", controller " + caps.Version
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := w.Write([]byte(body)); err != nil {
+		klog.Errorf("failed to write readyz response: %v", err)
+	}
+}
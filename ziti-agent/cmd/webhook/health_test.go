@@ -0,0 +1,64 @@
+package webhook
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	zitiedge "github.com/netfoundry/ziti-k8s-agent/ziti-agent/pkg/ziti-edge"
+)
+
+func TestHealthChecker(t *testing.T) {
+	valid := &x509.Certificate{NotAfter: time.Now().Add(time.Hour)}
+	expired := &x509.Certificate{NotAfter: time.Now().Add(-time.Minute)}
+
+	tests := []struct {
+		name              string
+		certificate       *x509.Certificate
+		lastAuthenticated time.Duration
+		// check runs a management API check, which fails without endpoints
+		check     bool
+		draining  bool
+		wantReady bool
+	}{
+		{name: "authenticated", certificate: valid, lastAuthenticated: time.Minute, wantReady: true},
+		{name: "not yet authenticated", certificate: valid},
+		{name: "authentication failing", certificate: valid, check: true},
+		{name: "outside the readiness window", certificate: valid, lastAuthenticated: 3 * time.Minute, check: true},
+		{name: "certificate expired", certificate: expired, lastAuthenticated: time.Minute},
+		{name: "draining", certificate: valid, lastAuthenticated: time.Minute, draining: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &WebhookConfig{}
+			cfg.Health.ReadinessWindow.Duration = 2 * time.Minute
+			cfg.Health.CheckTimeout.Duration = time.Second
+			h := newHealthChecker(zitiedge.NewEdge(zitiedge.Config{}, nil, zitiedge.Options{Retry: zitiedge.RetryPolicy{MaxAttempts: 1}}), cfg, func() (*x509.Certificate, error) {
+				return tt.certificate, nil
+			})
+			if tt.lastAuthenticated > 0 {
+				h.lastAuthenticated = time.Now().Add(-tt.lastAuthenticated)
+			}
+			if tt.check {
+				h.check(context.Background())
+			}
+			h.draining.Store(tt.draining)
+
+			readyz := httptest.NewRecorder()
+			h.serveReadyz(readyz, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if ready := readyz.Code == http.StatusOK; ready != tt.wantReady {
+				t.Errorf("readyz %d %q, want ready %v", readyz.Code, readyz.Body.String(), tt.wantReady)
+			}
+
+			// the process stays alive whatever the readiness
+			healthz := httptest.NewRecorder()
+			h.serveHealthz(healthz, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if healthz.Code != http.StatusOK {
+				t.Errorf("healthz %d, want %d", healthz.Code, http.StatusOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+// Leader election timings of the background loops; work that overlaps a change of leader is at
+// worst done twice
+const (
+	leaseDuration = 60 * time.Second
+	renewDeadline = 40 * time.Second
+	retryPeriod   = 10 * time.Second
+)
+
+// serviceAccountNamespaceFile holds the namespace of the pod the webhook runs in
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// leaseConfig names the Lease electing the replica that runs a background loop
+type leaseConfig struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"` // Optional - defaults to the namespace of the webhook pod
+}
+
+// whileLeading runs fn each time this replica acquires the lease, until ctx is done, so that one
+// replica at a time runs it. The context passed to fn is cancelled when the lease is lost.
+func whileLeading(ctx context.Context, kube kubernetes.Interface, lease leaseConfig, fn func(ctx context.Context)) error {
+	namespace := lease.Namespace
+	if namespace == "" {
+		contents, err := os.ReadFile(serviceAccountNamespaceFile)
+		if err != nil {
+			return fmt.Errorf("the namespace of lease %s is not set and the webhook namespace is unknown: %w", lease.Name, err)
+		}
+		namespace = strings.TrimSpace(string(contents))
+	}
+	holder, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("cannot name this replica: %w", err)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: lease.Name, Namespace: namespace},
+		Client:     kube.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: holder},
+	}
+	// an elector returns once it loses the lease, after which this replica campaigns again
+	for ctx.Err() == nil {
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			ReleaseOnCancel: true,
+			Name:            lease.Name,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					klog.Infof("Holding lease %s/%s", namespace, lease.Name)
+					fn(ctx)
+				},
+				OnStoppedLeading: func() {
+					klog.V(2).Infof("Released lease %s/%s", namespace, lease.Name)
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		elector.Run(ctx)
+	}
+	return nil
+}
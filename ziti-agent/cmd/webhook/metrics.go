@@ -0,0 +1,170 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	zitiedge "github.com/netfoundry/ziti-k8s-agent/ziti-agent/pkg/ziti-edge"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const (
+	admissionResultAllowed = "allowed"
+	admissionResultDenied  = "denied"
+	admissionResultError   = "error"
+
+	admissionResultUnauthenticated = "unauthenticated"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	admissionRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "admission",
+			Name:      "requests_total",
+			Help:      "Admission requests by webhook path, operation and result.",
+		},
+		[]string{"path", "operation", "result"},
+	)
+
+	admissionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "admission",
+			Name:      "duration_seconds",
+			Help:      "Time taken to answer admission requests by webhook path, operation and result.",
+			Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30},
+		},
+		[]string{"path", "operation", "result"},
+	)
+
+	admissionsInFlight = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "admission",
+			Name:      "in_flight",
+			Help:      "Admission requests currently being handled.",
+		},
+		func() float64 { return float64(inFlightAdmissions.Load()) },
+	)
+
+	admissionRollbacks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "admission",
+			Name:      "rollbacks_total",
+			Help:      "Ziti objects deleted because the admission that created them failed or their pod was never created, by kind and result.",
+		},
+		[]string{"kind", "result"},
+	)
+
+	gcOrphans = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "gc",
+			Name:      "orphans_total",
+			Help:      "Ziti objects without a pod that the garbage collector removed or disabled, by kind and result.",
+		},
+		[]string{"kind", "result"},
+	)
+
+	gcLastRun = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "gc",
+			Name:      "last_run_timestamp_seconds",
+			Help:      "Time the garbage collector last compared the Ziti objects with the pods of the cluster, in seconds since the epoch.",
+		},
+	)
+
+	podControllerReconciles = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "pod_controller",
+			Name:      "reconciles_total",
+			Help:      "Identity deletions and role attribute syncs made by the pod controller, by action and result.",
+		},
+		[]string{"action", "result"},
+	)
+
+	servingCertExpiry = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "webhook",
+			Name:      "serving_cert_expiry_timestamp_seconds",
+			Help:      "Expiry time of the webhook serving certificate currently loaded, in seconds since the epoch.",
+		},
+	)
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		admissionRequests,
+		admissionDuration,
+		admissionsInFlight,
+		admissionRollbacks,
+		gcOrphans,
+		gcLastRun,
+		podControllerReconciles,
+		servingCertExpiry,
+	)
+	if err := zitiedge.RegisterMetrics(metricsRegistry); err != nil {
+		panic(err)
+	}
+}
+
+// observeAdmission records one answered (or rejected) admission request
+func observeAdmission(path string, operation string, result string, start time.Time) {
+	if operation == "" {
+		operation = "unknown"
+	}
+	admissionRequests.WithLabelValues(path, operation, result).Inc()
+	admissionDuration.WithLabelValues(path, operation, result).Observe(time.Since(start).Seconds())
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// debugClientsPath serves the state of the shared clients when WebhookConfig.Debug.Clients is set
+const debugClientsPath = "/debug/clients"
+
+// serveMetrics exposes the metrics, and the client status if debug is not nil, on a dedicated
+// plain HTTP port when one is configured and returns that server, otherwise they are served from
+// the webhook TLS server's mux, where the client status is only shown to authenticated callers
+func serveMetrics(cfg *WebhookConfig, debug http.Handler) *http.Server {
+	if cfg.Metrics.Port == 0 || cfg.Metrics.Port == cfg.Server.Port {
+		http.Handle(cfg.Metrics.Path, metricsHandler())
+		klog.Infof("serving metrics on the webhook port at %s", cfg.Metrics.Path)
+		if debug != nil {
+			http.Handle(debugClientsPath, callers.require(debug))
+		}
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Metrics.Path, metricsHandler())
+	if debug != nil {
+		mux.Handle(debugClientsPath, debug)
+	}
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Metrics.Port),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		klog.Infof("serving metrics on port %d at %s", cfg.Metrics.Port, cfg.Metrics.Path)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("metrics server failed: %v", err)
+		}
+	}()
+	return server
+}
@@ -0,0 +1,31 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveAdmission(t *testing.T) {
+	admissionRequests.Reset()
+	admissionDuration.Reset()
+
+	observeAdmission("/ziti-tunnel", "CREATE", admissionResultAllowed, time.Now())
+	// a request rejected before its operation was read
+	observeAdmission("/ziti-router", "", admissionResultUnauthenticated, time.Now())
+
+	expected := `
+# HELP ziti_agent_admission_requests_total Admission requests by webhook path, operation and result.
+# TYPE ziti_agent_admission_requests_total counter
+ziti_agent_admission_requests_total{operation="CREATE",path="/ziti-tunnel",result="allowed"} 1
+ziti_agent_admission_requests_total{operation="unknown",path="/ziti-router",result="unauthenticated"} 1
+`
+	if err := testutil.GatherAndCompare(metricsRegistry, strings.NewReader(expected), "ziti_agent_admission_requests_total"); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(admissionDuration); n != 2 {
+		t.Errorf("%d admission duration series, want 2", n)
+	}
+}
@@ -0,0 +1,295 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+// podControllerMaxRetries is how often a pod is reconciled again after failing before it is
+// dropped; identities of deleted pods that are dropped are left to the garbage collector
+const podControllerMaxRetries = 10
+
+// podController keeps the identities of tunnel pods in step with their pods, from a pod informer
+// rather than from UPDATE and DELETE admissions: the role attributes of an identity follow its
+// pod, see desiredIdentityRoles, and the identity is deleted with its pod. Pods are reconciled
+// from a rate limited work queue, so that management API failures are retried without holding
+// up the pod. Deletions that happen while no replica runs the controller are
+// not seen, which the garbage collector covers.
+type podController struct {
+	zh    *zitiHandler
+	pods  corelisters.PodLister
+	queue workqueue.TypedRateLimitingInterface[string]
+
+	mu sync.Mutex
+	// gone holds the identity names of deleted pods until they are deleted, by pod key
+	gone map[string][]string
+}
+
+func newPodController(zh *zitiHandler, pods corelisters.PodLister) *podController {
+	return &podController{
+		zh:   zh,
+		pods: pods,
+		queue: workqueue.NewTypedRateLimitingQueueWithConfig(
+			workqueue.DefaultTypedControllerRateLimiter[string](),
+			workqueue.TypedRateLimitingQueueConfig[string]{Name: "ziti-pods"},
+		),
+		gone: map[string][]string{},
+	}
+}
+
+// identityName returns the name of the identity of a tunnel pod, from its sidecar or annotation
+func (c *podController) identityName(pod *corev1.Pod) (string, bool) {
+	if name, ok := hasContainer(pod.Spec.Containers, c.zh.Config.Prefix); ok && name != "" {
+		return name, true
+	}
+	if name, ok := filterMapValueByKey(pod.Annotations, annotationIdentityName); ok && name != "" {
+		return name, true
+	}
+	return "", false
+}
+
+// handlers returns the informer event handlers, which queue the tunnel pods that need reconciling
+func (c *podController) handlers() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				c.enqueue(pod)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod, ok := oldObj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+			pod, ok := newObj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+			// a resync delivers the same version, which is reconciled as well
+			if oldPod.ResourceVersion != pod.ResourceVersion &&
+				reflect.DeepEqual(oldPod.Labels, pod.Labels) &&
+				reflect.DeepEqual(oldPod.Annotations, pod.Annotations) {
+				return
+			}
+			c.enqueue(pod)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			pod, ok := obj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+			name, ok := c.identityName(pod)
+			if !ok {
+				return
+			}
+			key, err := cache.MetaNamespaceKeyFunc(pod)
+			if err != nil {
+				klog.Errorf("Cannot queue deleted pod %s/%s: %v", pod.Namespace, pod.Name, err)
+				return
+			}
+			c.addGone(key, name)
+			c.queue.Add(key)
+		},
+	}
+}
+
+// enqueue queues a pod that carries a tunnel identity
+func (c *podController) enqueue(pod *corev1.Pod) {
+	if _, ok := c.identityName(pod); !ok {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(pod)
+	if err != nil {
+		klog.Errorf("Cannot queue pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *podController) addGone(key, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gone[key] = append(c.gone[key], name)
+}
+
+// takeGone removes and returns the identity names of deleted pods with this key
+func (c *podController) takeGone(key string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := c.gone[key]
+	delete(c.gone, key)
+	return names
+}
+
+// run reconciles queued pods with the given number of workers until ctx is done
+func (c *podController) run(ctx context.Context, workers int) {
+	defer c.queue.ShutDown()
+	for i := 0; i < workers; i++ {
+		go wait.UntilWithContext(ctx, c.work, 0)
+	}
+	<-ctx.Done()
+}
+
+// work reconciles queued pods until the queue shuts down
+func (c *podController) work(ctx context.Context) {
+	for c.processNext(ctx) {
+	}
+}
+
+// processNext reconciles the next queued pod, and queues it again with backoff when that fails
+func (c *podController) processNext(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	err := c.reconcile(ctx, key)
+	if err == nil {
+		c.queue.Forget(key)
+		return true
+	}
+	if c.queue.NumRequeues(key) < podControllerMaxRetries {
+		klog.Warningf("Failed to reconcile the Ziti identity of pod %s, retrying: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	klog.Errorf("Failed to reconcile the Ziti identity of pod %s, giving up: %v", key, err)
+	c.takeGone(key)
+	c.queue.Forget(key)
+	return true
+}
+
+// reconcile deletes the identities of deleted pods with this key and syncs the role attributes
+// of the identity of the pod that has it now, if any
+func (c *podController) reconcile(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		// a malformed key never succeeds
+		klog.Errorf("Dropping pod key %q: %v", key, err)
+		return nil
+	}
+
+	zh := c.zh
+	// the namespace is gone along with its pods, whose identities are still deleted
+	ns, err := zh.KC.getNamespace(ctx, namespace)
+	if apierrors.IsNotFound(err) {
+		ns = nil
+	} else if err != nil {
+		return err
+	}
+	var report *shadowReport
+	if zh.shadowMode(ns) {
+		report = &shadowReport{}
+		zh = zh.forShadow(report)
+		defer func() {
+			if len(report.actions) > 0 {
+				klog.Infof("pod %s: shadow mode: would %s", key, strings.Join(report.actions, "; would "))
+			}
+		}()
+	}
+
+	var failed []string
+	for _, identity := range c.takeGone(key) {
+		if err := zh.ZC.deleteIdentity(ctx, identity); err != nil {
+			klog.V(2).Infof("Failed to delete identity %s of deleted pod %s: %v", identity, key, err)
+			failed = append(failed, identity)
+			podControllerReconciles.WithLabelValues("delete", "error").Inc()
+			continue
+		}
+		klog.V(3).Infof("Deleted identity %s of deleted pod %s", identity, key)
+		podControllerReconciles.WithLabelValues("delete", "success").Inc()
+	}
+	if len(failed) > 0 {
+		for _, identity := range failed {
+			c.addGone(key, identity)
+		}
+		return fmt.Errorf("failed to delete identities %v", failed)
+	}
+
+	pod, err := c.pods.Pods(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	identity, ok := c.identityName(pod)
+	if !ok || pod.DeletionTimestamp != nil || ns == nil {
+		return nil
+	}
+
+	deleteLabelFound, err := zh.KC.findNamespaceByOption(
+		ctx,
+		namespace,
+		metav1.ListOptions{
+			LabelSelector: fmt.Sprintf("%s=%s", zh.Config.LabelKey, zh.Config.LabelDelValue),
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if deleteLabelFound {
+		return nil
+	}
+
+	if err := zh.syncRoles(ctx, identity, pod, ns); err != nil {
+		podControllerReconciles.WithLabelValues("roles", "error").Inc()
+		return err
+	}
+	podControllerReconciles.WithLabelValues("roles", "success").Inc()
+	return nil
+}
+
+// runPodController reconciles tunnel pod identities while this replica holds the lease, so that
+// replicas do not act on the same pod at the same time
+func runPodController(ctx context.Context, cfg *WebhookConfig, m *clientManager) {
+	kube, err := m.kubeClient()
+	if err != nil {
+		klog.Errorf("Pod controller is off: failed to initialize kube-apiserver client: %v", err)
+		return
+	}
+	cluster, err := m.clusterID(ctx, kube)
+	if err != nil {
+		klog.Errorf("Pod controller is off: %v", err)
+		return
+	}
+	zh := newTunnelHandler(kube, cluster)
+
+	err = whileLeading(ctx, kube, cfg.PodController.Lease, func(ctx context.Context) {
+		factory := informers.NewSharedInformerFactory(kube, cfg.PodController.ResyncPeriod.Duration)
+		pods := factory.Core().V1().Pods()
+		c := newPodController(zh, pods.Lister())
+		if _, err := pods.Informer().AddEventHandler(c.handlers()); err != nil {
+			klog.Errorf("Pod controller is off: %v", err)
+			return
+		}
+		factory.Start(ctx.Done())
+		defer factory.Shutdown()
+		if !cache.WaitForCacheSync(ctx.Done(), pods.Informer().HasSynced) {
+			return
+		}
+
+		klog.Infof("Reconciling tunnel pod identities with %d workers", cfg.PodController.Workers)
+		c.run(ctx, cfg.PodController.Workers)
+	})
+	if err != nil {
+		klog.Errorf("Pod controller is off: %v", err)
+	}
+}
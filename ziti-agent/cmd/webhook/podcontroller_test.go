@@ -0,0 +1,135 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// reconcilingClient records the identities the pod controller deletes and the roles it sets
+type reconcilingClient struct {
+	*fakeZitiClient
+	failDelete bool
+
+	mu      sync.Mutex
+	deleted []string
+	roles   map[string][]string
+}
+
+func (f *reconcilingClient) deleteIdentity(ctx context.Context, name string) error {
+	if f.failDelete {
+		return errors.New("controller unavailable")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, name)
+	return nil
+}
+
+func (f *reconcilingClient) syncIdentityRoles(ctx context.Context, name string, roles []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.roles[name] = roles
+	return nil
+}
+
+func newTestPodController(t *testing.T, zc zitiClientIntf, pods ...*corev1.Pod) *podController {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, pod := range pods {
+		if err := indexer.Add(pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newPodController(newTestTunnelHandler(zc), corelisters.NewPodLister(indexer))
+	t.Cleanup(c.queue.ShutDown)
+	return c
+}
+
+func tunnelPod(name string, annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "shop",
+			Name:        name,
+			Labels:      map[string]string{labelApp: "web"},
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "web"}, {Name: "zt-" + name}}},
+	}
+}
+
+func TestPodControllerSyncsRoles(t *testing.T) {
+	zc := &reconcilingClient{fakeZitiClient: newFakeZitiClient(), roles: map[string][]string{}}
+	c := newTestPodController(t, zc,
+		tunnelPod("annotated", map[string]string{defaultZitiRoleAttributesKey: "a,b"}),
+		tunnelPod("labelled", nil),
+	)
+
+	for _, key := range []string{"shop/annotated", "shop/labelled", "shop/missing"} {
+		if err := c.reconcile(context.Background(), key); err != nil {
+			t.Fatalf("reconcile %s: %v", key, err)
+		}
+	}
+	if got := zc.roles["zt-annotated"]; !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("roles of annotated pod %v, want [a b]", got)
+	}
+	if got := zc.roles["zt-labelled"]; !slices.Equal(got, []string{"web"}) {
+		t.Errorf("roles of labelled pod %v, want [web]", got)
+	}
+	if len(zc.roles) != 2 || len(zc.deleted) != 0 {
+		t.Errorf("synced %v and deleted %v, want only the two existing pods synced", zc.roles, zc.deleted)
+	}
+}
+
+func TestPodControllerDeletesIdentityOfDeletedPod(t *testing.T) {
+	zc := &reconcilingClient{fakeZitiClient: newFakeZitiClient(), roles: map[string][]string{}, failDelete: true}
+	c := newTestPodController(t, zc)
+
+	pod := tunnelPod("gone", nil)
+	c.handlers().OnDelete(cache.DeletedFinalStateUnknown{Key: "shop/gone", Obj: pod})
+	if c.queue.Len() != 1 {
+		t.Fatalf("queued %d pods, want 1", c.queue.Len())
+	}
+
+	// a failed deletion is kept for the retry
+	if err := c.reconcile(context.Background(), "shop/gone"); err == nil {
+		t.Fatal("reconcile succeeded while the identity could not be deleted")
+	}
+	zc.failDelete = false
+	if err := c.reconcile(context.Background(), "shop/gone"); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(zc.deleted, []string{"zt-gone"}) {
+		t.Errorf("deleted %v, want [zt-gone]", zc.deleted)
+	}
+	if len(zc.roles) != 0 {
+		t.Errorf("synced roles %v of a deleted pod", zc.roles)
+	}
+}
+
+// TestCreateOnlyShadowLeavesDeleteToController checks that a shadowed or dry-run DELETE reports
+// nothing when the pod controller takes care of deletion
+func TestCreateOnlyShadowLeavesDeleteToController(t *testing.T) {
+	zh := newTestTunnelHandler(newFakeZitiClient())
+	zh.createOnly = true
+	pod := tunnelPod("web", nil)
+	ar := admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{Operation: admissionv1.Delete}}
+
+	report := &shadowReport{}
+	for _, h := range []*zitiHandler{zh.forShadow(report), zh.forDryRun().forShadow(report)} {
+		if response := h.admit(context.Background(), ar, pod, pod, nil, false, admissionv1.AdmissionResponse{}); !response.Allowed {
+			t.Fatalf("admission denied: %v", response.Result)
+		}
+	}
+	if len(report.actions) != 0 {
+		t.Errorf("shadow mode reported %v, want nothing", report.actions)
+	}
+}
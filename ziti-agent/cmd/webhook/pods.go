@@ -5,10 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"reflect"
+	"slices"
+	"strings"
+	"sync"
 
 	zitiedge "github.com/netfoundry/ziti-k8s-agent/ziti-agent/pkg/ziti-edge"
-	"github.com/openziti/edge-api/rest_management_api_client"
 	"github.com/openziti/edge-api/rest_management_api_client/edge_router"
 	rest_model_edge "github.com/openziti/edge-api/rest_model"
 	admissionv1 "k8s.io/api/admission/v1"
@@ -24,8 +25,6 @@ var (
 	rootUser     int64 = 0
 	isNotTrue    bool  = false
 	isPrivileged bool  = false
-	jsonPatch    []JsonPatchEntry
-	pvc          *corev1.PersistentVolumeClaim
 )
 
 const (
@@ -38,6 +37,9 @@ const (
 	// Annotation key for explicitly setting identity name
 	annotationIdentityName = "identity.openziti.io/name"
 
+	// Environment variable of router pods that the router name is patched into
+	envRouterName = "ZITI_ROUTER_NAME"
+
 	// Label keys in order of precedence
 	labelApp          = "app"
 	labelAppName      = "app.kubernetes.io/name"
@@ -63,21 +65,29 @@ type clusterClientIntf interface {
 	findNamespaceByOption(ctx context.Context, name string, opts metav1.ListOptions) (bool, error)
 	getPvcByOption(ctx context.Context, namespace string, name string, opts metav1.GetOptions) (*corev1.PersistentVolumeClaim, error)
 	deletePvc(ctx context.Context, namespace string, name string) error
+	getNamespace(ctx context.Context, name string) (*corev1.Namespace, error)
+	recordEvent(ctx context.Context, namespace string, pod *corev1.Pod, reason string, message string) error
 }
 
 type zitiClient struct {
-	client *rest_management_api_client.ZitiEdgeManagement
+	edge *zitiedge.Edge
+	// authPolicy is assigned to created identities if the controller supports auth policies
+	authPolicy string
+	// cluster is recorded on created identities, see provenance
+	cluster string
 }
 
 type zitiClientIntf interface {
-	createIdentity(ctx context.Context, name string, roleKey string, podMeta *metav1.ObjectMeta) (string, error)
+	// createIdentity returns the id of the identity and whether this call created it
+	createIdentity(ctx context.Context, name string, roles []string, podMeta *metav1.ObjectMeta) (string, bool, error)
 	deleteIdentity(ctx context.Context, id string) error
 	deleteZitiRouter(ctx context.Context, name string) error
 	getIdentityToken(ctx context.Context, name string, id string) (string, error)
 	getZitiRouterToken(ctx context.Context, name string) (string, error)
 	findIdentityId(ctx context.Context, name string) (string, error)
-	patchIdentityRoleAttributes(ctx context.Context, id string, key string, newPod *corev1.Pod, oldPod *corev1.Pod) error
-	updateZitiRouter(ctx context.Context, name string, options *rest_model_edge.EdgeRouterCreate) (*edge_router.CreateEdgeRouterCreated, error)
+	// syncIdentityRoles sets the role attributes of the named identity unless it already has them
+	syncIdentityRoles(ctx context.Context, name string, roles []string) error
+	updateZitiRouter(ctx context.Context, name string, podMeta *metav1.ObjectMeta, options *rest_model_edge.EdgeRouterCreate) (*edge_router.CreateEdgeRouterCreated, error)
 }
 
 type zitiConfig struct {
@@ -92,6 +102,7 @@ type zitiConfig struct {
 	LabelDelValue   string
 	LabelCrValue    string
 	ResolverIp      string
+	ClusterZone     string
 	DnsUpstreamEnabled bool
 	Unanswerable       string
 	SearchDomains      []string
@@ -100,6 +111,7 @@ type zitiConfig struct {
 	ZitiType        zitiType
 	AnnotationKey   string
 	RouterConfig    routerConfig
+	Shadow          bool
 }
 
 type routerConfig struct {
@@ -113,6 +125,12 @@ type zitiHandler struct {
 	KC     clusterClientIntf
 	ZC     zitiClientIntf
 	Config *zitiConfig
+	dryRun bool
+	// pending follows the identities handed to pods until the pods appear; nil turns it off
+	pending *pendingPods
+	// createOnly admits UPDATE and DELETE requests without acting on them, for when the pod
+	// controller reconciles role attributes and deletion instead
+	createOnly bool
 }
 
 type ZitiHandler interface {
@@ -154,6 +172,12 @@ func (zh *zitiHandler) handleAdmissionRequest(ctx context.Context, ar admissionv
 
 	klog.Infof("%s operation admission request UID: %s", ar.Request.Operation, ar.Request.UID)
 
+	if ar.Request.DryRun != nil && *ar.Request.DryRun {
+		klog.V(2).Infof("admission request UID %s is a dry run, skipping Ziti side effects", ar.Request.UID)
+		zh = zh.forDryRun()
+		reviewResponse.Warnings = append(reviewResponse.Warnings, dryRunWarning)
+	}
+
 	// create a context to pass to subsequent functions allowing cancellations to propagate
 
 	deleteLabelFound, err := zh.KC.findNamespaceByOption(
@@ -168,6 +192,29 @@ func (zh *zitiHandler) handleAdmissionRequest(ctx context.Context, ar admissionv
 		return failureResponse(reviewResponse, err)
 	}
 
+	// the namespace is looked up once for everything the admission needs from it
+	var namespace *corev1.Namespace
+	if ar.Request.Namespace != "" {
+		namespace, err = zh.KC.getNamespace(ctx, ar.Request.Namespace)
+		if err != nil {
+			klog.Warningf("failed to get namespace %s, shadow mode is %v: %v", ar.Request.Namespace, zh.Config.Shadow, err)
+			namespace = nil
+		}
+	}
+
+	if zh.shadowMode(namespace) {
+		report := &shadowReport{}
+		response := zh.forShadow(report).admit(ctx, ar, pod, oldPod, namespace, deleteLabelFound, reviewResponse)
+		zh.recordShadow(ctx, ar, pod, oldPod, report, response)
+		return successResponse(reviewResponse)
+	}
+
+	return zh.admit(ctx, ar, pod, oldPod, namespace, deleteLabelFound, reviewResponse)
+}
+
+// admit dispatches the decoded admission request to the handler for its operation
+func (zh *zitiHandler) admit(ctx context.Context, ar admissionv1.AdmissionReview, pod *corev1.Pod, oldPod *corev1.Pod, namespace *corev1.Namespace, deleteLabelFound bool, reviewResponse admissionv1.AdmissionResponse) *admissionv1.AdmissionResponse {
+
 	// Handle admission operations.
 	switch ar.Request.Operation {
 
@@ -185,6 +232,7 @@ func (zh *zitiHandler) handleAdmissionRequest(ctx context.Context, ar admissionv
 				return zh.handleTunnelCreate(
 					ctx,
 					&pod.ObjectMeta,
+					namespace,
 					ar.Request.UID,
 					reviewResponse,
 				)
@@ -210,6 +258,11 @@ func (zh *zitiHandler) handleAdmissionRequest(ctx context.Context, ar admissionv
 		klog.V(4).Infof("Starting webhook operation: %s", ar.Request.Operation)
 		klog.V(4).Infof("Updating: delete action %v", deleteLabelFound)
 
+		if zh.createOnly {
+			klog.V(4).Infof("Leaving %s to the pod controller", ar.Request.Operation)
+			break
+		}
+
 		return zh.handleDelete(
 			ctx,
 			oldPod,
@@ -220,12 +273,18 @@ func (zh *zitiHandler) handleAdmissionRequest(ctx context.Context, ar admissionv
 		klog.V(4).Infof("Starting webhook operation: %s", ar.Request.Operation)
 		klog.V(4).Infof("Updating: delete action %v", deleteLabelFound)
 
+		if zh.createOnly {
+			klog.V(4).Infof("Leaving %s to the pod controller", ar.Request.Operation)
+			break
+		}
+
 		if !deleteLabelFound {
 
 			return zh.handleUpdate(
 				ctx,
 				pod,
 				oldPod,
+				namespace,
 				reviewResponse,
 			)
 
@@ -241,22 +300,40 @@ func (zh *zitiHandler) handleAdmissionRequest(ctx context.Context, ar admissionv
 	return successResponse(reviewResponse)
 }
 
-func (zh *zitiHandler) handleTunnelCreate(ctx context.Context, podMeta *metav1.ObjectMeta, uid types.UID, response admissionv1.AdmissionResponse) *admissionv1.AdmissionResponse {
+func (zh *zitiHandler) handleTunnelCreate(ctx context.Context, podMeta *metav1.ObjectMeta, namespace *corev1.Namespace, uid types.UID, response admissionv1.AdmissionResponse) (result *admissionv1.AdmissionResponse) {
 
-	identityName, err := buildZitiIdentityName(zh.Config.Prefix, podMeta, uid)
+	identityName, err := zh.identityName(podMeta, uid)
 	if err != nil {
 		return failureResponse(response, err)
 	}
 
-	identityId, err := zh.ZC.createIdentity(
+	if namespace == nil {
+		klog.Warningf("namespace %s is unknown, the roles of identity %s are worked out from its pod alone", podMeta.Namespace, identityName)
+	}
+	roles := desiredIdentityRoles(podMeta, namespace, zh.Config.RoleKey)
+
+	var undo rollback
+	defer func() { undo.undoUnlessAllowed(ctx, result) }()
+
+	// followed before the identity is created, since the controller may create it even when no
+	// response arrives; the sweep deletes it if no pod shows up with it
+	if zh.pending != nil {
+		zh.pending.add(podMeta.Namespace, identityName)
+	}
+	identityId, created, err := zh.ZC.createIdentity(
 		ctx,
 		identityName,
-		zh.Config.RoleKey,
+		roles,
 		podMeta,
 	)
 	if err != nil {
 		return failureResponse(response, err)
 	}
+	if created {
+		undo.record(rollbackIdentity, identityName, func(ctx context.Context) error {
+			return zh.ZC.deleteIdentity(ctx, identityName)
+		})
+	}
 
 	identityToken, err := zh.ZC.getIdentityToken(
 		ctx,
@@ -267,15 +344,18 @@ func (zh *zitiHandler) handleTunnelCreate(ctx context.Context, podMeta *metav1.O
 		return failureResponse(response, err)
 	}
 
-	dnsConfig, err := zh.getDnsConfig(ctx, podMeta)
+	// the handler is shared by concurrent requests, so the discovered resolver stays request-scoped
+	resolverIp := zh.getResolverIp(ctx)
+
+	dnsConfig, err := zh.getDnsConfig(ctx, podMeta, resolverIp)
 	if err != nil {
 		return failureResponse(response, err)
 	}
 
 	sidecarArgs := []string{"tproxy"}
 
-	if zh.Config.DnsUpstreamEnabled && zh.Config.ResolverIp != "" {
-		sidecarArgs = append(sidecarArgs, "--dnsUpstream", fmt.Sprintf("tcp://%s:53", zh.Config.ResolverIp))
+	if zh.Config.DnsUpstreamEnabled && resolverIp != "" {
+		sidecarArgs = append(sidecarArgs, "--dnsUpstream", fmt.Sprintf("tcp://%s:53", resolverIp))
 	}
 
 	unanswerable := zh.Config.Unanswerable
@@ -293,7 +373,7 @@ func (zh *zitiHandler) handleTunnelCreate(ctx context.Context, podMeta *metav1.O
 		sidecarArgs = append(sidecarArgs, "--verbose")
 	}
 
-	jsonPatch = []JsonPatchEntry{
+	jsonPatch := []JsonPatchEntry{
 
 		{
 			OP:   "add",
@@ -408,32 +488,38 @@ func (zh *zitiHandler) handleTunnelCreate(ctx context.Context, podMeta *metav1.O
 	return successResponse(response)
 }
 
-func (zh *zitiHandler) getDnsConfig(ctx context.Context, podMeta *metav1.ObjectMeta) (*corev1.PodDNSConfig, error) {
+// getResolverIp returns the configured cluster resolver, or looks up the cluster DNS service if
+// none is configured
+func (zh *zitiHandler) getResolverIp(ctx context.Context) string {
+	if len(zh.Config.ResolverIp) != 0 {
+		return zh.Config.ResolverIp
+	}
+
 	// get cluster dns ip if not already configured
 	defaultClusterDnsServiceIP := "10.96.0.10"
-	if len(zh.Config.ResolverIp) == 0 {
-		service, err := zh.KC.getClusterService(
-			ctx,
-			"kube-system", "kube-dns",
-			metav1.GetOptions{},
-		)
-		if err != nil {
-			klog.Warningf("Failed to look up DNS service: %v", err)
-			klog.Warningf("Using default DNS IP: %s", defaultClusterDnsServiceIP)
-			zh.Config.ResolverIp = defaultClusterDnsServiceIP
-		} else if len(service.Spec.ClusterIP) != 0 {
-			zh.Config.ResolverIp = service.Spec.ClusterIP
-			klog.V(4).Infof("Using cluster DNS IP: %s", zh.Config.ResolverIp)
-		} else {
-			zh.Config.ResolverIp = defaultClusterDnsServiceIP
-			klog.Warningf("DNS service has no ClusterIP, using default: %s", defaultClusterDnsServiceIP)
-		}
+	service, err := zh.KC.getClusterService(
+		ctx,
+		"kube-system", "kube-dns",
+		metav1.GetOptions{},
+	)
+	if err != nil {
+		klog.Warningf("Failed to look up DNS service: %v", err)
+		klog.Warningf("Using default DNS IP: %s", defaultClusterDnsServiceIP)
+		return defaultClusterDnsServiceIP
+	}
+	if len(service.Spec.ClusterIP) == 0 {
+		klog.Warningf("DNS service has no ClusterIP, using default: %s", defaultClusterDnsServiceIP)
+		return defaultClusterDnsServiceIP
 	}
+	klog.V(4).Infof("Using cluster DNS IP: %s", service.Spec.ClusterIP)
+	return service.Spec.ClusterIP
+}
 
+func (zh *zitiHandler) getDnsConfig(ctx context.Context, podMeta *metav1.ObjectMeta, resolverIp string) (*corev1.PodDNSConfig, error) {
 	dnsConfig := &corev1.PodDNSConfig{
 		Nameservers: []string{
 			"127.0.0.1",
-			zh.Config.ResolverIp,
+			resolverIp,
 		},
 		Options: []corev1.PodDNSConfigOption{
 			{
@@ -452,22 +538,25 @@ func (zh *zitiHandler) getDnsConfig(ctx context.Context, podMeta *metav1.ObjectM
 		klog.V(4).Infof("Using custom search domains: %v", zh.Config.SearchDomains)
 	} else {
 		// Add namespace-specific search domain using configurable cluster zone
-		namespaceDomain := fmt.Sprintf("%s.svc.%s", podMeta.Namespace, runtimeConfig.ClusterDns.Zone)
-		svcDomain := fmt.Sprintf("svc.%s", runtimeConfig.ClusterDns.Zone)
-		dnsConfig.Searches = []string{namespaceDomain, svcDomain, runtimeConfig.ClusterDns.Zone}
-		klog.V(4).Infof("Using default cluster search domains with namespace %s and zone %s: %v", podMeta.Namespace, runtimeConfig.ClusterDns.Zone, dnsConfig.Searches)
+		namespaceDomain := fmt.Sprintf("%s.svc.%s", podMeta.Namespace, zh.Config.ClusterZone)
+		svcDomain := fmt.Sprintf("svc.%s", zh.Config.ClusterZone)
+		dnsConfig.Searches = []string{namespaceDomain, svcDomain, zh.Config.ClusterZone}
+		klog.V(4).Infof("Using default cluster search domains with namespace %s and zone %s: %v", podMeta.Namespace, zh.Config.ClusterZone, dnsConfig.Searches)
 	}
 
 	return dnsConfig, nil
 }
 
-func (zh *zitiHandler) handleRouterCreate(ctx context.Context, pod *corev1.Pod, uid types.UID, response admissionv1.AdmissionResponse) *admissionv1.AdmissionResponse {
+func (zh *zitiHandler) handleRouterCreate(ctx context.Context, pod *corev1.Pod, uid types.UID, response admissionv1.AdmissionResponse) (result *admissionv1.AdmissionResponse) {
 
-	routerName, err := buildZitiIdentityName(zh.Config.Prefix, &pod.ObjectMeta, uid)
+	routerName, err := zh.identityName(&pod.ObjectMeta, uid)
 	if err != nil {
 		return failureResponse(response, err)
 	}
 
+	var undo rollback
+	defer func() { undo.undoUnlessAllowed(ctx, result) }()
+
 	options := &rest_model_edge.EdgeRouterCreate{
 		AppData:           nil,
 		Cost:              &zh.Config.RouterConfig.Cost,
@@ -479,14 +568,20 @@ func (zh *zitiHandler) handleRouterCreate(ctx context.Context, pod *corev1.Pod,
 		Tags:              nil,
 	}
 
-	_, err = zh.ZC.updateZitiRouter(
+	created, err := zh.ZC.updateZitiRouter(
 		ctx,
 		routerName,
+		&pod.ObjectMeta,
 		options,
 	)
 	if err != nil {
 		return failureResponse(response, err)
 	}
+	if created != nil {
+		undo.record(rollbackRouter, routerName, func(ctx context.Context) error {
+			return zh.ZC.deleteZitiRouter(ctx, routerName)
+		})
+	}
 
 	identityToken, err := zh.ZC.getZitiRouterToken(
 		ctx,
@@ -496,7 +591,7 @@ func (zh *zitiHandler) handleRouterCreate(ctx context.Context, pod *corev1.Pod,
 		return failureResponse(response, err)
 	}
 
-	jsonPatch = []JsonPatchEntry{
+	jsonPatch := []JsonPatchEntry{
 		{
 			OP:    "replace",
 			Path:  "/spec/containers/0/env/0/value",
@@ -528,8 +623,8 @@ func (zh *zitiHandler) handleDelete(ctx context.Context, pod *corev1.Pod, respon
 			return failureResponse(response, err)
 		}
 
-		var err error
-		if pvc, err = zh.KC.getPvcByOption(ctx, pod.Namespace, pod.Labels[labelApp]+"-"+pod.Name, metav1.GetOptions{}); err != nil {
+		pvc, err := zh.KC.getPvcByOption(ctx, pod.Namespace, pod.Labels[labelApp]+"-"+pod.Name, metav1.GetOptions{})
+		if err != nil {
 			klog.Errorf("failed to delete PVC for router %s: %v", pod.Spec.Containers[0].Env[7].Value, err)
 			return failureResponse(response, fmt.Errorf("failed to delete PVC for router %s: %v", pod.Spec.Containers[0].Env[7].Value, err))
 		}
@@ -568,12 +663,19 @@ func (zh *zitiHandler) handleDelete(ctx context.Context, pod *corev1.Pod, respon
 	return successResponse(response)
 }
 
-func (zh *zitiHandler) handleUpdate(ctx context.Context, pod *corev1.Pod, oldPod *corev1.Pod, response admissionv1.AdmissionResponse) *admissionv1.AdmissionResponse {
+func (zh *zitiHandler) handleUpdate(ctx context.Context, pod *corev1.Pod, oldPod *corev1.Pod, namespace *corev1.Namespace, response admissionv1.AdmissionResponse) *admissionv1.AdmissionResponse {
+
+	// roles worked out without the namespace could drop those it grants, so they are left as they
+	// are until a later update
+	if namespace == nil {
+		klog.Warningf("namespace of pod %s/%s is unknown, leaving the roles of its identity unchanged", pod.Namespace, pod.Name)
+		return successResponse(response)
+	}
 
 	// Attempt to find a sidecar container identity first.
 	if name, containerExists := hasContainer(pod.Spec.Containers, zh.Config.Prefix); containerExists && name != "" {
 		klog.V(3).Infof("ziti identity name from container spec is %s", name)
-		if err := zh.ZC.patchIdentityRoleAttributes(ctx, name, zh.Config.RoleKey, pod, oldPod); err != nil {
+		if err := zh.syncRoles(ctx, name, pod, namespace); err != nil {
 			return failureResponse(response, err)
 		}
 		return successResponse(response)
@@ -582,7 +684,7 @@ func (zh *zitiHandler) handleUpdate(ctx context.Context, pod *corev1.Pod, oldPod
 	// Otherwise, look for an annotation-based identity.
 	if name, annotationExists := filterMapValueByKey(pod.Annotations, annotationIdentityName); annotationExists && name != "" {
 		klog.V(3).Infof("ziti identity name from annotations is %s", name)
-		if err := zh.ZC.patchIdentityRoleAttributes(ctx, name, zh.Config.RoleKey, pod, oldPod); err != nil {
+		if err := zh.syncRoles(ctx, name, pod, namespace); err != nil {
 			return failureResponse(response, err)
 		}
 		return successResponse(response)
@@ -619,27 +721,127 @@ func (cc *clusterClient) deletePvc(ctx context.Context, namespace string, name s
 	return cc.client.CoreV1().PersistentVolumeClaims(namespace).Delete(ctx, name, metav1.DeleteOptions{})
 }
 
-// create a ziti identity with a conventional name from the prefix, pod metadta, and admission request uid
-func (zc *zitiClient) createIdentity(ctx context.Context, name string, roleKey string, podMeta *metav1.ObjectMeta) (string, error) {
-	roles, ok := filterMapValueListByKey(
-		podMeta.Annotations,
-		roleKey,
-	)
+func (cc *clusterClient) getNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	return cc.client.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+}
+
+// recordEvent records a Normal event about the pod, which may not have been assigned a name yet
+func (cc *clusterClient) recordEvent(ctx context.Context, namespace string, pod *corev1.Pod, reason string, message string) error {
+	now := metav1.Now()
+	name := podName(pod)
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: name + ".",
+			Namespace:    namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  namespace,
+			Name:       name,
+			UID:        pod.UID,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           corev1.EventTypeNormal,
+		Source:         corev1.EventSource{Component: "ziti-admission-webhook"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := cc.client.CoreV1().Events(namespace).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
+
+// desiredIdentityRoles returns the role attributes the identity of a pod should have: those listed
+// in the pod's role annotation, or else in its namespace's, or else the pod's app label. Entries
+// are trimmed and empty or repeated ones dropped, so a pod with none of these gets no roles. The
+// namespace may be nil.
+func desiredIdentityRoles(podMeta *metav1.ObjectMeta, namespace *corev1.Namespace, roleKey string) []string {
+	roles, ok := filterMapValueListByKey(podMeta.Annotations, roleKey)
+	if !ok && namespace != nil {
+		roles, ok = filterMapValueListByKey(namespace.Annotations, roleKey)
+	}
 	if !ok {
 		roles = []string{podMeta.Labels[labelApp]}
 	}
 
+	desired := []string{}
+	for _, role := range roles {
+		role = strings.TrimSpace(role)
+		if role != "" && !slices.Contains(desired, role) {
+			desired = append(desired, role)
+		}
+	}
+	return desired
+}
+
+// syncRoles sets the role attributes of the named identity to those its pod should have, if it
+// does not have them already
+func (zh *zitiHandler) syncRoles(ctx context.Context, name string, pod *corev1.Pod, namespace *corev1.Namespace) error {
+	return zh.ZC.syncIdentityRoles(ctx, name, desiredIdentityRoles(&pod.ObjectMeta, namespace, zh.Config.RoleKey))
+}
+
+// create a ziti identity with a conventional name from the prefix, pod metadta, and admission request uid
+func (zc *zitiClient) createIdentity(ctx context.Context, name string, roles []string, podMeta *metav1.ObjectMeta) (string, bool, error) {
+	identityType, opts := zc.identityOptions()
+	origin := podProvenance(zc.cluster, podMeta)
+	opts.Tags = origin.tags()
 	identityDetails, err := zitiedge.CreateIdentity(
+		ctx,
 		name,
 		roles,
-		rest_model_edge.IdentityTypeDevice,
-		zc.client,
+		identityType,
+		opts,
+		zc.edge,
 	)
+	if errors.Is(err, zitiedge.ErrConflict) {
+		// the name carries the admission request uid, so the identity may be left over from an
+		// earlier attempt at this admission
+		id, reuseErr := zc.reuseIdentity(ctx, name, origin)
+		if reuseErr != nil {
+			return "", false, fmt.Errorf("%w, and it cannot be reused: %v", err, reuseErr)
+		}
+		return id, false, nil
+	}
 	if err != nil {
-		return "", err
+		return "", false, err
+	}
+
+	return identityDetails.GetPayload().Data.ID, true, nil
+}
+
+// identityOptions picks the identity type and optional fields the controller supports. Until the
+// first login the capabilities are unknown, and the fields that older controllers accept are used.
+func (zc *zitiClient) identityOptions() (rest_model_edge.IdentityType, zitiedge.IdentityOptions) {
+	caps := zc.edge.Capabilities()
+
+	identityType := rest_model_edge.IdentityTypeDevice
+	if caps.DefaultIdentityType {
+		identityType = rest_model_edge.IdentityTypeDefault
 	}
 
-	return identityDetails.GetPayload().Data.ID, nil
+	var opts zitiedge.IdentityOptions
+	if zc.authPolicy != "" {
+		if caps.Known && !caps.AuthPolicies {
+			warnUnsupported("controller.podIdentities.authPolicy", caps.Version)
+		} else {
+			opts.AuthPolicyID = zc.authPolicy
+		}
+	}
+	return identityType, opts
+}
+
+// unsupportedWarned remembers which configured features were reported as unsupported, by
+// controller version
+var unsupportedWarned sync.Map
+
+// warnUnsupported logs once per controller version that a configured feature is ignored
+func warnUnsupported(setting, version string) {
+	if _, seen := unsupportedWarned.LoadOrStore(setting+"@"+version, true); seen {
+		return
+	}
+	klog.Warningf("%s is ignored: controller %s does not support it", setting, version)
 }
 
 // get the token for the identity by name or id
@@ -648,7 +850,7 @@ func (zc *zitiClient) getIdentityToken(ctx context.Context, name string, id stri
 	if id == "" && name != "" {
 
 		// returns nil or list of exactly one identity
-		identityDetails, err := zitiedge.GetIdentityByName(name, zc.client)
+		identityDetails, err := zitiedge.GetIdentityByName(ctx, name, zc.edge)
 		if err != nil {
 			return "", err
 		}
@@ -664,18 +866,22 @@ func (zc *zitiClient) getIdentityToken(ctx context.Context, name string, id stri
 	}
 
 	// get the token for the identity by id
-	detailsById, err := zitiedge.GetIdentityById(id, zc.client)
+	detailsById, err := zitiedge.GetIdentityById(ctx, id, zc.edge)
 	if err != nil {
 		return "", err
 	}
 
-	return detailsById.GetPayload().Data.Enrollment.Ott.JWT, nil
+	enrollments := detailsById.GetPayload().Data.Enrollment
+	if enrollments == nil || enrollments.Ott == nil || enrollments.Ott.JWT == "" {
+		return "", fmt.Errorf("identity %s: %w", id, errNoEnrollment)
+	}
+	return enrollments.Ott.JWT, nil
 }
 
 func (zc *zitiClient) deleteIdentity(ctx context.Context, name string) error {
 
 	id := ""
-	identityDetails, err := zitiedge.GetIdentityByName(name, zc.client)
+	identityDetails, err := zitiedge.GetIdentityByName(ctx, name, zc.edge)
 	if err != nil {
 		return err
 	}
@@ -685,7 +891,8 @@ func (zc *zitiClient) deleteIdentity(ctx context.Context, name string) error {
 	}
 
 	if id != "" {
-		if err := zitiedge.DeleteIdentity(id, zc.client); err != nil {
+		// the identity may have been deleted since it was looked up, which is just as good
+		if err := zitiedge.DeleteIdentity(ctx, id, zc.edge); err != nil && !errors.Is(err, zitiedge.ErrNotFound) {
 			return err
 		}
 	}
@@ -695,7 +902,7 @@ func (zc *zitiClient) deleteIdentity(ctx context.Context, name string) error {
 func (zc *zitiClient) findIdentityId(ctx context.Context, name string) (string, error) {
 
 	id := ""
-	identityDetails, err := zitiedge.GetIdentityByName(name, zc.client)
+	identityDetails, err := zitiedge.GetIdentityByName(ctx, name, zc.edge)
 	if err != nil {
 		return "", err
 	}
@@ -707,49 +914,40 @@ func (zc *zitiClient) findIdentityId(ctx context.Context, name string) (string,
 	return id, nil
 }
 
-func (zc *zitiClient) patchIdentityRoleAttributes(ctx context.Context, name string, key string, newPod *corev1.Pod, oldPod *corev1.Pod) error {
-
-	var roles []string
-	id := ""
-
-	newRoles, newOk := filterMapValueListByKey(
-		newPod.Annotations,
-		key,
-	)
+func (zc *zitiClient) syncIdentityRoles(ctx context.Context, name string, roles []string) error {
 
-	oldRoles, oldOk := filterMapValueListByKey(
-		oldPod.Annotations,
-		key,
-	)
-
-	if !newOk && oldOk {
-		roles = []string{newPod.Labels["app"]}
-	} else if newOk && !reflect.DeepEqual(newRoles, oldRoles) {
-		roles = newRoles
-	} else {
-		roles = []string{}
-	}
-
-	identityDetails, err := zitiedge.GetIdentityByName(name, zc.client)
+	identityDetails, err := zitiedge.GetIdentityByName(ctx, name, zc.edge)
 	if err != nil {
 		return err
 	}
 
 	for _, identityItem := range identityDetails.GetPayload().Data {
-		id = *identityItem.ID
-	}
-
-	if id != "" {
-		if _, err := zitiedge.PatchIdentity(id, roles, zc.client); err != nil {
+		var current []string
+		if identityItem.RoleAttributes != nil {
+			current = *identityItem.RoleAttributes
+		}
+		if sameRoles(current, roles) {
+			return nil
+		}
+		klog.V(3).Infof("setting roles of ziti identity %s from %v to %v", name, current, roles)
+		if _, err := zitiedge.PatchIdentity(ctx, *identityItem.ID, roles, zc.edge); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// sameRoles reports whether two sets of role attributes are equal, in any order
+func sameRoles(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(slices.Compact(a), slices.Compact(b))
+}
+
 func (zc *zitiClient) getZitiRouterToken(ctx context.Context, name string) (string, error) {
 
-	routerDetails, err := zitiedge.GetEdgeRouterByName(name, zc.client)
+	routerDetails, err := zitiedge.GetEdgeRouterByName(ctx, name, zc.edge)
 	if err != nil {
 		return "", err
 	}
@@ -758,7 +956,7 @@ func (zc *zitiClient) getZitiRouterToken(ctx context.Context, name string) (stri
 			if *routerItem.EnrollmentJWT != "" {
 				return *routerItem.EnrollmentJWT, nil
 			} else {
-				_, err := zitiedge.ReEnrollEdgeRouter(*routerItem.ID, zc.client)
+				_, err := zitiedge.ReEnrollEdgeRouter(ctx, *routerItem.ID, zc.edge)
 				if err != nil {
 					return "", err
 				}
@@ -769,14 +967,19 @@ func (zc *zitiClient) getZitiRouterToken(ctx context.Context, name string) (stri
 	return "", nil
 }
 
-func (zc *zitiClient) updateZitiRouter(ctx context.Context, name string, options *rest_model_edge.EdgeRouterCreate) (*edge_router.CreateEdgeRouterCreated, error) {
+// create the edge router of a router pod unless it exists; new routers are tagged with the
+// cluster and pod they belong to
+func (zc *zitiClient) updateZitiRouter(ctx context.Context, name string, podMeta *metav1.ObjectMeta, options *rest_model_edge.EdgeRouterCreate) (*edge_router.CreateEdgeRouterCreated, error) {
 
-	routerDetails, err := zitiedge.GetEdgeRouterByName(name, zc.client)
+	routerDetails, err := zitiedge.GetEdgeRouterByName(ctx, name, zc.edge)
 	if err != nil {
 		return nil, err
 	}
 	if len(routerDetails.GetPayload().Data) == 0 {
-		routerDetails, err := zitiedge.CreateEdgeRouter(options, zc.client)
+		if options.Tags == nil && zc.cluster != "" {
+			options.Tags = zitiedge.NewTags(podProvenance(zc.cluster, podMeta).tags())
+		}
+		routerDetails, err := zitiedge.CreateEdgeRouter(ctx, options, zc.edge)
 		if err != nil {
 			return nil, err
 		}
@@ -787,14 +990,14 @@ func (zc *zitiClient) updateZitiRouter(ctx context.Context, name string, options
 
 func (zc *zitiClient) deleteZitiRouter(ctx context.Context, name string) error {
 
-	routerDetails, err := zitiedge.GetEdgeRouterByName(name, zc.client)
+	routerDetails, err := zitiedge.GetEdgeRouterByName(ctx, name, zc.edge)
 	if err != nil {
 		return err
 	}
 	for _, routerItem := range routerDetails.GetPayload().Data {
 		if *routerItem.ID != "" {
-			err = zitiedge.DeleteEdgeRouter(*routerItem.ID, zc.client)
-			if err != nil {
+			err = zitiedge.DeleteEdgeRouter(ctx, *routerItem.ID, zc.edge)
+			if err != nil && !errors.Is(err, zitiedge.ErrNotFound) {
 				return err
 			}
 			break
@@ -804,7 +1007,7 @@ func (zc *zitiClient) deleteZitiRouter(ctx context.Context, name string) error {
 }
 
 // NewZitiHandler creates a new Ziti Handler.
-func newZitiHandler(cc *clusterClient, zc *zitiClient, config *zitiConfig) *zitiHandler {
+func newZitiHandler(cc clusterClientIntf, zc zitiClientIntf, config *zitiConfig) *zitiHandler {
 	return &zitiHandler{
 		KC:     cc,
 		ZC:     zc,
@@ -0,0 +1,440 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openziti/edge-api/rest_management_api_client/edge_router"
+	rest_model_edge "github.com/openziti/edge-api/rest_model"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const testResolverIp = "10.96.0.99"
+
+// fakeClusterClient answers reads with fixed objects and counts namespace lookups and the events
+// it is asked to record
+type fakeClusterClient struct {
+	events     atomic.Int32
+	namespaces atomic.Int32
+}
+
+func (f *fakeClusterClient) getClusterService(ctx context.Context, namespace string, name string, opts metav1.GetOptions) (*corev1.Service, error) {
+	return &corev1.Service{Spec: corev1.ServiceSpec{ClusterIP: testResolverIp}}, nil
+}
+
+func (f *fakeClusterClient) findNamespaceByOption(ctx context.Context, name string, opts metav1.ListOptions) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeClusterClient) getPvcByOption(ctx context.Context, namespace string, name string, opts metav1.GetOptions) (*corev1.PersistentVolumeClaim, error) {
+	return nil, nil
+}
+
+func (f *fakeClusterClient) deletePvc(ctx context.Context, namespace string, name string) error {
+	return nil
+}
+
+func (f *fakeClusterClient) getNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	f.namespaces.Add(1)
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}, nil
+}
+
+func (f *fakeClusterClient) recordEvent(ctx context.Context, namespace string, pod *corev1.Pod, reason string, message string) error {
+	f.events.Add(1)
+	return nil
+}
+
+// fakeZitiClient issues a token derived from each identity's name and jitters every call so that
+// concurrent admissions interleave
+type fakeZitiClient struct {
+	mu         sync.Mutex
+	identities map[string]string
+}
+
+func newFakeZitiClient() *fakeZitiClient {
+	return &fakeZitiClient{identities: map[string]string{}}
+}
+
+func jitter() {
+	time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+}
+
+func (f *fakeZitiClient) createIdentity(ctx context.Context, name string, roles []string, podMeta *metav1.ObjectMeta) (string, bool, error) {
+	jitter()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := "id-" + name
+	if _, ok := f.identities[id]; ok {
+		return "", false, fmt.Errorf("identity %s already exists", name)
+	}
+	f.identities[id] = name
+	return id, true, nil
+}
+
+func (f *fakeZitiClient) getIdentityToken(ctx context.Context, name string, id string) (string, error) {
+	jitter()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	owner, ok := f.identities[id]
+	if !ok {
+		return "", fmt.Errorf("identity %s not found", id)
+	}
+	return "token-for-" + owner, nil
+}
+
+func (f *fakeZitiClient) deleteIdentity(ctx context.Context, id string) error {
+	return nil
+}
+
+func (f *fakeZitiClient) deleteZitiRouter(ctx context.Context, name string) error {
+	return nil
+}
+
+func (f *fakeZitiClient) getZitiRouterToken(ctx context.Context, name string) (string, error) {
+	return "", nil
+}
+
+func (f *fakeZitiClient) findIdentityId(ctx context.Context, name string) (string, error) {
+	return "", nil
+}
+
+func (f *fakeZitiClient) syncIdentityRoles(ctx context.Context, name string, roles []string) error {
+	return nil
+}
+
+func (f *fakeZitiClient) updateZitiRouter(ctx context.Context, name string, podMeta *metav1.ObjectMeta, options *rest_model_edge.EdgeRouterCreate) (*edge_router.CreateEdgeRouterCreated, error) {
+	return nil, nil
+}
+
+func newTestTunnelHandler(zc zitiClientIntf) *zitiHandler {
+	return newZitiHandler(
+		&fakeClusterClient{},
+		zc,
+		&zitiConfig{
+			ZitiType:        zitiTypeTunnel,
+			VolumeMountName: "ziti-identity",
+			LabelKey:        "tunnel.openziti.io/enabled",
+			RoleKey:         defaultZitiRoleAttributesKey,
+			Image:           "openziti/ziti-tunnel",
+			ImageVersion:    "latest",
+			ImagePullPolicy: defaultImagePullPolicy,
+			IdentityDir:     "/ziti-tunnel",
+			Prefix:          "zt",
+			LabelDelValue:   "false",
+			LabelCrValue:    "true",
+			ClusterZone:     "cluster.local",
+			Unanswerable:    "refused",
+		},
+	)
+}
+
+func newCreateReview(pod *corev1.Pod, uid types.UID) (admissionv1.AdmissionReview, error) {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		return admissionv1.AdmissionReview{}, err
+	}
+	return admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       uid,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}, nil
+}
+
+// patchedIdentity is what a tunnel patch tells a pod about its own identity
+type patchedIdentity struct {
+	containerName string
+	token         string
+	annotation    string
+	nameservers   []string
+}
+
+func decodeTunnelPatch(patch []byte) (patchedIdentity, error) {
+	var entries []struct {
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(patch, &entries); err != nil {
+		return patchedIdentity{}, fmt.Errorf("failed to decode patch: %w", err)
+	}
+
+	var got patchedIdentity
+	for _, entry := range entries {
+		switch entry.Path {
+		case "/spec/containers/-":
+			var container corev1.Container
+			if err := json.Unmarshal(entry.Value, &container); err != nil {
+				return patchedIdentity{}, fmt.Errorf("failed to decode container: %w", err)
+			}
+			got.containerName = container.Name
+			for _, env := range container.Env {
+				if env.Name == "ZITI_ENROLL_TOKEN" {
+					got.token = env.Value
+				}
+			}
+		case "/metadata/annotations":
+			var annotations map[string]string
+			if err := json.Unmarshal(entry.Value, &annotations); err != nil {
+				return patchedIdentity{}, fmt.Errorf("failed to decode annotations: %w", err)
+			}
+			got.annotation = annotations[annotationIdentityName]
+		case "/spec/dnsConfig":
+			var dnsConfig corev1.PodDNSConfig
+			if err := json.Unmarshal(entry.Value, &dnsConfig); err != nil {
+				return patchedIdentity{}, fmt.Errorf("failed to decode dns config: %w", err)
+			}
+			got.nameservers = dnsConfig.Nameservers
+		}
+	}
+	return got, nil
+}
+
+// TestConcurrentTunnelAdmissions sends many CREATE reviews through one shared handler at once and
+// checks that each response only carries the identity created for its own pod. Run with -race.
+func TestConcurrentTunnelAdmissions(t *testing.T) {
+	const requests = 300
+
+	zh := newTestTunnelHandler(newFakeZitiClient())
+
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			pod := &corev1.Pod{
+				TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: fmt.Sprintf("ns%d", i%7),
+					Labels:    map[string]string{labelApp: fmt.Sprintf("app%d", i)},
+				},
+			}
+			uid := types.UID(fmt.Sprintf("%08d-0000-0000-0000-000000000000", i))
+			want, err := buildZitiIdentityName("zt", &pod.ObjectMeta, uid)
+			if err != nil {
+				t.Errorf("request %d: %v", i, err)
+				return
+			}
+
+			review, err := newCreateReview(pod, uid)
+			if err != nil {
+				t.Errorf("request %d: %v", i, err)
+				return
+			}
+
+			response := zh.handleAdmissionRequest(context.Background(), review)
+			if !response.Allowed {
+				t.Errorf("request %d: admission denied: %v", i, response.Result)
+				return
+			}
+
+			got, err := decodeTunnelPatch(response.Patch)
+			if err != nil {
+				t.Errorf("request %d: %v", i, err)
+				return
+			}
+			if got.containerName != want {
+				t.Errorf("request %d: sidecar named %q, want %q", i, got.containerName, want)
+			}
+			if got.annotation != want {
+				t.Errorf("request %d: identity annotation %q, want %q", i, got.annotation, want)
+			}
+			if got.token != "token-for-"+want {
+				t.Errorf("request %d: enrollment token %q belongs to another identity, want %q", i, got.token, "token-for-"+want)
+			}
+			if len(got.nameservers) != 2 || got.nameservers[1] != testResolverIp {
+				t.Errorf("request %d: nameservers %v, want resolver %s", i, got.nameservers, testResolverIp)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if zh.Config.ResolverIp != "" {
+		t.Errorf("handler config was mutated by a request: resolver %q", zh.Config.ResolverIp)
+	}
+}
+
+// TestDryRunTunnelAdmission checks that a server-side dry run gets the usual patch shape with a
+// placeholder identity and never reaches the management API
+func TestDryRunTunnelAdmission(t *testing.T) {
+	zc := newFakeZitiClient()
+	zh := newTestTunnelHandler(zc)
+
+	pod := &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Labels:    map[string]string{labelApp: "app"},
+		},
+	}
+	review, err := newCreateReview(pod, types.UID("00000000-0000-0000-0000-000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dryRun := true
+	review.Request.DryRun = &dryRun
+
+	response := zh.handleAdmissionRequest(context.Background(), review)
+	if !response.Allowed {
+		t.Fatalf("admission denied: %v", response.Result)
+	}
+	if len(response.Warnings) != 1 || response.Warnings[0] != dryRunWarning {
+		t.Errorf("warnings %v, want the dry run warning", response.Warnings)
+	}
+
+	got, err := decodeTunnelPatch(response.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "zt-" + dryRunIdentityName; got.containerName != want || got.annotation != want {
+		t.Errorf("sidecar %q and annotation %q, want placeholder %q", got.containerName, got.annotation, want)
+	}
+	if got.token != dryRunToken {
+		t.Errorf("enrollment token %q, want placeholder", got.token)
+	}
+	if len(zc.identities) != 0 {
+		t.Errorf("dry run created identities: %v", zc.identities)
+	}
+}
+
+// TestShadowTunnelAdmission checks that shadow mode leaves the pod untouched and makes no
+// management API calls
+func TestShadowTunnelAdmission(t *testing.T) {
+	zc := newFakeZitiClient()
+	zh := newTestTunnelHandler(zc)
+	zh.Config.Shadow = true
+
+	pod := &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Labels:    map[string]string{labelApp: "app"},
+		},
+	}
+	review, err := newCreateReview(pod, types.UID("00000000-0000-0000-0000-000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	review.Request.Namespace = pod.Namespace
+
+	response := zh.handleAdmissionRequest(context.Background(), review)
+	if !response.Allowed {
+		t.Fatalf("admission denied: %v", response.Result)
+	}
+	if len(response.Patch) != 0 {
+		t.Errorf("shadow mode returned a patch: %s", response.Patch)
+	}
+	if len(zc.identities) != 0 {
+		t.Errorf("shadow mode created identities: %v", zc.identities)
+	}
+	if events := zh.KC.(*fakeClusterClient).events.Load(); events != 1 {
+		t.Errorf("shadow mode recorded %d events, want 1", events)
+	}
+	if lookups := zh.KC.(*fakeClusterClient).namespaces.Load(); lookups != 1 {
+		t.Errorf("namespace looked up %d times, want once", lookups)
+	}
+
+	// a dry run in a shadowed namespace has no side effects at all, not even the event
+	dryRun := true
+	review.Request.DryRun = &dryRun
+	response = zh.handleAdmissionRequest(context.Background(), review)
+	if !response.Allowed {
+		t.Fatalf("dry run admission denied: %v", response.Result)
+	}
+	if events := zh.KC.(*fakeClusterClient).events.Load(); events != 1 {
+		t.Errorf("dry run in shadow mode recorded an event, %d in total", events)
+	}
+}
+
+func TestDesiredIdentityRoles(t *testing.T) {
+	annotated := func(value string) map[string]string {
+		return map[string]string{defaultZitiRoleAttributesKey: value}
+	}
+
+	tests := []struct {
+		name      string
+		pod       metav1.ObjectMeta
+		namespace *corev1.Namespace
+		wantRoles []string
+	}{
+		{name: "pod annotation", pod: metav1.ObjectMeta{Annotations: annotated("a,b"), Labels: map[string]string{labelApp: "web"}}, wantRoles: []string{"a", "b"}},
+		{name: "app label", pod: metav1.ObjectMeta{Labels: map[string]string{labelApp: "web"}}, wantRoles: []string{"web"}},
+		{name: "namespace annotation", pod: metav1.ObjectMeta{Labels: map[string]string{labelApp: "web"}}, namespace: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Annotations: annotated("shop")}}, wantRoles: []string{"shop"}},
+		{name: "pod annotation over namespace", pod: metav1.ObjectMeta{Annotations: annotated("a")}, namespace: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Annotations: annotated("shop")}}, wantRoles: []string{"a"}},
+		{name: "trimmed and deduplicated", pod: metav1.ObjectMeta{Annotations: annotated(" a, b,,a ")}, wantRoles: []string{"a", "b"}},
+		{name: "nothing", pod: metav1.ObjectMeta{}, wantRoles: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := desiredIdentityRoles(&tt.pod, tt.namespace, defaultZitiRoleAttributesKey)
+			if !slices.Equal(got, tt.wantRoles) {
+				t.Errorf("roles %q, want %q", got, tt.wantRoles)
+			}
+		})
+	}
+}
+
+func TestSameRoles(t *testing.T) {
+	if !sameRoles([]string{"b", "a"}, []string{"a", "b", "a"}) {
+		t.Error("roles in another order or repeated differ")
+	}
+	if sameRoles([]string{"a"}, nil) || sameRoles([]string{"a"}, []string{"b"}) {
+		t.Error("different roles are the same")
+	}
+	if !sameRoles(nil, []string{}) {
+		t.Error("no roles differ from an empty list")
+	}
+}
+
+// namespacelessClusterClient cannot look up namespaces
+type namespacelessClusterClient struct {
+	*fakeClusterClient
+}
+
+func (f *namespacelessClusterClient) getNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	return nil, errors.New("apiserver unavailable")
+}
+
+// TestShadowModeWithoutNamespace checks that an admission whose namespace cannot be looked up is
+// still admitted, in or out of shadow mode as configured
+func TestShadowModeWithoutNamespace(t *testing.T) {
+	pod := &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Labels:    map[string]string{labelApp: "app"},
+		},
+	}
+	review, err := newCreateReview(pod, types.UID("00000000-0000-0000-0000-000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	review.Request.Namespace = pod.Namespace
+
+	for _, shadow := range []bool{false, true} {
+		zh := newTestTunnelHandler(newFakeZitiClient())
+		zh.KC = &namespacelessClusterClient{fakeClusterClient: &fakeClusterClient{}}
+		zh.Config.Shadow = shadow
+
+		response := zh.handleAdmissionRequest(context.Background(), review)
+		if !response.Allowed {
+			t.Fatalf("shadow %v: admission denied: %v", shadow, response.Result)
+		}
+		if patched := len(response.Patch) > 0; patched == shadow {
+			t.Errorf("shadow %v: patched %v", shadow, patched)
+		}
+	}
+}
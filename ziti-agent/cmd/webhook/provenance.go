@@ -0,0 +1,105 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	zitiedge "github.com/netfoundry/ziti-k8s-agent/ziti-agent/pkg/ziti-edge"
+	rest_model_edge "github.com/openziti/edge-api/rest_model"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// Tags recording which cluster and pod an identity was created for
+const (
+	tagCluster   = "k8s.openziti.io/cluster"
+	tagNamespace = "k8s.openziti.io/namespace"
+	tagPod       = "k8s.openziti.io/pod"
+)
+
+const (
+	// reissuedEnrollmentTTL matches the default enrollment duration of the controller
+	reissuedEnrollmentTTL = 3 * time.Hour
+	// enrollmentMinTTL is how long an enrollment must remain valid to be handed to a new pod, so
+	// that the sidecar has time to start and enroll
+	enrollmentMinTTL = 5 * time.Minute
+)
+
+// provenance identifies the cluster and pod an identity was created for. Pods admitted before
+// the apiserver names them from their generateName are identified by their generateName.
+type provenance struct {
+	cluster   string
+	namespace string
+	pod       string
+}
+
+func podProvenance(cluster string, podMeta *metav1.ObjectMeta) provenance {
+	pod := podMeta.Name
+	if pod == "" {
+		pod = podMeta.GenerateName
+	}
+	return provenance{cluster: cluster, namespace: podMeta.Namespace, pod: pod}
+}
+
+func (p provenance) tags() map[string]string {
+	return map[string]string{
+		tagCluster:   p.cluster,
+		tagNamespace: p.namespace,
+		tagPod:       p.pod,
+	}
+}
+
+// matches reports whether an identity's tags carry this provenance
+func (p provenance) matches(tags *rest_model_edge.Tags) bool {
+	if tags == nil {
+		return false
+	}
+	for key, want := range p.tags() {
+		if got, _ := tags.SubTags[key].(string); got != want {
+			return false
+		}
+	}
+	return true
+}
+
+// reuseIdentity returns the id of an identity that an earlier attempt at the same admission
+// created, e.g. one whose response was lost and retried, or one a racing webhook replica answered.
+// An identity created for another cluster or pod is never reused. If its one-time token has
+// expired or was consumed, a new one is issued for the pod.
+func (zc *zitiClient) reuseIdentity(ctx context.Context, name string, origin provenance) (string, error) {
+	found, err := zitiedge.GetIdentityByName(ctx, name, zc.edge)
+	if err != nil {
+		return "", err
+	}
+	if len(found.GetPayload().Data) == 0 {
+		return "", fmt.Errorf("identity %s could not be found", name)
+	}
+	detail := found.GetPayload().Data[0]
+	if !origin.matches(detail.Tags) {
+		return "", fmt.Errorf("identity %s was not created for pod %s/%s of this cluster", name, origin.namespace, origin.pod)
+	}
+
+	if !enrollmentUsable(detail.Enrollment) {
+		klog.Infof("Re-issuing the enrollment of Ziti identity %s", name)
+		if err := zitiedge.ReissueEnrollment(ctx, detail, time.Now().Add(reissuedEnrollmentTTL), zc.edge); err != nil {
+			return "", fmt.Errorf("failed to re-issue the enrollment of identity %s: %w", name, err)
+		}
+	}
+	klog.Infof("Ziti identity %s already exists for this pod, reusing it", name)
+	return *detail.ID, nil
+}
+
+// enrollmentUsable reports whether an identity has a one-time token that a sidecar can still
+// enroll with
+func enrollmentUsable(enrollments *rest_model_edge.IdentityEnrollments) bool {
+	if enrollments == nil || enrollments.Ott == nil || enrollments.Ott.JWT == "" {
+		return false
+	}
+	expiresAt := time.Time(enrollments.Ott.ExpiresAt)
+	return expiresAt.IsZero() || time.Until(expiresAt) > enrollmentMinTTL
+}
+
+// errNoEnrollment is returned for identities that have no one-time token left
+var errNoEnrollment = errors.New("identity has no pending enrollment")
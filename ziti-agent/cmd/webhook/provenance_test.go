@@ -0,0 +1,55 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-openapi/strfmt"
+	rest_model_edge "github.com/openziti/edge-api/rest_model"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestProvenanceMatches(t *testing.T) {
+	origin := podProvenance("cluster-a", &metav1.ObjectMeta{Namespace: "shop", GenerateName: "web-5d9c8-"})
+	tagsOf := func(values map[string]string) *rest_model_edge.Tags {
+		tags := &rest_model_edge.Tags{SubTags: rest_model_edge.SubTags{}}
+		for k, v := range values {
+			tags.SubTags[k] = v
+		}
+		return tags
+	}
+
+	if !origin.matches(tagsOf(origin.tags())) {
+		t.Error("identity created for the pod does not match")
+	}
+	other := origin.tags()
+	other[tagCluster] = "cluster-b"
+	if origin.matches(tagsOf(other)) {
+		t.Error("identity created by another cluster matches")
+	}
+	if origin.matches(nil) || origin.matches(tagsOf(map[string]string{tagNamespace: "shop"})) {
+		t.Error("identity without provenance matches")
+	}
+}
+
+func TestEnrollmentUsable(t *testing.T) {
+	ott := func(jwt string, expiresAt time.Time) *rest_model_edge.IdentityEnrollments {
+		return &rest_model_edge.IdentityEnrollments{Ott: &rest_model_edge.IdentityEnrollmentsOtt{JWT: jwt, ExpiresAt: strfmt.DateTime(expiresAt)}}
+	}
+	tests := []struct {
+		name        string
+		enrollments *rest_model_edge.IdentityEnrollments
+		want        bool
+	}{
+		{name: "consumed", enrollments: &rest_model_edge.IdentityEnrollments{}},
+		{name: "none", enrollments: nil},
+		{name: "pending", enrollments: ott("jwt", time.Now().Add(time.Hour)), want: true},
+		{name: "expired", enrollments: ott("jwt", time.Now().Add(-time.Minute))},
+		{name: "about to expire", enrollments: ott("jwt", time.Now().Add(time.Minute))},
+	}
+	for _, tt := range tests {
+		if got := enrollmentUsable(tt.enrollments); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
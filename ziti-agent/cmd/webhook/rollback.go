@@ -0,0 +1,188 @@
+package webhook
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// rollbackTimeout bounds undoing the side effects of a failed admission, which may run after the
+// admission deadline has passed
+const rollbackTimeout = 15 * time.Second
+
+// Kinds of side effects that are rolled back
+const (
+	rollbackIdentity = "identity"
+	rollbackRouter   = "edge-router"
+)
+
+// rollback records the Ziti side effects of one admission, such as a created identity, so that
+// they are undone if a later step fails. Only what the admission created itself is recorded;
+// anything reused from an earlier attempt may already be in use by a pod.
+type rollback struct {
+	actions []rollbackAction
+}
+
+type rollbackAction struct {
+	kind string
+	name string
+	undo func(ctx context.Context) error
+}
+
+// record adds the undo of a side effect of the given kind on the named object
+func (r *rollback) record(kind, name string, undo func(ctx context.Context) error) {
+	r.actions = append(r.actions, rollbackAction{kind: kind, name: name, undo: undo})
+}
+
+// run undoes the recorded side effects, latest first. It is not cut short by the cancellation of
+// ctx, so that an admission that failed on its deadline still cleans up.
+func (r *rollback) run(ctx context.Context) {
+	if len(r.actions) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+	defer cancel()
+
+	for _, action := range slices.Backward(r.actions) {
+		if err := action.undo(ctx); err != nil {
+			klog.Errorf("Failed to roll back %s %s after a failed admission, it must be removed by hand: %v", action.kind, action.name, err)
+			admissionRollbacks.WithLabelValues(action.kind, "error").Inc()
+			continue
+		}
+		klog.Infof("Rolled back %s %s after a failed admission", action.kind, action.name)
+		admissionRollbacks.WithLabelValues(action.kind, "success").Inc()
+	}
+	r.actions = nil
+}
+
+// undoUnlessAllowed runs the rollback when the admission response denies the pod
+func (r *rollback) undoUnlessAllowed(ctx context.Context, response *admissionv1.AdmissionResponse) {
+	if response == nil || !response.Allowed {
+		r.run(ctx)
+	}
+}
+
+// pendingPods follows the identities of admitted pods until their pod shows up. The apiserver may
+// still reject a mutated pod, e.g. over a quota or pod security admission, and the webhook is not
+// told; a failed admission may also leave behind an identity whose creation got no response.
+// Identities whose pod did not appear within the grace period are deleted. Tracking is in memory and per replica, so admissions answered before a restart are
+// not followed.
+type pendingPods struct {
+	grace time.Duration
+
+	mu      sync.Mutex
+	pending map[string]pendingPod
+}
+
+// pendingPod is an identity waiting for its pod, keyed by identity name
+type pendingPod struct {
+	namespace  string
+	admittedAt time.Time
+}
+
+func newPendingPods(grace time.Duration) *pendingPods {
+	return &pendingPods{grace: grace, pending: map[string]pendingPod{}}
+}
+
+// add starts following an identity handed to a pod of namespace
+func (p *pendingPods) add(namespace, identityName string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending[identityName] = pendingPod{namespace: namespace, admittedAt: time.Now()}
+}
+
+// due removes and returns the identities whose grace period is over, by namespace
+func (p *pendingPods) due(now time.Time) map[string][]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	due := map[string][]string{}
+	for name, pod := range p.pending {
+		if now.Sub(pod.admittedAt) >= p.grace {
+			due[pod.namespace] = append(due[pod.namespace], name)
+			delete(p.pending, name)
+		}
+	}
+	return due
+}
+
+// run checks the identities whose grace period is over until ctx is done
+func (p *pendingPods) run(ctx context.Context, kube func() (*kubernetes.Clientset, error), zc zitiClientIntf) {
+	interval := min(p.grace, time.Minute)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		due := p.due(time.Now())
+		if len(due) == 0 {
+			continue
+		}
+		kc, err := kube()
+		if err != nil {
+			klog.Errorf("Cannot check whether admitted pods were created: %v", err)
+			continue
+		}
+		for namespace, names := range due {
+			p.sweep(ctx, kc, zc, namespace, names)
+		}
+	}
+}
+
+// sweep deletes the identities of namespace that no pod carries
+func (p *pendingPods) sweep(ctx context.Context, kube kubernetes.Interface, zc zitiClientIntf, namespace string, names []string) {
+	pods, err := kube.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("Cannot check whether admitted pods of namespace %s were created, keeping their identities: %v", namespace, err)
+		return
+	}
+	claimed := map[string]bool{}
+	for i := range pods.Items {
+		for _, name := range podIdentityNames(&pods.Items[i]) {
+			claimed[name] = true
+		}
+	}
+
+	for _, name := range names {
+		if claimed[name] {
+			continue
+		}
+		if err := zc.deleteIdentity(ctx, name); err != nil {
+			klog.Errorf("Failed to delete identity %s, whose pod was not created within %s: %v", name, p.grace, err)
+			admissionRollbacks.WithLabelValues(rollbackIdentity, "error").Inc()
+			continue
+		}
+		klog.Infof("Deleted identity %s, whose pod was not created within %s", name, p.grace)
+		admissionRollbacks.WithLabelValues(rollbackIdentity, "success").Inc()
+	}
+}
+
+// podIdentityNames lists the identity and edge router names a pod refers to, by annotation,
+// sidecar name or the router name in its environment
+func podIdentityNames(pod *corev1.Pod) []string {
+	var names []string
+	if name := pod.Annotations[annotationIdentityName]; name != "" {
+		names = append(names, name)
+	}
+	for _, container := range pod.Spec.Containers {
+		names = append(names, container.Name)
+		for _, env := range container.Env {
+			if env.Name == envRouterName && env.Value != "" {
+				names = append(names, env.Value)
+			}
+		}
+	}
+	return names
+}
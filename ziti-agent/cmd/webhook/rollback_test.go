@@ -0,0 +1,135 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// failingTokenClient creates identities but cannot issue their tokens, and records deletions
+type failingTokenClient struct {
+	*fakeZitiClient
+	reused bool
+
+	mu      sync.Mutex
+	deleted []string
+}
+
+func (f *failingTokenClient) createIdentity(ctx context.Context, name string, roles []string, podMeta *metav1.ObjectMeta) (string, bool, error) {
+	id, created, err := f.fakeZitiClient.createIdentity(ctx, name, roles, podMeta)
+	return id, created && !f.reused, err
+}
+
+func (f *failingTokenClient) getIdentityToken(ctx context.Context, name string, id string) (string, error) {
+	return "", errors.New("controller unavailable")
+}
+
+func (f *failingTokenClient) deleteIdentity(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, name)
+	return nil
+}
+
+func TestTunnelCreateRollback(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Labels: map[string]string{labelApp: "web"}}}
+
+	tests := []struct {
+		name       string
+		reused     bool
+		wantDelete bool
+	}{
+		{name: "created identity is deleted", wantDelete: true},
+		{name: "reused identity is kept", reused: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zc := &failingTokenClient{fakeZitiClient: newFakeZitiClient(), reused: tt.reused}
+			zh := newTestTunnelHandler(zc)
+
+			resp := zh.handleTunnelCreate(context.Background(), &pod.ObjectMeta, nil, "0123456789abcdef", admissionv1.AdmissionResponse{})
+			if resp.Allowed {
+				t.Fatal("admission allowed without a token")
+			}
+			if got := len(zc.deleted) > 0; got != tt.wantDelete {
+				t.Errorf("deleted %v, want deletion %v", zc.deleted, tt.wantDelete)
+			}
+		})
+	}
+}
+
+func TestPendingPodsSweep(t *testing.T) {
+	zc := &failingTokenClient{fakeZitiClient: newFakeZitiClient()}
+	kube := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web-1", Annotations: map[string]string{annotationIdentityName: "zt-web-shop-aaaa"}}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web-2"}, Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "zt-web-shop-bbbb"}}}},
+	)
+
+	p := newPendingPods(time.Minute)
+	for _, name := range []string{"zt-web-shop-aaaa", "zt-web-shop-bbbb", "zt-web-shop-cccc"} {
+		p.add("shop", name)
+	}
+	if due := p.due(time.Now()); len(due) != 0 {
+		t.Fatalf("due before the grace period: %v", due)
+	}
+	due := p.due(time.Now().Add(time.Minute))
+	if len(due["shop"]) != 3 {
+		t.Fatalf("due after the grace period: %v", due)
+	}
+
+	p.sweep(context.Background(), kube, zc, "shop", due["shop"])
+	if !slices.Equal(zc.deleted, []string{"zt-web-shop-cccc"}) {
+		t.Errorf("deleted %v, want only the identity without a pod", zc.deleted)
+	}
+	if due := p.due(time.Now().Add(time.Hour)); len(due) != 0 {
+		t.Errorf("identities still pending after the sweep: %v", due)
+	}
+}
+
+// unansweredCreateClient gets no response when creating identities, which the controller may
+// still have created
+type unansweredCreateClient struct {
+	*failingTokenClient
+}
+
+func (f *unansweredCreateClient) createIdentity(ctx context.Context, name string, roles []string, podMeta *metav1.ObjectMeta) (string, bool, error) {
+	return "", false, context.DeadlineExceeded
+}
+
+func TestTunnelCreatePending(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Labels: map[string]string{labelApp: "web"}}}
+	const uid = "0123456789abcdef"
+
+	tests := []struct {
+		name string
+		zc   zitiClientIntf
+	}{
+		{name: "no response to the create", zc: &unansweredCreateClient{&failingTokenClient{fakeZitiClient: newFakeZitiClient()}}},
+		{name: "token failed", zc: &failingTokenClient{fakeZitiClient: newFakeZitiClient()}},
+		{name: "admitted", zc: newFakeZitiClient()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zh := newTestTunnelHandler(tt.zc)
+			zh.pending = newPendingPods(time.Minute)
+			identityName, err := zh.identityName(&pod.ObjectMeta, uid)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			zh.handleTunnelCreate(context.Background(), &pod.ObjectMeta, nil, uid, admissionv1.AdmissionResponse{})
+			// whatever the outcome, the sweep checks the identity once the grace period is over
+			if due := zh.pending.due(time.Now().Add(time.Minute)); !slices.Equal(due["shop"], []string{identityName}) {
+				t.Errorf("due %v, want %s", due, identityName)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package webhook
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/spf13/cobra"
@@ -12,6 +13,8 @@ const (
 	defaultZitiTunnelLabelKey    = "tunnel.openziti.io/enabled"
 	// Default values
 	defaultImagePullPolicy = "IfNotPresent"
+	// controller.tls.preset turning the built-in verification rules off
+	tlsPresetNone = "none"
 )
 
 var (
@@ -20,6 +23,12 @@ var (
 	key           []byte
 	zitiIdentity  *ZitiIdentityConfig
 	runtimeConfig *WebhookConfig
+	clients       *clientManager
+	callers       *callerAuthenticator
+	pending       *pendingPods
+	// rootCtx scopes the background loops and admissions; it is cancelled once shutdown has
+	// drained admissions, or has given up waiting for them
+	rootCtx = context.Background()
 )
 
 func NewWebhookCmd() *cobra.Command {
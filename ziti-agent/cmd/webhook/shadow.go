@@ -0,0 +1,144 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/openziti/edge-api/rest_management_api_client/edge_router"
+	rest_model_edge "github.com/openziti/edge-api/rest_model"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// annotationShadowMode on a namespace turns shadow mode on ("true") or off ("false") for its
+	// pods, overriding the global setting
+	annotationShadowMode = "webhook.openziti.io/shadow"
+
+	shadowEventReason = "ZitiShadowAdmission"
+)
+
+// shadowReport collects the changes a shadowed admission would have made
+type shadowReport struct {
+	actions []string
+}
+
+func (r *shadowReport) add(format string, args ...interface{}) {
+	r.actions = append(r.actions, fmt.Sprintf(format, args...))
+}
+
+// shadowMode reports whether admissions in the namespace only observe, either because the
+// namespace says so or because shadow mode is on globally. Without the namespace, e.g. when it
+// could not be looked up, the global setting applies.
+func (zh *zitiHandler) shadowMode(ns *corev1.Namespace) bool {
+	if ns == nil {
+		return zh.Config.Shadow
+	}
+
+	value, ok := ns.Annotations[annotationShadowMode]
+	if !ok {
+		return zh.Config.Shadow
+	}
+	shadow, err := strconv.ParseBool(value)
+	if err != nil {
+		klog.Warningf("ignoring namespace %s annotation %s=%q: %v", ns.Name, annotationShadowMode, value, err)
+		return zh.Config.Shadow
+	}
+	return shadow
+}
+
+// forShadow returns a copy of the handler that works out the full admission but records the
+// management API calls and cluster writes in report instead of making them
+func (zh *zitiHandler) forShadow(report *shadowReport) *zitiHandler {
+	return &zitiHandler{
+		KC:         &shadowClusterClient{clusterClientIntf: zh.KC, report: report},
+		ZC:         &shadowZitiClient{report: report},
+		Config:     zh.Config,
+		dryRun:     zh.dryRun,
+		createOnly: zh.createOnly,
+	}
+}
+
+// recordShadow logs what a shadowed admission would have done and records it as an Event on the pod
+func (zh *zitiHandler) recordShadow(ctx context.Context, ar admissionv1.AdmissionReview, pod *corev1.Pod, oldPod *corev1.Pod, report *shadowReport, response *admissionv1.AdmissionResponse) {
+	subject := pod
+	if ar.Request.Operation == admissionv1.Delete {
+		subject = oldPod
+	}
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "shadow mode: %s %s admission", ar.Request.Operation, zh.Config.ZitiType)
+	if !response.Allowed && response.Result != nil {
+		fmt.Fprintf(&message, " would be denied: %s", response.Result.Message)
+	}
+	if len(report.actions) > 0 {
+		fmt.Fprintf(&message, "; would %s", strings.Join(report.actions, "; would "))
+	}
+	if len(response.Patch) > 0 {
+		fmt.Fprintf(&message, "; patch: %s", response.Patch)
+	}
+
+	klog.Infof("request UID %s for pod %s/%s: %s", ar.Request.UID, ar.Request.Namespace, podName(subject), message.String())
+	if err := zh.KC.recordEvent(ctx, ar.Request.Namespace, subject, shadowEventReason, message.String()); err != nil {
+		klog.Warningf("failed to record shadow mode event for pod %s/%s: %v", ar.Request.Namespace, podName(subject), err)
+	}
+}
+
+// podName returns the pod's name, or its generateName while the API server has yet to assign one
+func podName(pod *corev1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
+
+// shadowClusterClient passes reads through to the cluster and records writes
+type shadowClusterClient struct {
+	clusterClientIntf
+	report *shadowReport
+}
+
+func (c *shadowClusterClient) deletePvc(ctx context.Context, namespace string, name string) error {
+	c.report.add("delete PVC %s/%s", namespace, name)
+	return nil
+}
+
+// shadowZitiClient records management API writes and answers reads with placeholders, without
+// contacting the controller
+type shadowZitiClient struct {
+	dryRunZitiClient
+	report *shadowReport
+}
+
+func (c *shadowZitiClient) createIdentity(ctx context.Context, name string, roles []string, podMeta *metav1.ObjectMeta) (string, bool, error) {
+	c.report.add("create identity %s with roles %v", name, roles)
+	return dryRunIdentityName, false, nil
+}
+
+func (c *shadowZitiClient) deleteIdentity(ctx context.Context, name string) error {
+	c.report.add("delete identity %s", name)
+	return nil
+}
+
+func (c *shadowZitiClient) deleteZitiRouter(ctx context.Context, name string) error {
+	c.report.add("delete edge router %s", name)
+	return nil
+}
+
+func (c *shadowZitiClient) syncIdentityRoles(ctx context.Context, name string, roles []string) error {
+	c.report.add("set roles of identity %s to %v", name, roles)
+	return nil
+}
+
+func (c *shadowZitiClient) updateZitiRouter(ctx context.Context, name string, podMeta *metav1.ObjectMeta, options *rest_model_edge.EdgeRouterCreate) (*edge_router.CreateEdgeRouterCreated, error) {
+	var roles rest_model_edge.Attributes
+	if options.RoleAttributes != nil {
+		roles = *options.RoleAttributes
+	}
+	c.report.add("create or update edge router %s with roles %v", name, roles)
+	return nil, nil
+}
@@ -0,0 +1,247 @@
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog/v2"
+)
+
+// certReloader holds the webhook serving certificate and the CA bundle that callers' client
+// certificates are verified against. When the certificate and key are mounted files it watches
+// their directories and swaps in a rotated key pair without a restart; otherwise it serves the
+// pair read once from TLS_CERT and TLS_PRIVATE_KEY.
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	leaf      *x509.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newCertReloader(cfg *WebhookConfig) (*certReloader, error) {
+	c := &certReloader{
+		certFile:     cfg.Server.CertFile,
+		keyFile:      cfg.Server.KeyFile,
+		clientCAFile: cfg.Authentication.ClientCAFile,
+	}
+	if c.certFile == "" {
+		loadWebhookTLSFromEnv()
+		if len(cert) == 0 || len(key) == 0 {
+			return nil, errors.New("server.certFile and server.keyFile, or TLS_CERT and TLS_PRIVATE_KEY environment variables, must be provided")
+		}
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads and parses the key pair and client CA bundle; the previous ones stay in use if
+// either fails
+func (c *certReloader) reload() error {
+	certPEM, keyPEM := cert, key
+	if c.certFile != "" {
+		var err error
+		if certPEM, err = os.ReadFile(c.certFile); err != nil {
+			return fmt.Errorf("read serving certificate: %w", err)
+		}
+		if keyPEM, err = os.ReadFile(c.keyFile); err != nil {
+			return fmt.Errorf("read serving key: %w", err)
+		}
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to load webhook server TLS key pair: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse webhook server certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if c.clientCAFile != "" {
+		caPEM, err := os.ReadFile(c.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("read client CA bundle: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no certificates found in client CA bundle %s", c.clientCAFile)
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &pair
+	c.leaf = leaf
+	c.clientCAs = clientCAs
+	c.mu.Unlock()
+
+	servingCertExpiry.Set(float64(leaf.NotAfter.Unix()))
+	klog.Infof("loaded webhook serving certificate %q, valid until %s", leaf.Subject.CommonName, leaf.NotAfter)
+	return nil
+}
+
+// getCertificate is used as tls.Config.GetCertificate so each handshake sees the latest pair
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// clientCAPool returns the CA bundle currently used to verify client certificates
+func (c *certReloader) clientCAPool() *x509.CertPool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.clientCAs
+}
+
+// leafCertificate returns the parsed certificate currently being served
+func (c *certReloader) leafCertificate() (*x509.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.leaf == nil {
+		return nil, errors.New("no serving certificate loaded")
+	}
+	return c.leaf, nil
+}
+
+// watch reloads the key pair and CA bundle whenever something changes in their directories, until
+// ctx is done. The directories are watched rather than the files because Secret volumes are
+// updated by swapping a symlink, which replaces the files instead of writing to them.
+func (c *certReloader) watch(ctx context.Context) error {
+	var files []string
+	for _, file := range []string{c.certFile, c.keyFile, c.clientCAFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create certificate watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	for _, dir := range uniqueDirs(files...) {
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			klog.V(3).Infof("certificate directory changed: %s", event)
+			if err := c.reload(); err != nil {
+				klog.Errorf("failed to reload webhook serving certificate, keeping the previous one: %v", err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			klog.Errorf("certificate watcher error: %v", err)
+		}
+	}
+}
+
+func uniqueDirs(files ...string) []string {
+	var dirs []string
+	seen := map[string]bool{}
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// configTLS builds the server TLS configuration from WebhookConfig.Server, serving certificates
+// from certs
+func configTLS(cfg *WebhookConfig, certs *certReloader) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(cfg.Server.MinTLSVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := parseCipherSuites(cfg.Server.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: certs.getCertificate,
+	}
+	if cfg.Authentication.ClientCAFile != "" {
+		// client certificates are optional at the TLS layer so that kubelet probes, which present
+		// none, can still connect; admission paths reject callers without a verified chain
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			perConn := config.Clone()
+			perConn.GetConfigForClient = nil
+			perConn.ClientCAs = certs.clientCAPool()
+			// the server only adds h2 to its own copy of the config, not to this one
+			perConn.NextProtos = []string{"h2", "http/1.1"}
+			return perConn, nil
+		}
+	}
+	return config, nil
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2", "VersionTLS12":
+		return tls.VersionTLS12, nil
+	case "1.3", "VersionTLS13":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported server.minTLSVersion %q, must be 1.2 or 1.3", version)
+	}
+}
+
+// parseCipherSuites maps IANA cipher suite names to their IDs; only suites Go considers secure
+// are accepted. An empty list leaves the Go defaults in place.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported or insecure cipher suite %q in server.cipherSuites", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
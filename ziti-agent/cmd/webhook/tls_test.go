@@ -0,0 +1,175 @@
+package webhook
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed serving certificate for name and its key the way a Secret
+// volume update does, by replacing the files rather than writing to them
+func writeKeyPair(t *testing.T, certFile, keyFile, name string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		tmp := file + ".tmp"
+		if err := os.WriteFile(tmp, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func servedName(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	pair, err := config.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &WebhookConfig{}
+	cfg.Server.CertFile = filepath.Join(dir, "tls.crt")
+	cfg.Server.KeyFile = filepath.Join(dir, "tls.key")
+	writeKeyPair(t, cfg.Server.CertFile, cfg.Server.KeyFile, "before")
+
+	certs, err := newCertReloader(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := configTLS(cfg, certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, config); name != "before" {
+		t.Fatalf("serving %q, want the initial certificate", name)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watching := make(chan error, 1)
+	go func() { watching <- certs.watch(ctx) }()
+	// give the watcher time to register the directory
+	time.Sleep(100 * time.Millisecond)
+
+	writeKeyPair(t, cfg.Server.CertFile, cfg.Server.KeyFile, "after")
+	deadline := time.Now().Add(5 * time.Second)
+	for servedName(t, config) != "after" {
+		if time.Now().After(deadline) {
+			t.Fatal("rotated certificate not served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if leaf, err := certs.leafCertificate(); err != nil || leaf.Subject.CommonName != "after" {
+		t.Errorf("leaf certificate %v, %v, want the rotated one", leaf, err)
+	}
+
+	// a broken pair is not served; the previous one stays in use
+	if err := os.WriteFile(cfg.Server.KeyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := certs.reload(); err == nil {
+		t.Error("broken key pair loaded")
+	}
+	if name := servedName(t, config); name != "after" {
+		t.Errorf("serving %q after a failed reload, want the previous certificate", name)
+	}
+
+	cancel()
+	if err := <-watching; err != nil {
+		t.Errorf("watch: %v", err)
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+		wantErr bool
+	}{
+		{version: "", want: tls.VersionTLS12},
+		{version: "1.2", want: tls.VersionTLS12},
+		{version: "VersionTLS13", want: tls.VersionTLS13},
+		{version: "1.1", wantErr: true},
+		{version: "TLS1.3", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTLSVersion(tt.version)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want error %v", tt.version, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("%q: version %x, want %x", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		want    []uint16
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{
+			name:  "secure",
+			names: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"},
+			want:  []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256},
+		},
+		{name: "unknown", names: []string{"TLS_NOT_A_SUITE"}, wantErr: true},
+		{name: "insecure", names: []string{"TLS_RSA_WITH_RC4_128_SHA"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCipherSuites(tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("suites %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
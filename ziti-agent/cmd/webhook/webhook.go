@@ -2,23 +2,22 @@ package webhook
 
 import (
 	"context"
-	"crypto"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"strings"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/netfoundry/ziti-k8s-agent/ziti-agent/cmd/common"
-	k "github.com/netfoundry/ziti-k8s-agent/ziti-agent/pkg/kubernetes"
-	zitiedge "github.com/netfoundry/ziti-k8s-agent/ziti-agent/pkg/ziti-edge"
-	"github.com/openziti/edge-api/rest_management_api_client"
 	"github.com/spf13/cobra"
 	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 )
 
@@ -30,6 +29,9 @@ func init() {
 	addToScheme(scheme)
 }
 
+// inFlightAdmissions counts requests inside serve, for logging during shutdown and for metrics
+var inFlightAdmissions atomic.Int64
+
 type admitv1Func func(context.Context, admissionv1.AdmissionReview) *admissionv1.AdmissionResponse
 
 type admitHandler struct {
@@ -42,8 +44,58 @@ func newAdmitHandler(f admitv1Func) admitHandler {
 	}
 }
 
+// admissionResponseReserve is kept back from the admission timeout to write the response
+const admissionResponseReserve = 2 * time.Second
+
+// admissionContext returns the context an admission is handled in. It is cancelled when the
+// kube-apiserver abandons the request or when shutdown gives up on draining and cancels the root
+// context, and its deadline falls short of the webhook timeout, which the kube-apiserver passes
+// in the timeout query parameter, so that a slow management API call fails the admission before
+// the kube-apiserver gives up on it.
+func admissionContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := runtimeConfig.Server.AdmissionTimeout.Duration
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil && parsed > 0 {
+			timeout = parsed
+		} else {
+			klog.V(2).Infof("ignoring admission timeout %q: %v", value, err)
+		}
+	}
+	if timeout > 2*admissionResponseReserve {
+		timeout -= admissionResponseReserve
+	} else {
+		timeout /= 2
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	stop := context.AfterFunc(rootCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
 func serve(w http.ResponseWriter, r *http.Request, admit admitHandler) {
 
+	inFlightAdmissions.Add(1)
+	defer inFlightAdmissions.Add(-1)
+
+	// requests that never produce an admission response are counted as errors
+	startTime := time.Now()
+	operation, result := "", admissionResultError
+	defer func() {
+		observeAdmission(r.URL.Path, operation, result, startTime)
+	}()
+
+	caller, err := callers.authenticate(r)
+	if err != nil {
+		result = admissionResultUnauthenticated
+		rejectUnauthenticated(w, r, err)
+		return
+	}
+	if caller != "" {
+		klog.V(4).Infof("admission request to %s from %s", r.URL.Path, caller)
+	}
+
 	var body []byte
 	if r.Body != nil {
 		if data, err := io.ReadAll(r.Body); err == nil {
@@ -76,7 +128,6 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitHandler) {
 			return
 		}
 		// Report the time taken to process the request
-		startTime := time.Now()
 		defer func() {
 			duration := time.Since(startTime)
 			klog.V(3).Infof("Request ID %s processed in %s", requestedAdmissionReview.Request.UID, duration.Round(time.Millisecond))
@@ -84,9 +135,17 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitHandler) {
 
 		responseAdmissionReview := &admissionv1.AdmissionReview{}
 		responseAdmissionReview.SetGroupVersionKind(*gvk)
-		responseAdmissionReview.Response = admit.admissionv1(context.Background(), *requestedAdmissionReview)
+		ctx, cancel := admissionContext(r)
+		defer cancel()
+		responseAdmissionReview.Response = admit.admissionv1(ctx, *requestedAdmissionReview)
 		responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
 		responseObj = responseAdmissionReview
+		operation = string(requestedAdmissionReview.Request.Operation)
+		if responseAdmissionReview.Response.Allowed {
+			result = admissionResultAllowed
+		} else {
+			result = admissionResultDenied
+		}
 		responseJSON, err := json.Marshal(responseAdmissionReview)
 		if err != nil {
 			klog.Warningf("failed to marshal review response to JSON: %v", err)
@@ -105,6 +164,7 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitHandler) {
 	if err != nil {
 		err = fmt.Errorf("failed to marshal review response to JSON: %v", err)
 		klog.Error(err)
+		result = admissionResultError
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	} else {
@@ -114,115 +174,15 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitHandler) {
 	if _, err := w.Write(responseBytes); err != nil {
 		err = fmt.Errorf("failed to write response: %v", err)
 		klog.Error(err)
+		result = admissionResultError
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func zitiClientImpl() (*rest_management_api_client.ZitiEdgeManagement, error) {
-	if zitiIdentity == nil {
-		return nil, fmt.Errorf("ziti identity not loaded")
-	}
-
-	// Debug certificate and key data
-	klog.V(4).Infof("Certificate data length: %d bytes", len(zitiIdentity.ID.Cert))
-	klog.V(4).Infof("Private key data length: %d bytes", len(zitiIdentity.ID.Key))
-	if len(zitiIdentity.ID.Cert) > 100 {
-		klog.V(5).Infof("Certificate data preview: %s...", zitiIdentity.ID.Cert[:100])
-	} else {
-		klog.V(5).Infof("Certificate data preview: %s", zitiIdentity.ID.Cert)
-	}
-	if len(zitiIdentity.ID.Key) > 100 {
-		klog.V(5).Infof("Private key data preview: %s...", zitiIdentity.ID.Key[:100])
-	} else {
-		klog.V(5).Infof("Private key data preview: %s", zitiIdentity.ID.Key)
-	}
-
-	// Clean certificate and key data by removing "pem:" prefix if present
-	certData := zitiIdentity.ID.Cert
-	keyData := zitiIdentity.ID.Key
-	
-	if strings.HasPrefix(certData, "pem:") {
-		certData = strings.TrimPrefix(certData, "pem:")
-		klog.V(4).Infof("Removed 'pem:' prefix from certificate data")
-	}
-	if strings.HasPrefix(keyData, "pem:") {
-		keyData = strings.TrimPrefix(keyData, "pem:")
-		klog.V(4).Infof("Removed 'pem:' prefix from private key data")
-	}
-
-	// parse ziti admin certs to synchronously (blocking) create a ziti identity
-	zitiAdminIdentity, err := tls.X509KeyPair([]byte(certData), []byte(keyData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse X509 key pair: %w", err)
-	}
-
-	if len(zitiAdminIdentity.Certificate) == 0 {
-		err := fmt.Errorf("no certificates found in TLS key pair")
-		return nil, err
-	}
-
-	parsedCert, err := x509.ParseCertificate(zitiAdminIdentity.Certificate[0])
-	if err != nil {
-		return nil, err
-	}
-
-	// Log certificate details and analyze key usage compatibility
-	klog.V(4).Infof("Client certificate Subject: %v", parsedCert.Subject)
-	klog.V(4).Infof("Client certificate Issuer: %v", parsedCert.Issuer)
-	klog.V(4).Infof("Client certificate Valid from: %v to %v", parsedCert.NotBefore, parsedCert.NotAfter)
-
-	zitiCtrlCaBundle := []byte(zitiIdentity.ID.CA)
-	klog.V(4).Infof("Parsed client certificate - Subject: %v, Issuer: %v", parsedCert.Subject, parsedCert.Issuer)
-	klog.V(4).Infof("Loading CA bundle, size: %d bytes", len(zitiCtrlCaBundle))
-	klog.V(5).Infof("CA bundle content: %s", string(zitiCtrlCaBundle))
-
-	certPool := x509.NewCertPool()
-	if !certPool.AppendCertsFromPEM(zitiCtrlCaBundle) {
-		err := fmt.Errorf("failed to append CA certificates from PEM")
-		return nil, err
-	}
-
-	// Try each management API endpoint until one works
-	zc, err := createZitiClientWithFailover(runtimeConfig.Controller.MgmtAPIEndpoints, parsedCert, zitiAdminIdentity.PrivateKey, *certPool, zitiCtrlCaBundle)
-
-	return zc, err
-
-}
-
-// createZitiClientWithFailover attempts to create a Ziti client by trying each management API endpoint
-func createZitiClientWithFailover(endpoints []string, cert *x509.Certificate, privateKey crypto.PrivateKey, certPool x509.CertPool, caBundle []byte) (*rest_management_api_client.ZitiEdgeManagement, error) {
-	var lastErr error
-	
-	for i, endpoint := range endpoints {
-		klog.V(2).Infof("Attempting to connect to management API endpoint %d/%d: %s", i+1, len(endpoints), endpoint)
-		
-		cfg := zitiedge.Config{
-			ApiEndpoint: endpoint,
-			Cert:        cert,
-			PrivateKey:  privateKey,
-			CAS:         certPool,
-		}
-		cfg.CABundle = caBundle
-		
-		zc, err := zitiedge.Client(&cfg)
-		if err != nil {
-			klog.V(2).Infof("Failed to create client for endpoint %s: %v", endpoint, err)
-			lastErr = err
-			continue
-		}
-		
-		klog.V(1).Infof("Successfully created client for management API endpoint: %s", endpoint)
-		return zc, nil
-	}
-	
-	return nil, fmt.Errorf("failed to connect to any management API endpoint, last error: %w", lastErr)
-}
-
-
 func serveZitiTunnel(w http.ResponseWriter, r *http.Request) {
 
-	kc, err := k.Client()
+	kc, err := clients.kubeClient()
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		err = fmt.Errorf("failed to initialize kube-apiserver client: %v", err)
@@ -230,19 +190,26 @@ func serveZitiTunnel(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	zc, err := zitiClientImpl()
+	cluster, err := clients.clusterID(r.Context(), kc)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		err = fmt.Errorf("failed to initialize ziti client: %v", err)
 		klog.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	zh := newZitiHandler(
+	zh := newTunnelHandler(kc, cluster)
+	zh.pending = pending
+	// the pod controller takes over role updates and deletion from the admissions
+	zh.createOnly = runtimeConfig.PodController.Enabled
+	serve(w, r, newAdmitHandler(zh.handleAdmissionRequest))
+
+}
+
+// newTunnelHandler returns the handler of tunnel sidecar pods, configured by the runtime config
+func newTunnelHandler(kc *kubernetes.Clientset, cluster string) *zitiHandler {
+	return newZitiHandler(
 		&clusterClient{client: kc},
-		&zitiClient{client: zc},
+		&zitiClient{edge: clients.edge, authPolicy: runtimeConfig.Controller.PodIdentities.AuthPolicy, cluster: cluster},
 		&zitiConfig{
 			ZitiType:             zitiTypeTunnel,
 			VolumeMountName:      runtimeConfig.Sidecar.VolumeMountName,
@@ -256,21 +223,21 @@ func serveZitiTunnel(w http.ResponseWriter, r *http.Request) {
 			LabelDelValue:        "false",
 			LabelCrValue:         "true",
 			ResolverIp:           runtimeConfig.Sidecar.ResolverIP,
+			ClusterZone:          runtimeConfig.ClusterDns.Zone,
 			DnsUpstreamEnabled:   runtimeConfig.Sidecar.DnsUpstreamEnabled,
 			Unanswerable:         runtimeConfig.Sidecar.DnsUnanswerable,
 			SearchDomains:        runtimeConfig.Sidecar.SearchDomains,
 			AdditionalArgs:       runtimeConfig.Sidecar.AdditionalArgs,
 			PodSecurityOverride:  runtimeConfig.Security.PodSecurityContextOverride,
 			RouterConfig:         routerConfig{},
+			Shadow:               runtimeConfig.Shadow.Enabled,
 		},
 	)
-	serve(w, r, newAdmitHandler(zh.handleAdmissionRequest))
-
 }
 
 func serveZitiRouter(w http.ResponseWriter, r *http.Request) {
 
-	kc, err := k.Client()
+	kc, err := clients.kubeClient()
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		err = fmt.Errorf("failed to initialize kube-apiserver client: %v", err)
@@ -279,10 +246,8 @@ func serveZitiRouter(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	zc, err := zitiClientImpl()
+	cluster, err := clients.clusterID(r.Context(), kc)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		err = fmt.Errorf("failed to initialize ziti client: %v", err)
 		klog.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -290,7 +255,7 @@ func serveZitiRouter(w http.ResponseWriter, r *http.Request) {
 
 	zh := newZitiHandler(
 		&clusterClient{client: kc},
-		&zitiClient{client: zc},
+		&zitiClient{edge: clients.edge, cluster: cluster},
 		&zitiConfig{
 			ZitiType:            zitiTypeRouter,
 			LabelKey:            "router.openziti.io/enabled",
@@ -306,6 +271,7 @@ func serveZitiRouter(w http.ResponseWriter, r *http.Request) {
 				IsTunnelerEnabled: false,
 				RoleAttributes:    []string{"router"},
 			},
+			Shadow: runtimeConfig.Shadow.Enabled,
 		},
 	)
 	serve(w, r, newAdmitHandler(zh.handleAdmissionRequest))
@@ -321,33 +287,127 @@ func webhook(cmd *cobra.Command, args []string) {
 	}
 
 	// Load Ziti identity from environment variable
-	zitiIdentity, err = loadZitiIdentityFromEnv()
+	zitiIdentity, err = loadZitiIdentityFromEnv(runtimeConfig)
 	if err != nil {
 		klog.Fatalf("failed to load Ziti identity: %v", err)
 	}
 
-	// Load webhook server TLS certificates from environment variables
-	loadWebhookTLSFromEnv()
-	
-	klog.Infof("Running version is %s", common.Version)
-
-	if len(cert) == 0 || len(key) == 0 {
-		klog.Fatal("TLS_CERT and TLS_PRIVATE_KEY must be provided via environment variables")
+	// Load webhook server TLS certificates from the configured files or environment variables
+	certs, err := newCertReloader(runtimeConfig)
+	if err != nil {
+		klog.Fatalf("failed to load webhook server certificate: %v", err)
+	}
+	tlsConfig, err := configTLS(runtimeConfig, certs)
+	if err != nil {
+		klog.Fatalf("failed to configure webhook server TLS: %v", err)
 	}
 
+	klog.Infof("Running version is %s", common.Version)
+
 	if zitiIdentity == nil {
 		klog.Fatal("Ziti identity must be loaded from JSON file")
 	}
 
+	clients, err = newClientManager(zitiIdentity, runtimeConfig)
+	if err != nil {
+		klog.Fatalf("failed to initialize ziti client: %v", err)
+	}
+	callers = newCallerAuthenticator(runtimeConfig, reviewToken)
+	pending = newPendingPods(runtimeConfig.Controller.PodIdentities.PendingGracePeriod.Duration)
+
 	port := runtimeConfig.Server.Port
 	http.HandleFunc("/ziti-tunnel", serveZitiTunnel)
 	http.HandleFunc("/ziti-router", serveZitiRouter)
+
+	// the root context outlives the termination signal so that draining admissions can finish
+	// their management API calls
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	var cancel context.CancelFunc
+	rootCtx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		if err := certs.watch(rootCtx); err != nil {
+			klog.Errorf("webhook serving certificate will not be reloaded: %v", err)
+		}
+	}()
+
+	go clients.edge.Run(rootCtx)
+	go callers.run(rootCtx)
+	go pending.run(rootCtx, clients.kubeClient, &zitiClient{edge: clients.edge})
+	if runtimeConfig.GC.Enabled {
+		go runGC(rootCtx, runtimeConfig, clients)
+	}
+	if runtimeConfig.PodController.Enabled {
+		go runPodController(rootCtx, runtimeConfig, clients)
+	}
+	if clients.events != nil {
+		go clients.events.Run(rootCtx)
+		go logRouterEvents(rootCtx, clients.events)
+	}
+
+	health := newHealthChecker(clients.edge, runtimeConfig, certs.leafCertificate)
+	http.HandleFunc("/healthz", health.serveHealthz)
+	http.HandleFunc("/readyz", health.serveReadyz)
+	go health.run(rootCtx)
+	var debug http.Handler
+	if runtimeConfig.Debug.Clients {
+		debug = http.HandlerFunc(clients.serveStatus)
+	}
+	metricsServer := serveMetrics(runtimeConfig, debug)
 	server := &http.Server{
 		Addr:      fmt.Sprintf(":%d", port),
-		TLSConfig: configTLS(cert, key),
+		TLSConfig: tlsConfig,
 	}
-	if err = server.ListenAndServeTLS("", ""); err != nil {
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-signalCtx.Done()
+		// restore default signal handling so that a second signal terminates immediately
+		stop()
+		drain(health, runtimeConfig, cancel, server, metricsServer)
+	}()
+
+	klog.Infof("ziti agent webhook server is listening on port %d", port)
+	if err = server.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		klog.Fatal(err)
 	}
-	klog.Infof("ziti agent webhook server is listening on port %d", port)
+	<-drained
+	klog.Info("ziti agent webhook server stopped")
+}
+
+// drain fails readiness, keeps serving for the configured delay while the pod is removed from the
+// service endpoints, then stops accepting connections and waits up to the shutdown timeout for
+// in-flight admission requests to complete. Admissions still running after that are cancelled
+// through the root context, and given the rollback timeout to undo what they created.
+func drain(health *healthChecker, cfg *WebhookConfig, cancelRoot context.CancelFunc, servers ...*http.Server) {
+	klog.Infof("termination signal received, draining %d in-flight admission requests", inFlightAdmissions.Load())
+	health.draining.Store(true)
+	if delay := cfg.Server.ShutdownDelay.Duration; delay > 0 {
+		klog.V(2).Infof("waiting %s before closing listeners", delay)
+		time.Sleep(delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout.Duration)
+	defer cancel()
+	for _, server := range servers {
+		if server == nil {
+			continue
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			klog.Errorf("server on %s did not shut down cleanly with %d admission requests in flight: %v", server.Addr, inFlightAdmissions.Load(), err)
+		}
+	}
+
+	if inFlightAdmissions.Load() == 0 {
+		return
+	}
+	klog.Warningf("cancelling %d admission requests still in flight", inFlightAdmissions.Load())
+	cancelRoot()
+	deadline := time.Now().Add(rollbackTimeout)
+	for inFlightAdmissions.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
 }
@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmissionContextDeadline(t *testing.T) {
+	runtimeConfig = &WebhookConfig{}
+	runtimeConfig.Server.AdmissionTimeout.Duration = 30 * time.Second
+	defer func() { runtimeConfig = nil }()
+
+	tests := []struct {
+		target string
+		want   time.Duration
+	}{
+		{"/ziti-tunnel", 28 * time.Second},
+		{"/ziti-tunnel?timeout=10s", 8 * time.Second},
+		{"/ziti-tunnel?timeout=3s", 1500 * time.Millisecond},
+		{"/ziti-tunnel?timeout=bogus", 28 * time.Second},
+	}
+	for _, tt := range tests {
+		ctx, cancel := admissionContext(httptest.NewRequest("POST", tt.target, nil))
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if !ok {
+			t.Fatalf("%s: admission context has no deadline", tt.target)
+		}
+		if got := time.Until(deadline); got > tt.want || got < tt.want-time.Second {
+			t.Errorf("%s: deadline in %s, want about %s", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestAdmissionContextFollowsRequest(t *testing.T) {
+	runtimeConfig = &WebhookConfig{}
+	runtimeConfig.Server.AdmissionTimeout.Duration = 30 * time.Second
+	defer func() { runtimeConfig = nil }()
+
+	parent, abandon := context.WithCancel(context.Background())
+	ctx, cancel := admissionContext(httptest.NewRequest("POST", "/ziti-tunnel", nil).WithContext(parent))
+	defer cancel()
+
+	abandon()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("admission context was not cancelled with the request")
+	}
+}
+
+// TestDrainCancelsStuckAdmissions checks that admissions still running when the shutdown timeout
+// expires are cancelled through the root context instead of being cut off by the exit
+func TestDrainCancelsStuckAdmissions(t *testing.T) {
+	runtimeConfig = &WebhookConfig{}
+	runtimeConfig.Server.AdmissionTimeout.Duration = 30 * time.Second
+	runtimeConfig.Server.ShutdownTimeout.Duration = 100 * time.Millisecond
+	root, cancelRoot := context.WithCancel(context.Background())
+	rootCtx = root
+	defer func() {
+		runtimeConfig = nil
+		rootCtx = context.Background()
+	}()
+
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlightAdmissions.Add(1)
+		defer inFlightAdmissions.Add(-1)
+		ctx, cancel := admissionContext(r)
+		defer cancel()
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+	}))
+	defer server.Close()
+
+	go func() {
+		if resp, err := server.Client().Get(server.URL); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	drain(&healthChecker{}, runtimeConfig, cancelRoot, server.Config)
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("drain returned without cancelling the admission in flight")
+	}
+	if n := inFlightAdmissions.Load(); n != 0 {
+		t.Errorf("%d admissions still in flight after drain", n)
+	}
+}
@@ -40,6 +40,9 @@ type ZitiControllerSpec struct {
 
 	// Ziti Controller Management Address
 	ZitiCtrlMgmtApi string `json:"zitiCtrlMgmtApi,omitempty"`
+
+	// Ziti service fronting the management API, dialed over the overlay instead of the management address
+	ZitiCtrlMgmtApiService string `json:"zitiCtrlMgmtApiService,omitempty"`
 }
 
 // ZitiControllerStatus defines the observed state of ZitiController
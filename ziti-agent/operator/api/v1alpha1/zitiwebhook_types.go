@@ -165,6 +165,9 @@ type DeploymentEnvVars struct {
 	// +kubebuilder:default:=""
 	ZitiCtrlMgmtApi string `json:"zitiCtrlMgmtApi,omitempty"`
 
+	// Ziti service fronting the management API, dialed over the overlay instead of ZitiCtrlMgmtApi
+	ZitiCtrlMgmtApiService string `json:"zitiCtrlMgmtApiService,omitempty"`
+
 	// Ziti Controller Client Certificate
 	ZitiCtrlClientCertFile string `json:"zitiCtrlClientCertFile,omitempty"`
 
@@ -260,7 +263,7 @@ type DeploymentEnvVars struct {
 type ClusterRoleSpec struct {
 	// Cluster Role Rules
 	// +kubebuilder:validation:MinItems=1
-	// +kubebuilder:default:={{"apiGroups":{""},"resources":{"services","namespaces"},"verbs":{"get","list","watch"}},{"apiGroups":{""},"resources":{"persistentvolumeclaims"},"verbs":{"get","delete"}}}
+	// +kubebuilder:default:={{"apiGroups":{""},"resources":{"services","namespaces"},"verbs":{"get","list","watch"}},{"apiGroups":{""},"resources":{"persistentvolumeclaims"},"verbs":{"get","delete"}},{"apiGroups":{""},"resources":{"events"},"verbs":{"create"}},{"apiGroups":{""},"resources":{"pods"},"verbs":{"get","list"}}}
 	Rules []rbacv1.PolicyRule `json:"rules,omitempty"`
 }
 
@@ -321,7 +324,7 @@ func init() {
 }
 
 func (z *ZitiWebhook) GetDefaults() *ZitiWebhookSpec {
-	sideEffectClassNone := admissionregistrationv1.SideEffectClassNone
+	sideEffectClassNoneOnDryRun := admissionregistrationv1.SideEffectClassNoneOnDryRun
 	failurePolicyFail := admissionregistrationv1.Fail
 	matchPolicyEquivalent := admissionregistrationv1.Equivalent
 	reinvocationPolicyNever := admissionregistrationv1.NeverReinvocationPolicy
@@ -369,7 +372,7 @@ func (z *ZitiWebhook) GetDefaults() *ZitiWebhookSpec {
 				Name:                    "tunnel.ziti.webhook",
 				ObjectSelector:          &metav1.LabelSelector{},
 				NamespaceSelector:       &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "kubernetes.io/metadata.name", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"kube-system"}}, {Key: "tunnel.openziti.io/enabled", Operator: metav1.LabelSelectorOpIn, Values: []string{"true", "false"}}}},
-				SideEffects:             &sideEffectClassNone,
+				SideEffects:             &sideEffectClassNoneOnDryRun,
 				FailurePolicy:           &failurePolicyFail,
 				TimeoutSeconds:          &[]int32{30}[0],
 				MatchPolicy:             &matchPolicyEquivalent,
@@ -404,7 +407,7 @@ func (z *ZitiWebhook) GetDefaults() *ZitiWebhookSpec {
 				Name:                    "router.ziti.webhook",
 				ObjectSelector:          &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "router.openziti.io/enabled", Operator: metav1.LabelSelectorOpIn, Values: []string{"true", "false"}}}},
 				NamespaceSelector:       &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "kubernetes.io/metadata.name", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"kube-system"}}}},
-				SideEffects:             &sideEffectClassNone,
+				SideEffects:             &sideEffectClassNoneOnDryRun,
 				FailurePolicy:           &failurePolicyFail,
 				TimeoutSeconds:          &[]int32{30}[0],
 				MatchPolicy:             &matchPolicyEquivalent,
@@ -448,6 +451,16 @@ func (z *ZitiWebhook) GetDefaults() *ZitiWebhookSpec {
 					Resources: []string{"persistentvolumeclaims"},
 					Verbs:     []string{"get", "delete"},
 				},
+				{
+					APIGroups: []string{""},
+					Resources: []string{"events"},
+					Verbs:     []string{"create"},
+				},
+				{
+					APIGroups: []string{""},
+					Resources: []string{"pods"},
+					Verbs:     []string{"get", "list"},
+				},
 			},
 		},
 		ServiceAccount: ServiceAccountSpec{
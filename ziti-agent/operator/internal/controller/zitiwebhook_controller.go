@@ -132,6 +132,7 @@ func (r *ZitiWebhookReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 			r.CachedZitiController = ziticontroller
 			zitiwebhook.Spec.ZitiControllerName = r.CachedZitiController.Spec.Name
 			zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApi = r.CachedZitiController.Spec.ZitiCtrlMgmtApi
+			zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApiService = r.CachedZitiController.Spec.ZitiCtrlMgmtApiService
 			if zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApi == "" {
 				zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApi, _ = utils.GetUrlFromJwt(r.CachedZitiController.Spec.AdminJwt)
 				zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApi = zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApi + "/edge/management/v1"
@@ -142,6 +143,7 @@ func (r *ZitiWebhookReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 				log.V(5).Info("Cached ZitiController Spec", "Name", r.CachedZitiController.Spec.Name, "ZitiController.Spec", r.CachedZitiController.Spec)
 				zitiwebhook.Spec.ZitiControllerName = r.CachedZitiController.Spec.Name
 				zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApi = r.CachedZitiController.Spec.ZitiCtrlMgmtApi
+				zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApiService = r.CachedZitiController.Spec.ZitiCtrlMgmtApiService
 				if zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApi == "" {
 					zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApi, _ = utils.GetUrlFromJwt(r.CachedZitiController.Spec.AdminJwt)
 					zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApi = zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApi + "/edge/management/v1"
@@ -997,6 +999,10 @@ func (r *ZitiWebhookReconciler) getDesiredStateDeploymentConfiguration(ctx conte
 									Name:  "ZITI_MGMT_API",
 									Value: zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApi,
 								},
+								{
+									Name:  "ZITI_MGMT_API_SERVICE",
+									Value: zitiwebhook.Spec.DeploymentSpec.Env.ZitiCtrlMgmtApiService,
+								},
 								{
 									Name:  "POD_SECURITY_CONTEXT_OVERRIDE",
 									Value: fmt.Sprintf("%t", zitiwebhook.Spec.DeploymentSpec.Env.PodSecurityOverride),
@@ -1024,6 +1030,33 @@ func (r *ZitiWebhookReconciler) getDesiredStateDeploymentConfiguration(ctx conte
 									corev1.ResourceMemory: zitiwebhook.Spec.DeploymentSpec.ResourceRequest["memory"],
 								},
 							},
+							LivenessProbe: &corev1.Probe{
+								ProbeHandler: corev1.ProbeHandler{
+									HTTPGet: &corev1.HTTPGetAction{
+										Path:   "/healthz",
+										Port:   intstr.FromInt32(zitiwebhook.Spec.DeploymentSpec.Port),
+										Scheme: corev1.URISchemeHTTPS,
+									},
+								},
+								InitialDelaySeconds: 5,
+								TimeoutSeconds:      5,
+								PeriodSeconds:       10,
+								SuccessThreshold:    1,
+								FailureThreshold:    3,
+							},
+							ReadinessProbe: &corev1.Probe{
+								ProbeHandler: corev1.ProbeHandler{
+									HTTPGet: &corev1.HTTPGetAction{
+										Path:   "/readyz",
+										Port:   intstr.FromInt32(zitiwebhook.Spec.DeploymentSpec.Port),
+										Scheme: corev1.URISchemeHTTPS,
+									},
+								},
+								TimeoutSeconds:   5,
+								PeriodSeconds:    10,
+								SuccessThreshold: 1,
+								FailureThreshold: 3,
+							},
 							TerminationMessagePath:   "/dev/termination-log",
 							TerminationMessagePolicy: corev1.TerminationMessageReadFile,
 						},
@@ -215,7 +215,7 @@ var _ = Describe("ZitiWebhook Controller", func() {
 				Expect(serviceAccount.ObjectMeta.Labels).To(HaveKeyWithValue("app.kubernetes.io/component", "webhook"))
 
 				By("Verifying the ClusterRole specs")
-				Expect(clusterRole.Rules).To(HaveLen(2))
+				Expect(clusterRole.Rules).To(HaveLen(4))
 				Expect(clusterRole.Rules[0].APIGroups).To(Equal([]string{""}))
 				Expect(clusterRole.Rules[0].Resources).To(Equal([]string{"services", "namespaces"}))
 				Expect(clusterRole.Rules[0].Verbs).To(Equal([]string{"get", "list", "watch"}))
@@ -226,6 +226,11 @@ var _ = Describe("ZitiWebhook Controller", func() {
 				Expect(clusterRole.Rules[1].Verbs).To(Equal([]string{"get", "delete"}))
 				Expect(clusterRole.Rules[1].ResourceNames).To(BeEmpty())
 				Expect(clusterRole.Rules[1].NonResourceURLs).To(BeEmpty())
+				Expect(clusterRole.Rules[2].APIGroups).To(Equal([]string{""}))
+				Expect(clusterRole.Rules[2].Resources).To(Equal([]string{"events"}))
+				Expect(clusterRole.Rules[2].Verbs).To(Equal([]string{"create"}))
+				Expect(clusterRole.Rules[3].Resources).To(Equal([]string{"pods"}))
+				Expect(clusterRole.Rules[3].Verbs).To(Equal([]string{"get", "list"}))
 				Expect(clusterRole.ObjectMeta.Labels).To(HaveKeyWithValue("app", zitiwebhook.Spec.Name))
 				Expect(clusterRole.ObjectMeta.Labels).To(HaveKeyWithValue("app.kubernetes.io/name", zitiwebhook.Spec.Name+"-"+zitiwebhook.Namespace))
 				Expect(clusterRole.ObjectMeta.Labels).To(HaveKeyWithValue("app.kubernetes.io/part-of", zitiwebhook.Spec.Name+"-operator"))
@@ -240,7 +245,7 @@ var _ = Describe("ZitiWebhook Controller", func() {
 						{Key: "kubernetes.io/metadata.name", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"kube-system"}},
 						{Key: "tunnel.openziti.io/enabled", Operator: metav1.LabelSelectorOpIn, Values: []string{"true", "false"}},
 					}}))
-				Expect(mutatingWebhook.Webhooks[0].SideEffects).To(Equal(&[]admissionregistrationv1.SideEffectClass{admissionregistrationv1.SideEffectClassNone}[0]))
+				Expect(mutatingWebhook.Webhooks[0].SideEffects).To(Equal(&[]admissionregistrationv1.SideEffectClass{admissionregistrationv1.SideEffectClassNoneOnDryRun}[0]))
 				Expect(mutatingWebhook.Webhooks[0].FailurePolicy).To(Equal(&[]admissionregistrationv1.FailurePolicyType{admissionregistrationv1.Fail}[0]))
 				Expect(mutatingWebhook.Webhooks[0].TimeoutSeconds).To(Equal(&[]int32{30}[0]))
 				Expect(mutatingWebhook.Webhooks[0].MatchPolicy).To(Equal(&[]admissionregistrationv1.MatchPolicyType{admissionregistrationv1.Equivalent}[0]))
@@ -265,7 +270,7 @@ var _ = Describe("ZitiWebhook Controller", func() {
 					MatchExpressions: []metav1.LabelSelectorRequirement{
 						{Key: "kubernetes.io/metadata.name", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"kube-system"}},
 					}}))
-				Expect(mutatingWebhook.Webhooks[1].SideEffects).To(Equal(&[]admissionregistrationv1.SideEffectClass{admissionregistrationv1.SideEffectClassNone}[0]))
+				Expect(mutatingWebhook.Webhooks[1].SideEffects).To(Equal(&[]admissionregistrationv1.SideEffectClass{admissionregistrationv1.SideEffectClassNoneOnDryRun}[0]))
 				Expect(mutatingWebhook.Webhooks[1].FailurePolicy).To(Equal(&[]admissionregistrationv1.FailurePolicyType{admissionregistrationv1.Fail}[0]))
 				Expect(mutatingWebhook.Webhooks[1].TimeoutSeconds).To(Equal(&[]int32{30}[0]))
 				Expect(mutatingWebhook.Webhooks[1].MatchPolicy).To(Equal(&[]admissionregistrationv1.MatchPolicyType{admissionregistrationv1.Equivalent}[0]))
@@ -411,21 +416,26 @@ var _ = Describe("ZitiWebhook Controller", func() {
 					ValueFrom: nil,
 				}))
 				Expect(container.Env[11]).To(Equal(corev1.EnvVar{
+					Name:      "ZITI_MGMT_API_SERVICE",
+					Value:     "",
+					ValueFrom: nil,
+				}))
+				Expect(container.Env[12]).To(Equal(corev1.EnvVar{
 					Name:      "POD_SECURITY_CONTEXT_OVERRIDE",
 					Value:     "false",
 					ValueFrom: nil,
 				}))
-				Expect(container.Env[12]).To(Equal(corev1.EnvVar{
+				Expect(container.Env[13]).To(Equal(corev1.EnvVar{
 					Name:      "CLUSTER_DNS_SERVICE_IP",
 					Value:     "",
 					ValueFrom: nil,
 				}))
-				Expect(container.Env[13]).To(Equal(corev1.EnvVar{
+				Expect(container.Env[14]).To(Equal(corev1.EnvVar{
 					Name:      "SEARCH_DOMAIN_LIST",
 					Value:     "",
 					ValueFrom: nil,
 				}))
-				Expect(container.Env[14]).To(Equal(corev1.EnvVar{
+				Expect(container.Env[15]).To(Equal(corev1.EnvVar{
 					Name:      "ZITI_ROLE_KEY",
 					Value:     "identity.openziti.io/role-attributes",
 					ValueFrom: nil,
@@ -434,6 +444,14 @@ var _ = Describe("ZitiWebhook Controller", func() {
 				Expect(container.Resources.Requests.Memory().String()).To(Equal("128Mi"))
 				Expect(container.Resources.Limits.Cpu().String()).To(Equal("500m"))
 				Expect(container.Resources.Limits.Memory().String()).To(Equal("512Mi"))
+				Expect(container.LivenessProbe).NotTo(BeNil())
+				Expect(container.LivenessProbe.HTTPGet.Path).To(Equal("/healthz"))
+				Expect(container.LivenessProbe.HTTPGet.Port).To(Equal(intstr.FromInt32(9443)))
+				Expect(container.LivenessProbe.HTTPGet.Scheme).To(Equal(corev1.URISchemeHTTPS))
+				Expect(container.ReadinessProbe).NotTo(BeNil())
+				Expect(container.ReadinessProbe.HTTPGet.Path).To(Equal("/readyz"))
+				Expect(container.ReadinessProbe.HTTPGet.Port).To(Equal(intstr.FromInt32(9443)))
+				Expect(container.ReadinessProbe.HTTPGet.Scheme).To(Equal(corev1.URISchemeHTTPS))
 				Expect(deployment.Spec.Template.Spec.ServiceAccountName).To(Equal(zitiwebhookName + "-service-account"))
 				Expect(deployment.Spec.Template.Spec.RestartPolicy).To(Equal(corev1.RestartPolicyAlways))
 				Expect(deployment.Spec.Template.Spec.DNSPolicy).To(Equal(corev1.DNSClusterFirst))
@@ -613,6 +631,7 @@ var _ = Describe("ZitiWebhook Controller", func() {
 							SidecarPrefix:          "zt-updated",
 							SidecarIdentityDir:     "/ziti-tunnel-updated",
 							ZitiCtrlMgmtApi:        "https://updated-controller:1280/edge/management/v1",
+							ZitiCtrlMgmtApiService: "ziti-mgmt-api",
 							PodSecurityOverride:    true,
 							ClusterDnsServiceIP:    "",
 							SearchDomainList:       "",
@@ -764,6 +783,7 @@ var _ = Describe("ZitiWebhook Controller", func() {
 				Expect(deployment.Spec.Template.Spec.Containers[0].Ports[0].ContainerPort).To(Equal(int32(8443)))
 				Expect(deployment.Spec.Template.Spec.Containers[0].Args).To(Equal([]string{"webhook", "--v=3"}))
 				Expect(deployment.Spec.Template.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: "ZITI_MGMT_API", Value: "https://updated-controller:1280/edge/management/v1"}))
+				Expect(deployment.Spec.Template.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: "ZITI_MGMT_API_SERVICE", Value: "ziti-mgmt-api"}))
 				Expect(deployment.Spec.Template.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: "SIDECAR_IMAGE", Value: "openziti/ziti-edge-tunnel"}))
 				Expect(deployment.Spec.Template.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: "SIDECAR_IMAGE_VERSION", Value: "1.2.0"}))
 				Expect(deployment.Spec.Template.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{Name: "SIDECAR_IMAGE_PULL_POLICY", Value: "Always"}))
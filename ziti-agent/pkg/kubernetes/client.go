@@ -3,6 +3,7 @@ package kubernetes
 import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 )
 
@@ -21,3 +22,15 @@ func Client() (*kubernetes.Clientset, error) {
 	}
 	return clientset, nil
 }
+
+// ClientFromKubeconfig builds a clientset from the given kubeconfig file, or else from $KUBECONFIG
+// or ~/.kube/config, falling back to the in-cluster config when none of them exist
+func ClientFromKubeconfig(kubeconfig string) (*kubernetes.Clientset, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
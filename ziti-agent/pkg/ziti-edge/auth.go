@@ -0,0 +1,125 @@
+package zitiedge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	openapiclient "github.com/go-openapi/runtime/client"
+	"github.com/openziti/edge-api/rest_management_api_client"
+	"github.com/openziti/edge-api/rest_management_api_client/authentication"
+	rest_model_edge "github.com/openziti/edge-api/rest_model"
+	"github.com/openziti/edge-api/rest_util"
+)
+
+// Ways the admin can log in to the management API
+const (
+	// AuthMethodCert authenticates with the client certificate of an admin identity
+	AuthMethodCert = "cert"
+	// AuthMethodUpdb authenticates with a username and password
+	AuthMethodUpdb = "updb"
+	// AuthMethodExtJWT authenticates with a JWT issued by an external JWT signer the controller trusts
+	AuthMethodExtJWT = "ext-jwt"
+)
+
+// authenticator returns the rest_util authenticator for the configured method
+func (cfg *Config) authenticator() (rest_util.Authenticator, error) {
+	var (
+		auth rest_util.Authenticator
+		base *rest_util.AuthenticatorBase
+	)
+	switch cfg.AuthMethod {
+	case "", AuthMethodCert:
+		if cfg.Cert == nil || cfg.PrivateKey == nil {
+			return nil, errors.New("cert authentication requires a certificate and private key")
+		}
+		cert := rest_util.NewAuthenticatorCert(cfg.Cert, cfg.PrivateKey)
+		auth, base = cert, &cert.AuthenticatorBase
+	case AuthMethodUpdb:
+		if cfg.Username == "" || cfg.Password == "" {
+			return nil, errors.New("updb authentication requires a username and password")
+		}
+		updb := rest_util.NewAuthenticatorUpdb(cfg.Username, cfg.Password)
+		auth, base = updb, &updb.AuthenticatorBase
+	case AuthMethodExtJWT:
+		if cfg.JWTFile == "" {
+			return nil, errors.New("ext-jwt authentication requires a token file")
+		}
+		jwt := &extJWTAuthenticator{tokenFile: cfg.JWTFile}
+		auth, base = jwt, &jwt.AuthenticatorBase
+	default:
+		return nil, fmt.Errorf("unknown authentication method %q", cfg.AuthMethod)
+	}
+	base.RootCas = &cfg.CAS
+	base.TlsConfigFunc = cfg.TLS.tlsConfigFunc()
+	base.HttpClientFunc = cfg.httpClientFunc()
+	return auth, nil
+}
+
+// extJWTAuthenticator logs in with a bearer token read from a file at every login, so that a
+// token rotated on disk is used for the next API session. Unlike rest_util.AuthenticatorAuthHeader,
+// it verifies the controller against the configured CA pool.
+type extJWTAuthenticator struct {
+	rest_util.AuthenticatorBase
+	tokenFile string
+}
+
+var _ rest_util.Authenticator = &extJWTAuthenticator{}
+
+func (a *extJWTAuthenticator) BuildHttpClient() (*http.Client, error) {
+	return a.BuildHttpClientWithModifyTls(nil)
+}
+
+func (a *extJWTAuthenticator) token() (string, error) {
+	contents, err := os.ReadFile(a.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read ext-jwt token: %w", err)
+	}
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", fmt.Errorf("ext-jwt token file %s is empty", a.tokenFile)
+	}
+	return token, nil
+}
+
+func (a *extJWTAuthenticator) Authenticate(controllerAddress *url.URL) (*rest_model_edge.CurrentAPISessionDetail, error) {
+	token, err := a.token()
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := a.BuildHttpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	path := rest_management_api_client.DefaultBasePath
+	if controllerAddress.Path != "" && controllerAddress.Path != "/" {
+		path = controllerAddress.Path
+	}
+	clientRuntime := openapiclient.NewWithClient(controllerAddress.Host, path, rest_management_api_client.DefaultSchemes, httpClient)
+	clientRuntime.DefaultAuthentication = &rest_util.HeaderAuth{
+		HeaderName:  "Authorization",
+		HeaderValue: "Bearer " + token,
+	}
+
+	resp, err := rest_management_api_client.New(clientRuntime, nil).Authentication.Authenticate(&authentication.AuthenticateParams{
+		Auth: &rest_model_edge.Authenticate{
+			ConfigTypes: a.ConfigTypes,
+			EnvInfo:     a.EnvInfo,
+			SdkInfo:     a.SdkInfo,
+		},
+		Method:  AuthMethodExtJWT,
+		Context: context.Background(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.GetPayload() == nil {
+		return nil, fmt.Errorf("error, nil payload: %v", resp.Error())
+	}
+	return resp.GetPayload().Data, nil
+}
@@ -0,0 +1,45 @@
+package zitiedge
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthenticatorRequiresCredentials(t *testing.T) {
+	for _, cfg := range []Config{
+		{},
+		{AuthMethod: AuthMethodUpdb, Username: "admin"},
+		{AuthMethod: AuthMethodExtJWT},
+		{AuthMethod: "oidc"},
+	} {
+		if _, err := cfg.authenticator(); err == nil {
+			t.Errorf("authenticator for %q accepted incomplete configuration", cfg.AuthMethod)
+		}
+	}
+}
+
+func TestExtJWTTokenReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	auth := &extJWTAuthenticator{tokenFile: path}
+
+	for _, want := range []string{"first", "rotated"} {
+		if err := os.WriteFile(path, []byte(want+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := auth.token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got token %q, want %q", got, want)
+		}
+	}
+
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.token(); err == nil {
+		t.Error("empty token file accepted")
+	}
+}
@@ -0,0 +1,108 @@
+package zitiedge
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/openziti/edge-api/rest_management_api_client"
+	"github.com/openziti/edge-api/rest_management_api_client/informational"
+	"k8s.io/klog/v2"
+)
+
+// Controller releases that introduced the features the agent can use
+var (
+	// auth policies and the externalId of identities came with external JWT signers
+	authPoliciesSince = semver{0, 22, 0}
+	// from this release identities are either Default or Router; User, Device and Service are
+	// kept as aliases of Default
+	defaultIdentityTypeSince = semver{0, 27, 0}
+	// event types were renamed in v1.0, e.g. fabric.routers became router; older controllers only
+	// accept the previous names
+	eventTypesSince = semver{1, 0, 0}
+)
+
+// Capabilities describes what the controller behind a management API session supports. The zero
+// value, with Known unset, is used until a controller has answered.
+type Capabilities struct {
+	// Version is the controller release, e.g. v1.1.15
+	Version string `json:"version,omitempty"`
+	// Known is set once the version was read; the flags below are all false until then
+	Known bool `json:"known"`
+	// Advertised lists the capabilities the controller reports, such as HA_CONTROLLER
+	Advertised []string `json:"advertised,omitempty"`
+
+	AuthPolicies        bool `json:"authPolicies"`
+	ExternalIDs         bool `json:"externalIds"`
+	DefaultIdentityType bool `json:"defaultIdentityType"`
+	EventTypes          bool `json:"eventTypes"`
+}
+
+// Has reports whether the controller advertises capability
+func (c Capabilities) Has(capability string) bool {
+	return slices.Contains(c.Advertised, capability)
+}
+
+// newCapabilities derives the feature flags from a controller version. Development builds report
+// v0.0.0 and are assumed to support everything.
+func newCapabilities(version string, advertised []string) Capabilities {
+	caps := Capabilities{Version: version, Known: true, Advertised: advertised}
+	v, ok := parseSemver(version)
+	if !ok || v == (semver{}) {
+		klog.V(2).Infof("Controller version %q is not a release, assuming it supports every feature", version)
+		v = semver{1 << 30, 0, 0}
+	}
+	caps.AuthPolicies = !v.less(authPoliciesSince)
+	caps.ExternalIDs = caps.AuthPolicies
+	caps.DefaultIdentityType = !v.less(defaultIdentityTypeSince)
+	caps.EventTypes = !v.less(eventTypesSince)
+	return caps
+}
+
+// probeCapabilities reads the controller version with a fresh session. A failure leaves the
+// capabilities unknown rather than failing the login.
+func probeCapabilities(ctx context.Context, url string, client *rest_management_api_client.ZitiEdgeManagement) Capabilities {
+	resp, err := client.Informational.ListVersion(withContext(ctx, informational.NewListVersionParams()))
+	if err != nil || resp.GetPayload() == nil || resp.GetPayload().Data == nil {
+		klog.Warningf("Failed to read the controller version from %s, assuming an old controller: %v", url, err)
+		return Capabilities{}
+	}
+	version := resp.GetPayload().Data
+	caps := newCapabilities(version.Version, version.Capabilities)
+	klog.Infof("Management API endpoint %s is controller %s", url, caps.Version)
+	return caps
+}
+
+// semver is the major, minor and patch of a release
+type semver [3]int
+
+// parseSemver reads versions such as v1.1.15 or 0.27.2-rc1
+func parseSemver(version string) (semver, bool) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return semver{}, false
+	}
+	var v semver
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return semver{}, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+func (v semver) less(other semver) bool {
+	for i := range v {
+		if v[i] != other[i] {
+			return v[i] < other[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package zitiedge
+
+import "testing"
+
+func TestNewCapabilities(t *testing.T) {
+	tests := []struct {
+		version                   string
+		authPolicies, defaultType bool
+	}{
+		{"v0.21.5", false, false},
+		{"v0.22.0", true, false},
+		{"0.27.0-rc1", true, true},
+		{"v1.1.15", true, true},
+		{"v0.0.0", true, true},
+	}
+	for _, tt := range tests {
+		caps := newCapabilities(tt.version, []string{"HA_CONTROLLER"})
+		if !caps.Known || caps.AuthPolicies != tt.authPolicies || caps.ExternalIDs != tt.authPolicies || caps.DefaultIdentityType != tt.defaultType {
+			t.Errorf("%s: got %+v", tt.version, caps)
+		}
+		if !caps.Has("HA_CONTROLLER") || caps.Has("OIDC_AUTH") {
+			t.Errorf("%s: advertised capabilities %v", tt.version, caps.Advertised)
+		}
+	}
+}
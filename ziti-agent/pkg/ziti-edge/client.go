@@ -5,7 +5,6 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
-	"net/url"
 	"strings"
 	"time"
 
@@ -17,25 +16,37 @@ import (
 
 type Config struct {
 	ApiEndpoint string
-	Cert        *x509.Certificate
-	PrivateKey  crypto.PrivateKey
-	CAS         x509.CertPool
-	CABundle    []byte
+	// AuthMethod is AuthMethodCert (the default), AuthMethodUpdb or AuthMethodExtJWT
+	AuthMethod string
+	// Cert and PrivateKey are the admin identity for cert authentication
+	Cert       *x509.Certificate
+	PrivateKey crypto.PrivateKey
+	// Username and Password are the credentials for updb authentication
+	Username string
+	Password string
+	// JWTFile holds the token for ext-jwt authentication; it is read at every login
+	JWTFile  string
+	CAS      x509.CertPool
+	CABundle []byte
+	// TLS adjusts how the controller certificate is verified
+	TLS TLSVerification
+	// Overlay, when set, reaches the management API through a Ziti service
+	Overlay *Overlay
 }
 
-// Create a Ziti Edge API session with a Ziti Identity configuration
+// Create a Ziti Edge API session with the configured authentication method
 func Client(cfg *Config) (*rest_management_api_client.ZitiEdgeManagement, error) {
-	klog.V(5).Infof("Creating Ziti Edge Management client with endpoint: %s, cert subject: %s",
-		cfg.ApiEndpoint,
-		cfg.Cert.Subject,
-	)
+	auth, err := cfg.authenticator()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Cert == nil {
+		klog.V(5).Infof("Creating Ziti Edge Management client with endpoint: %s, auth method: %s", cfg.ApiEndpoint, cfg.AuthMethod)
+	} else {
+		logClientCertificate(cfg)
+	}
 
-	klog.V(5).Info("Client Certificate Details:")
-	klog.V(5).Infof("  Subject: %v", cfg.Cert.Subject)
-	klog.V(5).Infof("  Issuer: %v", cfg.Cert.Issuer)
-	klog.V(5).Infof("  Valid from: %v to %v", cfg.Cert.NotBefore, cfg.Cert.NotAfter)
-	klog.V(5).Infof("  Key usages: %s", keyUsageString(cfg.Cert.KeyUsage))
-	klog.V(5).Infof("  Extended Key usages: %s", extKeyUsageString(cfg.Cert.ExtKeyUsage))
 	klog.V(5).Info("CA Pool Certificate Details:")
 	// Log the key usages of the CA certificate
 	block, _ := pem.Decode(cfg.CABundle)
@@ -53,32 +64,18 @@ func Client(cfg *Config) (*rest_management_api_client.ZitiEdgeManagement, error)
 			klog.V(5).Infof("  CA Extended Key usages: %s", extKeyUsageString(parsedCert.ExtKeyUsage))
 		}
 	}
-	// Check if our client cert is trusted by the CA pool and analyze key usage
-	opts := x509.VerifyOptions{
-		Roots: &cfg.CAS,
-	}
-	if _, err := cfg.Cert.Verify(opts); err == nil {
-		klog.V(4).Info("Client certificate is trusted by the CA pool")
-	} else {
-		klog.V(4).Infof("Warning: Client certificate is not trusted by the CA pool: %v", err)
-		
-		// Analyze key usage compatibility for detailed reporting
-		analyzeKeyUsageCompatibility(cfg.Cert)
-	}
-
 	klog.V(5).Info("Verifying controller with provided CA pool...")
 	
-	// Extract base controller URL for certificate verification
-	// VerifyController appends /edge/client/v1/versions, so we need the base URL
-	baseControllerURL, err := extractControllerBaseURL(cfg.ApiEndpoint)
+	// Management API calls go to the endpoint after the preset rules; verification may use another URL
+	baseControllerURL, err := cfg.TLS.apiBaseURL(cfg.ApiEndpoint)
 	if err != nil {
 		klog.Errorf("Failed to extract base controller URL: %v", err)
 		return nil, errors.Wrap(err, "failed to extract base controller URL")
 	}
-	
-	klog.V(5).Infof("Using base controller URL for verification: %s", baseControllerURL)
-	ok, err := rest_util.VerifyController(baseControllerURL, &cfg.CAS)
-	if !ok {
+
+	verifyURL := cfg.TLS.verifyURL(baseControllerURL)
+	klog.V(5).Infof("Using base controller URL for verification: %s", verifyURL)
+	if err := verifyController(verifyURL, &cfg.CAS, cfg.TLS, cfg.httpClientFunc()); err != nil {
 		klog.Errorf("Ziti Controller failed CA validation - %s", err)
 		return nil, errors.Wrap(err, "controller verification failed")
 	}
@@ -88,8 +85,8 @@ func Client(cfg *Config) (*rest_management_api_client.ZitiEdgeManagement, error)
 	mgmtAPIURL := reconstituteMgmtAPIURL(baseControllerURL)
 	klog.V(5).Infof("Using reconstituted management API URL: %s", mgmtAPIURL)
 
-	klog.V(5).Info("Creating new Edge Management client with certificate...")
-	client, err := rest_util.NewEdgeManagementClientWithCert(cfg.Cert, cfg.PrivateKey, mgmtAPIURL, &cfg.CAS)
+	klog.V(5).Info("Creating new Edge Management client...")
+	client, err := rest_util.NewEdgeManagementClientWithAuthenticator(auth, mgmtAPIURL)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create edge management client")
 	}
@@ -98,32 +95,31 @@ func Client(cfg *Config) (*rest_management_api_client.ZitiEdgeManagement, error)
 	return client, nil
 }
 
-// extractControllerBaseURL extracts the base controller URL for certificate verification
-// by removing ALL URL path components and conditionally removing -p suffix from NetFoundry hostnames
-// VerifyController expects just the base URL since it appends /edge/client/v1/versions
-func extractControllerBaseURL(mgmtAPIURL string) (string, error) {
-	parsedURL, err := url.Parse(mgmtAPIURL)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse management API URL: %w", err)
-	}
-
-	hostname := parsedURL.Hostname()
-	port := parsedURL.Port()
+// logClientCertificate logs the admin certificate and whether the CA pool trusts it
+func logClientCertificate(cfg *Config) {
+	klog.V(5).Infof("Creating Ziti Edge Management client with endpoint: %s, cert subject: %s",
+		cfg.ApiEndpoint,
+		cfg.Cert.Subject,
+	)
 
-	// Check if hostname matches NetFoundry pattern: <uuid>-p.<env>.netfoundry.io
-	// If so, remove the -p suffix for certificate verification
-	if strings.Contains(hostname, ".netfoundry.io") && strings.Contains(hostname, "-p.") {
-		hostname = strings.Replace(hostname, "-p.", ".", 1)
+	klog.V(5).Info("Client Certificate Details:")
+	klog.V(5).Infof("  Subject: %v", cfg.Cert.Subject)
+	klog.V(5).Infof("  Issuer: %v", cfg.Cert.Issuer)
+	klog.V(5).Infof("  Valid from: %v to %v", cfg.Cert.NotBefore, cfg.Cert.NotAfter)
+	klog.V(5).Infof("  Key usages: %s", keyUsageString(cfg.Cert.KeyUsage))
+	klog.V(5).Infof("  Extended Key usages: %s", extKeyUsageString(cfg.Cert.ExtKeyUsage))
+	// Check if our client cert is trusted by the CA pool and analyze key usage
+	opts := x509.VerifyOptions{
+		Roots: &cfg.CAS,
 	}
-
-	// Construct base URL with scheme, cleaned hostname, and port, but NO path
-	// VerifyController will append /edge/client/v1/versions to this base URL
-	baseURL := fmt.Sprintf("%s://%s", parsedURL.Scheme, hostname)
-	if port != "" {
-		baseURL += ":" + port
+	if _, err := cfg.Cert.Verify(opts); err == nil {
+		klog.V(4).Info("Client certificate is trusted by the CA pool")
+	} else {
+		klog.V(4).Infof("Warning: Client certificate is not trusted by the CA pool: %v", err)
+		
+		// Analyze key usage compatibility for detailed reporting
+		analyzeKeyUsageCompatibility(cfg.Cert)
 	}
-
-	return baseURL, nil
 }
 
 // reconstituteMgmtAPIURL takes a sanitized base controller URL and reconstitutes the management API endpoint
@@ -0,0 +1,112 @@
+package zitiedge
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/openziti/edge-api/rest_util"
+)
+
+func TestControllerURLs(t *testing.T) {
+	tests := []struct {
+		name     string
+		tls      TLSVerification
+		endpoint string
+		mgmtAPI  string
+		verify   string
+	}{
+		{
+			name:     "plain",
+			endpoint: "https://ctrl.example.com:1280/edge/management/v1",
+			mgmtAPI:  "https://ctrl.example.com:1280/edge/management/v1",
+			verify:   "https://ctrl.example.com:1280",
+		},
+		{
+			name:     "netfoundry host without preset",
+			endpoint: "https://abc-p.production.netfoundry.io:443/edge/management/v1",
+			mgmtAPI:  "https://abc-p.production.netfoundry.io:443/edge/management/v1",
+			verify:   "https://abc-p.production.netfoundry.io:443",
+		},
+		{
+			name:     "netfoundry preset",
+			tls:      TLSVerification{Preset: TLSPresetNetFoundry},
+			endpoint: "https://abc-p.production.netfoundry.io:443/edge/management/v1",
+			mgmtAPI:  "https://abc.production.netfoundry.io:443/edge/management/v1",
+			verify:   "https://abc.production.netfoundry.io:443",
+		},
+		{
+			name:     "netfoundry preset on another domain",
+			tls:      TLSVerification{Preset: TLSPresetNetFoundry},
+			endpoint: "https://abc-p.netfoundry.io.example.com/edge/management/v1",
+			mgmtAPI:  "https://abc-p.netfoundry.io.example.com/edge/management/v1",
+			verify:   "https://abc-p.netfoundry.io.example.com",
+		},
+		{
+			name:     "verify url override",
+			tls:      TLSVerification{VerifyURL: "https://ctrl-client.example.com:1280/"},
+			endpoint: "https://lb.example.com/edge/management/v1",
+			mgmtAPI:  "https://lb.example.com/edge/management/v1",
+			verify:   "https://ctrl-client.example.com:1280",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, err := tt.tls.apiBaseURL(tt.endpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := reconstituteMgmtAPIURL(base); got != tt.mgmtAPI {
+				t.Errorf("management API URL %s, want %s", got, tt.mgmtAPI)
+			}
+			if got := tt.tls.verifyURL(base); got != tt.verify {
+				t.Errorf("verification URL %s, want %s", got, tt.verify)
+			}
+		})
+	}
+}
+
+func TestVerifyController(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	cas := x509.NewCertPool()
+	cas.AddCert(srv.Certificate())
+	// the test server certificate is valid for example.com but not for localhost
+	addr := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name    string
+		tls     TLSVerification
+		wantErr bool
+	}{
+		{name: "name mismatch", wantErr: true},
+		{name: "server name", tls: TLSVerification{ServerName: "example.com"}},
+		{name: "pinned", tls: TLSVerification{ServerName: "example.com", CAFingerprint: strings.ToUpper(Fingerprint(srv.Certificate()))}},
+		{name: "pin mismatch", tls: TLSVerification{ServerName: "example.com", CAFingerprint: strings.Repeat("00", 32)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyController(addr, cas, tt.tls, rest_util.NewHttpClientWithTlsConfig)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 2 || paths[0] != "/edge/client/v1/versions" {
+		t.Errorf("controller requests %v", paths)
+	}
+}
@@ -0,0 +1,132 @@
+package zitiedge
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/openziti/edge-api/rest_management_api_client"
+	"github.com/openziti/edge-api/rest_management_api_client/controllers"
+	"k8s.io/klog/v2"
+)
+
+// managementAPIBinding is the key under which controllers advertise their management API addresses
+const managementAPIBinding = "edge-management"
+
+// Discover asks the controller cluster for its members and merges their advertised management API
+// addresses into the endpoint set. Configured endpoints are always kept; discovered endpoints that
+// are no longer advertised are dropped. A controller that does not run in a cluster answers with
+// an empty listing, which leaves the configured endpoints alone.
+func (e *Edge) Discover(ctx context.Context) error {
+	var advertised []string
+	err := e.do(ctx, "ListControllers", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error {
+		resp, err := client.Controllers.ListControllers(withContext(ctx, controllers.NewListControllersParams()), nil)
+		if err != nil {
+			return err
+		}
+		advertised = advertisedEndpoints(resp)
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			klog.V(2).Infof("Controller does not list cluster members, keeping the configured management API endpoints")
+			return nil
+		}
+		return err
+	}
+
+	e.merge(advertised)
+	return nil
+}
+
+// advertisedEndpoints collects the v1 management API URLs of the online controllers
+func advertisedEndpoints(resp *controllers.ListControllersOK) []string {
+	var urls []string
+	if resp == nil || resp.Payload == nil {
+		return urls
+	}
+	for _, ctrl := range resp.Payload.Data {
+		if ctrl == nil || (ctrl.IsOnline != nil && !*ctrl.IsOnline) {
+			continue
+		}
+		for _, address := range ctrl.APIAddresses[managementAPIBinding] {
+			if address == nil || address.URL == "" || (address.Version != "" && address.Version != "v1") {
+				continue
+			}
+			url := normalizeEndpoint(address.URL)
+			if !slices.Contains(urls, url) {
+				urls = append(urls, url)
+			}
+		}
+	}
+	return urls
+}
+
+// merge adds newly advertised endpoints after the existing ones and drops discovered endpoints
+// that are no longer advertised
+func (e *Edge) merge(advertised []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.lastDiscovery = time.Now()
+
+	kept := e.endpoints[:0:0]
+	for _, ep := range e.endpoints {
+		if ep.discovered && !slices.Contains(advertised, ep.url) {
+			klog.Infof("Management API endpoint %s is no longer advertised by the controller cluster", ep.url)
+			ep.removed = true
+			if e.preferred == ep {
+				e.preferred = nil
+			}
+			forgetEndpoint(ep.url)
+			continue
+		}
+		kept = append(kept, ep)
+	}
+
+	for _, url := range advertised {
+		if slices.ContainsFunc(kept, func(ep *endpoint) bool { return normalizeEndpoint(ep.url) == url }) {
+			continue
+		}
+		klog.Infof("Discovered management API endpoint %s", url)
+		kept = append(kept, &endpoint{url: url, discovered: true})
+		endpointAvailable.WithLabelValues(url).Set(1)
+	}
+
+	e.endpoints = kept
+	if e.preferred != nil {
+		setActiveEndpoint(e.urls(), e.preferred.url)
+	}
+}
+
+// runDiscovery refreshes the endpoint set every discovery interval until ctx is done
+func (e *Edge) runDiscovery(ctx context.Context) {
+	ticker := time.NewTicker(e.failover.DiscoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.Discover(ctx); err != nil && ctx.Err() == nil {
+			klog.Warningf("Failed to discover controller cluster members: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Endpoints returns the management API endpoints currently in use, configured and discovered
+func (e *Edge) Endpoints() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.urls()
+}
+
+// normalizeEndpoint makes URLs that differ only by a trailing slash compare equal
+func normalizeEndpoint(url string) string {
+	return strings.TrimRight(url, "/")
+}
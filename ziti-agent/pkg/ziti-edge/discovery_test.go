@@ -0,0 +1,156 @@
+package zitiedge
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/openziti/edge-api/rest_management_api_client/controllers"
+	rest_model_edge "github.com/openziti/edge-api/rest_model"
+)
+
+func controllerDetail(online *bool, addresses ...*rest_model_edge.APIAddress) *rest_model_edge.ControllerDetail {
+	return &rest_model_edge.ControllerDetail{
+		IsOnline:     online,
+		APIAddresses: rest_model_edge.APIAddressList{managementAPIBinding: addresses},
+	}
+}
+
+func TestAdvertisedEndpoints(t *testing.T) {
+	online, offline := true, false
+	tests := []struct {
+		name        string
+		controllers rest_model_edge.ControllersList
+		want        []string
+	}{
+		{name: "no cluster"},
+		{
+			name: "online members",
+			controllers: rest_model_edge.ControllersList{
+				controllerDetail(&online, &rest_model_edge.APIAddress{URL: "https://ctrl1:1280/edge/management/v1", Version: "v1"}),
+				// controllers that do not report their state are assumed online
+				controllerDetail(nil, &rest_model_edge.APIAddress{URL: "https://ctrl2:1280/edge/management/v1"}),
+			},
+			want: []string{"https://ctrl1:1280/edge/management/v1", "https://ctrl2:1280/edge/management/v1"},
+		},
+		{
+			name: "offline member",
+			controllers: rest_model_edge.ControllersList{
+				controllerDetail(&offline, &rest_model_edge.APIAddress{URL: "https://ctrl1:1280/edge/management/v1"}),
+				controllerDetail(&online, &rest_model_edge.APIAddress{URL: "https://ctrl2:1280/edge/management/v1"}),
+			},
+			want: []string{"https://ctrl2:1280/edge/management/v1"},
+		},
+		{
+			name: "other versions and bindings",
+			controllers: rest_model_edge.ControllersList{
+				controllerDetail(&online,
+					&rest_model_edge.APIAddress{URL: "https://ctrl1:1280/edge/management/v2", Version: "v2"},
+					&rest_model_edge.APIAddress{URL: ""},
+					nil,
+				),
+				{IsOnline: &online, APIAddresses: rest_model_edge.APIAddressList{
+					"edge-client": {{URL: "https://ctrl2:1280/edge/client/v1", Version: "v1"}},
+				}},
+				nil,
+			},
+		},
+		{
+			name: "trailing slashes",
+			controllers: rest_model_edge.ControllersList{
+				controllerDetail(&online,
+					&rest_model_edge.APIAddress{URL: "https://ctrl1:1280/edge/management/v1/"},
+					&rest_model_edge.APIAddress{URL: "https://ctrl1:1280/edge/management/v1"},
+				),
+			},
+			want: []string{"https://ctrl1:1280/edge/management/v1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := controllers.NewListControllersOK()
+			resp.Payload = &rest_model_edge.ListControllersEnvelope{Data: tt.controllers}
+			if got := advertisedEndpoints(resp); !slices.Equal(got, tt.want) {
+				t.Errorf("advertised %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := advertisedEndpoints(controllers.NewListControllersOK()); len(got) != 0 {
+		t.Errorf("advertised %v without a payload", got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	const (
+		configured = "https://ctrl1:1280/edge/management/v1"
+		ctrl2      = "https://ctrl2:1280/edge/management/v1"
+		ctrl3      = "https://ctrl3:1280/edge/management/v1"
+	)
+	tests := []struct {
+		name       string
+		configured []string
+		// rounds are the endpoints advertised by successive discoveries
+		rounds [][]string
+		want   []string
+	}{
+		{
+			name:       "discovered endpoints follow the configured ones",
+			configured: []string{configured},
+			rounds:     [][]string{{ctrl2, configured, ctrl3}},
+			want:       []string{configured, ctrl2, ctrl3},
+		},
+		{
+			name:       "configured endpoints are kept when not advertised",
+			configured: []string{configured},
+			rounds:     [][]string{{ctrl2}, {}},
+			want:       []string{configured},
+		},
+		{
+			name:       "discovered endpoints are dropped when no longer advertised",
+			configured: []string{configured},
+			rounds:     [][]string{{ctrl2, ctrl3}, {ctrl3}},
+			want:       []string{configured, ctrl3},
+		},
+		{
+			name:       "configured endpoint with a trailing slash",
+			configured: []string{configured + "/"},
+			rounds:     [][]string{{configured, ctrl2}, {configured, ctrl2}},
+			want:       []string{configured + "/", ctrl2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewEdge(Config{}, tt.configured, Options{})
+			for _, advertised := range tt.rounds {
+				e.merge(advertised)
+			}
+			if got := e.Endpoints(); !slices.Equal(got, tt.want) {
+				t.Errorf("endpoints %v, want %v", got, tt.want)
+			}
+			if e.Status().LastDiscovery.IsZero() {
+				t.Error("discovery time not recorded")
+			}
+		})
+	}
+}
+
+func TestMergeDropsPreferredEndpoint(t *testing.T) {
+	const (
+		configured = "https://ctrl1:1280/edge/management/v1"
+		discovered = "https://ctrl2:1280/edge/management/v1"
+	)
+	e := NewEdge(Config{}, []string{configured}, Options{})
+	e.merge([]string{discovered})
+	ep := e.endpoints[1]
+	e.succeeded(ep)
+
+	e.merge(nil)
+	if e.preferred != nil || !ep.removed {
+		t.Fatalf("endpoint %s still preferred after it was dropped", discovered)
+	}
+	// a call still in flight on the dropped endpoint does not bring it back
+	e.succeeded(ep)
+	if e.preferred != nil {
+		t.Errorf("dropped endpoint %s preferred again", discovered)
+	}
+}
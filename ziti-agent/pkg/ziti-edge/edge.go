@@ -0,0 +1,529 @@
+package zitiedge
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/openziti/edge-api/rest_management_api_client"
+	"github.com/openziti/edge-api/rest_management_api_client/current_api_session"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultMinBackoff    = time.Second
+	defaultMaxBackoff    = 2 * time.Minute
+	defaultCheckInterval = 15 * time.Second
+)
+
+// FailoverConfig tunes how an Edge moves between management API endpoints. Zero values select
+// the defaults, except for DiscoveryInterval.
+type FailoverConfig struct {
+	// MinBackoff is how long an endpoint is skipped after its first failure; the period doubles
+	// with each consecutive failure up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// CheckInterval is how often endpoints with an open circuit are probed in the background
+	CheckInterval time.Duration
+	// DiscoveryInterval is how often the controller cluster is asked for its members; zero turns
+	// discovery off and only the configured endpoints are used
+	DiscoveryInterval time.Duration
+}
+
+// Options tune an Edge; zero values select the defaults
+type Options struct {
+	Failover FailoverConfig
+	Timeouts Timeouts
+	Retry    RetryPolicy
+}
+
+// Edge is a long-lived handle on the Ziti Edge Management API that is safe to share between
+// concurrent callers. Each call goes to the endpoint that last succeeded and fails over to the
+// other endpoints when it cannot be reached. Failing endpoints are skipped for a backoff period
+// and probed in the background until they recover. The endpoint set can grow with the members of
+// an HA controller cluster (see Discover). API sessions are kept per endpoint and renewed when the
+// controller reports them expired.
+type Edge struct {
+	cfg      Config
+	failover FailoverConfig
+	timeouts Timeouts
+	retry    RetryPolicy
+
+	mu            sync.RWMutex
+	endpoints     []*endpoint
+	preferred     *endpoint
+	lastError     error
+	lastDiscovery time.Time
+}
+
+// endpoint is one management API URL with its session and circuit breaker state; all fields but
+// url and loginMu are guarded by Edge.mu
+type endpoint struct {
+	url string
+	// discovered endpoints were advertised by the controller cluster rather than configured
+	discovered bool
+
+	// loginMu serializes logins so that concurrent callers waiting on an expired session
+	// trigger a single re-authentication
+	loginMu sync.Mutex
+
+	client      *rest_management_api_client.ZitiEdgeManagement
+	caps        Capabilities
+	loginAt     time.Time
+	logins      int
+	failures    int
+	openUntil   time.Time
+	lastSuccess time.Time
+	lastError   error
+	// removed is set once discovery drops the endpoint, so that calls still in flight on it do
+	// not make it preferred again
+	removed bool
+}
+
+// EdgeStatus is a point-in-time snapshot of an Edge session for debugging
+type EdgeStatus struct {
+	Endpoint       string           `json:"endpoint"`
+	Endpoints      []string         `json:"endpoints"`
+	Connected      bool             `json:"connected"`
+	LoginAt        time.Time        `json:"loginAt,omitempty"`
+	SessionAge     string           `json:"sessionAge,omitempty"`
+	Logins         int              `json:"logins"`
+	LastError      string           `json:"lastError,omitempty"`
+	LastDiscovery  time.Time        `json:"lastDiscovery,omitempty"`
+	Capabilities   Capabilities     `json:"capabilities"`
+	EndpointStates []EndpointStatus `json:"endpointStates"`
+}
+
+// EndpointStatus is the session and circuit breaker state of one management API endpoint
+type EndpointStatus struct {
+	URL              string    `json:"url"`
+	Discovered       bool      `json:"discovered,omitempty"`
+	Connected        bool      `json:"connected"`
+	Version          string    `json:"version,omitempty"`
+	Available        bool      `json:"available"`
+	Failures         int       `json:"failures,omitempty"`
+	CircuitOpenUntil time.Time `json:"circuitOpenUntil,omitempty"`
+	LastSuccess      time.Time `json:"lastSuccess,omitempty"`
+	LastError        string    `json:"lastError,omitempty"`
+}
+
+// loginError marks a failure to open an API session, which counts against the endpoint
+type loginError struct {
+	err error
+}
+
+func (e *loginError) Error() string { return e.err.Error() }
+func (e *loginError) Unwrap() error { return e.err }
+
+// NewEdge returns an Edge that authenticates with cfg against the given management API endpoints,
+// preferring them in order until one has succeeded. No connection is made until the first call.
+func NewEdge(cfg Config, endpoints []string, opts Options) *Edge {
+	failover := opts.Failover
+	if failover.MinBackoff <= 0 {
+		failover.MinBackoff = defaultMinBackoff
+	}
+	if failover.MaxBackoff < failover.MinBackoff {
+		failover.MaxBackoff = max(defaultMaxBackoff, failover.MinBackoff)
+	}
+	if failover.CheckInterval <= 0 {
+		failover.CheckInterval = defaultCheckInterval
+	}
+
+	e := &Edge{
+		cfg:      cfg,
+		failover: failover,
+		timeouts: opts.Timeouts,
+		retry:    opts.Retry.withDefaults(),
+	}
+	for _, url := range endpoints {
+		e.endpoints = append(e.endpoints, &endpoint{url: url})
+		endpointAvailable.WithLabelValues(url).Set(1)
+	}
+	return e
+}
+
+// do runs fn with a management client on behalf of the named zitiedge function. Endpoints are
+// tried in order of preference until one answers; an answer from the controller, including an
+// error status, ends the call. If the controller rejects the API session as unauthorized, the
+// session is dropped and fn is retried once on the same endpoint with a fresh login. Transient
+// failures are repeated according to the RetryPolicy, and the error returned is classified (see
+// Error).
+//
+// A pass that ends with a failed login is not repeated unless the controller could not be reached,
+// since bad credentials or an untrusted controller do not go away by trying again.
+//
+// Each attempt gets the function's timeout from Timeouts, and fn must bind the context it is
+// given to its request. Once ctx is done the call is abandoned without holding it against the
+// endpoint.
+func (e *Edge) do(ctx context.Context, function string, fn func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error) (err error) {
+	defer func(start time.Time) {
+		observeCall(function, start, err)
+	}(time.Now())
+
+	for retry := 0; ; retry++ {
+		err = classify(ctx, e.tryEndpoints(ctx, function, fn))
+		if !errors.Is(err, ErrTransient) || isLoginRejected(err) || retry+1 >= e.retry.MaxAttempts {
+			return err
+		}
+		delay := e.retry.backoff(retry)
+		klog.V(2).Infof("%s failed transiently, retrying in %s: %v", function, delay.Round(time.Millisecond), err)
+		if sleepErr := sleep(ctx, delay); sleepErr != nil {
+			return fmt.Errorf("%s abandoned: %w", function, errors.Join(sleepErr, err))
+		}
+	}
+}
+
+// tryEndpoints makes one pass over the endpoints in order of preference
+func (e *Edge) tryEndpoints(ctx context.Context, function string, fn func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error) (err error) {
+	candidates := e.candidates()
+	if len(candidates) == 0 {
+		return errors.New("no management API endpoints configured")
+	}
+
+	timeout := e.timeouts.forOperation(function)
+	for i, ep := range candidates {
+		err = e.attempt(ctx, timeout, ep, fn)
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s abandoned: %w", function, errors.Join(ctx.Err(), err))
+		}
+		if !isEndpointFailure(err) {
+			e.succeeded(ep)
+			return err
+		}
+		e.failed(ep, err)
+		if i < len(candidates)-1 {
+			klog.V(2).Infof("Management API endpoint %s failed, trying the next endpoint: %v", ep.url, err)
+		}
+	}
+	return fmt.Errorf("failed to reach any management API endpoint, last error: %w", err)
+}
+
+// attempt runs fn against one endpoint within timeout
+func (e *Edge) attempt(ctx context.Context, timeout time.Duration, ep *endpoint, fn func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return e.call(ctx, ep, fn)
+}
+
+// call runs fn against one endpoint, logging in first if needed
+func (e *Edge) call(ctx context.Context, ep *endpoint, fn func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error) error {
+	client, err := e.session(ctx, ep)
+	if err != nil {
+		return err
+	}
+
+	err = fn(ctx, client)
+	if IsUnauthorized(err) {
+		klog.V(2).Infof("Management API session on %s is no longer valid, logging in again", ep.url)
+		e.invalidate(ep, client)
+		if client, err = e.session(ctx, ep); err != nil {
+			return err
+		}
+		err = fn(ctx, client)
+	}
+	return err
+}
+
+// isEndpointFailure reports whether err means the endpoint could not serve the call, as opposed
+// to the controller answering it with an error
+func isEndpointFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var login *loginError
+	if errors.As(err, &login) {
+		return true
+	}
+	switch StatusCode(err) {
+	case 0, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isLoginRejected reports whether err is a failed login other than a network failure
+func isLoginRejected(err error) bool {
+	var login *loginError
+	if !errors.As(err, &login) {
+		return false
+	}
+	var verification *tls.CertificateVerificationError
+	if errors.As(err, &verification) {
+		return true
+	}
+	var netErr *net.OpError
+	return !errors.As(err, &netErr) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// candidates orders the endpoints for a call: the last one that succeeded, then the others whose
+// circuit is closed in configured order. If every circuit is open, all endpoints are returned,
+// soonest to close first, so that a call is never refused without trying.
+func (e *Edge) candidates() []*endpoint {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	now := time.Now()
+	var closed []*endpoint
+	if e.preferred != nil && !now.Before(e.preferred.openUntil) {
+		closed = append(closed, e.preferred)
+	}
+	for _, ep := range e.endpoints {
+		if ep != e.preferred && !now.Before(ep.openUntil) {
+			closed = append(closed, ep)
+		}
+	}
+	if len(closed) > 0 {
+		return closed
+	}
+
+	all := append([]*endpoint(nil), e.endpoints...)
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].openUntil.Before(all[j].openUntil)
+	})
+	return all
+}
+
+// succeeded closes the endpoint's circuit and makes it the preferred endpoint
+func (e *Edge) succeeded(ep *endpoint) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reset(ep)
+	if e.preferred != ep && !ep.removed {
+		e.preferred = ep
+		setActiveEndpoint(e.urls(), ep.url)
+	}
+}
+
+// reset closes the endpoint's circuit
+func (e *Edge) reset(ep *endpoint) {
+	if ep.failures > 0 {
+		klog.Infof("Management API endpoint %s recovered after %d failures", ep.url, ep.failures)
+	}
+	ep.failures = 0
+	ep.openUntil = time.Time{}
+	ep.lastSuccess = time.Now()
+	endpointAvailable.WithLabelValues(ep.url).Set(1)
+}
+
+// failed opens the endpoint's circuit for a backoff period that grows with consecutive failures
+func (e *Edge) failed(ep *endpoint, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ep.failures++
+	backoff := e.failover.MinBackoff << min(ep.failures-1, 16)
+	if backoff > e.failover.MaxBackoff || backoff <= 0 {
+		backoff = e.failover.MaxBackoff
+	}
+	ep.openUntil = time.Now().Add(backoff)
+	ep.lastError = err
+	ep.client = nil
+	e.lastError = err
+	if e.preferred == ep {
+		e.preferred = nil
+	}
+	endpointAvailable.WithLabelValues(ep.url).Set(0)
+	klog.V(2).Infof("Management API endpoint %s skipped for %s after %d consecutive failures", ep.url, backoff, ep.failures)
+}
+
+// session returns the endpoint's management client, logging in if there is none. The login
+// itself cannot be interrupted, but it is not started once ctx is done.
+func (e *Edge) session(ctx context.Context, ep *endpoint) (*rest_management_api_client.ZitiEdgeManagement, error) {
+	e.mu.RLock()
+	client := ep.client
+	e.mu.RUnlock()
+	if client != nil {
+		return client, nil
+	}
+
+	ep.loginMu.Lock()
+	defer ep.loginMu.Unlock()
+
+	// another caller may have logged in while we waited
+	e.mu.RLock()
+	client = ep.client
+	e.mu.RUnlock()
+	if client != nil {
+		return client, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	klog.V(2).Infof("Logging in to management API endpoint %s", ep.url)
+	cfg := e.cfg
+	cfg.ApiEndpoint = ep.url
+	client, err := Client(&cfg)
+	if err != nil {
+		return nil, &loginError{err: fmt.Errorf("failed to log in to %s: %w", ep.url, err)}
+	}
+	klog.V(1).Infof("Successfully created client for management API endpoint: %s", ep.url)
+	caps := probeCapabilities(ctx, ep.url, client)
+	setControllerVersion(ep.url, caps.Version)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ep.client = client
+	ep.caps = caps
+	ep.loginAt = time.Now()
+	ep.logins++
+	return client, nil
+}
+
+// invalidate drops the endpoint's session if it is still the one the caller observed failing, so
+// that a login completed by a concurrent caller is not thrown away
+func (e *Edge) invalidate(ep *endpoint, stale *rest_management_api_client.ZitiEdgeManagement) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ep.client == stale {
+		ep.client = nil
+	}
+}
+
+// Capabilities describes the controller of the preferred endpoint, or of any endpoint logged in to
+// if none is preferred yet. It is read at every login, so an upgraded controller is picked up once
+// the session is renewed.
+func (e *Edge) Capabilities() Capabilities {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.capabilities()
+}
+
+// capabilities is Capabilities for a caller holding e.mu
+func (e *Edge) capabilities() Capabilities {
+	if e.preferred != nil && e.preferred.caps.Known {
+		return e.preferred.caps
+	}
+	for _, ep := range e.endpoints {
+		if ep.caps.Known {
+			return ep.caps
+		}
+	}
+	return Capabilities{}
+}
+
+// Ping checks that an API session can be established on some endpoint and is accepted by the
+// controller
+func (e *Edge) Ping(ctx context.Context) error {
+	return e.do(ctx, "Ping", currentAPISession)
+}
+
+// currentAPISession asks the controller about the API session, which fails unless it is valid
+func currentAPISession(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error {
+	_, err := client.CurrentAPISession.GetCurrentAPISession(withContext(ctx, current_api_session.NewGetCurrentAPISessionParams()), nil)
+	return err
+}
+
+// Run probes endpoints with an open circuit every check interval until ctx is done, so that a
+// recovered controller is used again without waiting for a call to risk it. If discovery is on,
+// it also refreshes the controller cluster members.
+func (e *Edge) Run(ctx context.Context) {
+	if e.failover.DiscoveryInterval > 0 {
+		go e.runDiscovery(ctx)
+	}
+
+	ticker := time.NewTicker(e.failover.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		e.mu.RLock()
+		var open []*endpoint
+		for _, ep := range e.endpoints {
+			if ep.failures > 0 {
+				open = append(open, ep)
+			}
+		}
+		e.mu.RUnlock()
+
+		var wg sync.WaitGroup
+		for _, ep := range open {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				e.probe(ctx, ep)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// probe checks one endpoint and closes its circuit if it answers, without making it preferred
+func (e *Edge) probe(ctx context.Context, ep *endpoint) {
+	err := e.attempt(ctx, e.timeouts.forOperation("Ping"), ep, currentAPISession)
+	if ctx.Err() != nil {
+		return
+	}
+	if isEndpointFailure(err) {
+		e.failed(ep, err)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reset(ep)
+}
+
+// urls lists the endpoint URLs; the caller holds e.mu
+func (e *Edge) urls() []string {
+	urls := make([]string, 0, len(e.endpoints))
+	for _, ep := range e.endpoints {
+		urls = append(urls, ep.url)
+	}
+	return urls
+}
+
+// Status reports the preferred endpoint, the age of its API session and the state of every
+// endpoint
+func (e *Edge) Status() EdgeStatus {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	status := EdgeStatus{
+		Endpoints: e.urls(),
+	}
+	now := time.Now()
+	for _, ep := range e.endpoints {
+		status.Logins += ep.logins
+		state := EndpointStatus{
+			URL:         ep.url,
+			Discovered:  ep.discovered,
+			Connected:   ep.client != nil,
+			Version:     ep.caps.Version,
+			Available:   !now.Before(ep.openUntil),
+			Failures:    ep.failures,
+			LastSuccess: ep.lastSuccess,
+		}
+		if state.Failures > 0 {
+			state.CircuitOpenUntil = ep.openUntil
+		}
+		if ep.lastError != nil {
+			state.LastError = ep.lastError.Error()
+		}
+		status.EndpointStates = append(status.EndpointStates, state)
+	}
+	if ep := e.preferred; ep != nil {
+		status.Endpoint = ep.url
+		status.Connected = ep.client != nil
+		if !ep.loginAt.IsZero() {
+			status.LoginAt = ep.loginAt
+			status.SessionAge = time.Since(ep.loginAt).Round(time.Second).String()
+		}
+	}
+	if e.lastError != nil {
+		status.LastError = e.lastError.Error()
+	}
+	status.LastDiscovery = e.lastDiscovery
+	status.Capabilities = e.capabilities()
+	return status
+}
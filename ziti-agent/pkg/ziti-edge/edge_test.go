@@ -0,0 +1,344 @@
+package zitiedge
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	httptransport "github.com/go-openapi/runtime/client"
+	"github.com/go-openapi/strfmt"
+	"github.com/openziti/edge-api/rest_management_api_client"
+)
+
+// fakeController answers the current API session request with its status
+type fakeController struct {
+	*httptest.Server
+	status atomic.Int32
+	calls  atomic.Int32
+}
+
+func newFakeController(t *testing.T, status int) *fakeController {
+	t.Helper()
+	c := &fakeController{}
+	c.status.Store(int32(status))
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		status := int(c.status.Load())
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			_, _ = w.Write([]byte(`{"data":{},"meta":{}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"error":{"code":"UNAVAILABLE","message":"controller unavailable"},"meta":{}}`))
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *fakeController) endpoint() string {
+	return c.URL + rest_management_api_client.DefaultBasePath
+}
+
+// newTestEdge returns an Edge over the controllers with an API session on each, so that no login
+// is needed; an endpoint that fails has to be connected again, since logging in fails without
+// credentials
+func newTestEdge(t *testing.T, failover FailoverConfig, controllers ...*fakeController) *Edge {
+	t.Helper()
+	var endpoints []string
+	for _, c := range controllers {
+		endpoints = append(endpoints, c.endpoint())
+	}
+	e := NewEdge(Config{}, endpoints, Options{Failover: failover, Retry: RetryPolicy{MaxAttempts: 1}})
+	for _, c := range controllers {
+		connect(t, e, c)
+	}
+	return e
+}
+
+// connect gives the controller's endpoint an API session
+func connect(t *testing.T, e *Edge, c *fakeController) {
+	t.Helper()
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := lookup(t, e, c)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ep.client = rest_management_api_client.New(
+		httptransport.New(u.Host, rest_management_api_client.DefaultBasePath, []string{"http"}),
+		strfmt.Default,
+	)
+}
+
+func lookup(t *testing.T, e *Edge, c *fakeController) *endpoint {
+	t.Helper()
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, ep := range e.endpoints {
+		if ep.url == c.endpoint() {
+			return ep
+		}
+	}
+	t.Fatalf("no endpoint %s", c.endpoint())
+	return nil
+}
+
+// expire lets the endpoint's circuit close, as if its backoff had passed
+func expire(t *testing.T, e *Edge, c *fakeController) {
+	t.Helper()
+	ep := lookup(t, e, c)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ep.openUntil = time.Now().Add(-time.Millisecond)
+}
+
+func preferredURL(e *Edge) string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.preferred == nil {
+		return ""
+	}
+	return e.preferred.url
+}
+
+func candidateURLs(e *Edge) []string {
+	var urls []string
+	for _, ep := range e.candidates() {
+		urls = append(urls, ep.url)
+	}
+	return urls
+}
+
+func TestEdgeFailover(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		// down closes the first controller, so that it does not answer at all
+		down         bool
+		wantFailover bool
+		wantKind     error
+	}{
+		{name: "unreachable", down: true, wantFailover: true},
+		{name: "unavailable", status: http.StatusServiceUnavailable, wantFailover: true},
+		{name: "bad gateway", status: http.StatusBadGateway, wantFailover: true},
+		{name: "gateway timeout", status: http.StatusGatewayTimeout, wantFailover: true},
+		// an answer from the controller ends the call, even an error
+		{name: "internal error", status: http.StatusInternalServerError, wantKind: ErrTransient},
+		{name: "not found", status: http.StatusNotFound, wantKind: ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := newFakeController(t, tt.status)
+			second := newFakeController(t, http.StatusOK)
+			e := newTestEdge(t, FailoverConfig{MinBackoff: time.Minute}, first, second)
+			if tt.down {
+				first.Close()
+			}
+
+			err := e.Ping(context.Background())
+			if !tt.wantFailover {
+				if !errors.Is(err, tt.wantKind) {
+					t.Fatalf("got error %v, want %v", err, tt.wantKind)
+				}
+				if second.calls.Load() != 0 || lookup(t, e, first).failures != 0 {
+					t.Errorf("failed over after the controller answered")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("call did not fail over: %v", err)
+			}
+			if got := preferredURL(e); got != second.endpoint() {
+				t.Errorf("preferred endpoint %q, want %q", got, second.endpoint())
+			}
+			if ep := lookup(t, e, first); ep.failures != 1 || !time.Now().Before(ep.openUntil) {
+				t.Errorf("failing endpoint has %d failures and is open until %s, want an open circuit", ep.failures, ep.openUntil)
+			}
+
+			// the next call goes straight to the endpoint that succeeded
+			calls := first.calls.Load()
+			if err := e.Ping(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if first.calls.Load() != calls || second.calls.Load() != 2 {
+				t.Errorf("calls %d and %d, want the second call on the preferred endpoint only", first.calls.Load()-calls, second.calls.Load()-1)
+			}
+		})
+	}
+}
+
+func TestEdgeAllEndpointsFail(t *testing.T) {
+	first := newFakeController(t, http.StatusServiceUnavailable)
+	second := newFakeController(t, http.StatusServiceUnavailable)
+	e := newTestEdge(t, FailoverConfig{MinBackoff: time.Minute}, first, second)
+
+	err := e.Ping(context.Background())
+	if !errors.Is(err, ErrTransient) || StatusCode(err) != http.StatusServiceUnavailable {
+		t.Fatalf("got error %v, want the last endpoint's 503", err)
+	}
+	if got := preferredURL(e); got != "" {
+		t.Errorf("preferred endpoint %q after every endpoint failed", got)
+	}
+	// with every circuit open, the endpoint that closes soonest is tried first
+	if got := candidateURLs(e); len(got) != 2 || got[0] != first.endpoint() {
+		t.Errorf("candidates %v, want both with %s first", got, first.endpoint())
+	}
+}
+
+func TestEdgeCircuitBreaker(t *testing.T) {
+	first := newFakeController(t, http.StatusServiceUnavailable)
+	second := newFakeController(t, http.StatusOK)
+	e := newTestEdge(t, FailoverConfig{MinBackoff: time.Minute, MaxBackoff: time.Hour}, first, second)
+
+	if err := e.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		name string
+		// do changes the state of the endpoints before it is checked
+		do             func(t *testing.T)
+		wantCandidates []string
+		wantFailures   int
+		wantPreferred  string
+	}{
+		{
+			name:           "open",
+			do:             func(t *testing.T) {},
+			wantCandidates: []string{second.endpoint()},
+			wantFailures:   1,
+			wantPreferred:  second.endpoint(),
+		},
+		{
+			// the backoff passed, so the endpoint may be tried again after the preferred one
+			name:           "half-open",
+			do:             func(t *testing.T) { expire(t, e, first) },
+			wantCandidates: []string{second.endpoint(), first.endpoint()},
+			wantFailures:   1,
+			wantPreferred:  second.endpoint(),
+		},
+		{
+			// a probe that fails opens the circuit again for twice as long
+			name: "half-open probe fails",
+			do: func(t *testing.T) {
+				connect(t, e, first)
+				e.probe(context.Background(), lookup(t, e, first))
+				if open := time.Until(lookup(t, e, first).openUntil); open < time.Minute+30*time.Second {
+					t.Errorf("circuit open for %s after the second failure, want 2m", open)
+				}
+			},
+			wantCandidates: []string{second.endpoint()},
+			wantFailures:   2,
+			wantPreferred:  second.endpoint(),
+		},
+		{
+			// a probe that succeeds closes the circuit without taking over from the preferred
+			// endpoint
+			name: "closed by probe",
+			do: func(t *testing.T) {
+				first.status.Store(http.StatusOK)
+				expire(t, e, first)
+				connect(t, e, first)
+				e.probe(context.Background(), lookup(t, e, first))
+				calls := first.calls.Load()
+				if err := e.Ping(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				if first.calls.Load() != calls {
+					t.Error("call left the preferred endpoint for a recovered one")
+				}
+			},
+			wantCandidates: []string{second.endpoint(), first.endpoint()},
+			wantPreferred:  second.endpoint(),
+		},
+		{
+			// the preferred endpoint fails, and the recovered one takes over
+			name:           "preferred fails",
+			do:             func(t *testing.T) { second.status.Store(http.StatusServiceUnavailable); pingOK(t, e) },
+			wantCandidates: []string{first.endpoint()},
+			wantPreferred:  first.endpoint(),
+		},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			step.do(t)
+			if got := candidateURLs(e); !slices.Equal(got, step.wantCandidates) {
+				t.Errorf("candidates %v, want %v", got, step.wantCandidates)
+			}
+			if got := lookup(t, e, first).failures; got != step.wantFailures {
+				t.Errorf("first endpoint has %d failures, want %d", got, step.wantFailures)
+			}
+			if got := preferredURL(e); got != step.wantPreferred {
+				t.Errorf("preferred endpoint %q, want %q", got, step.wantPreferred)
+			}
+		})
+	}
+}
+
+func pingOK(t *testing.T, e *Edge) {
+	t.Helper()
+	if err := e.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEdgeLoginFailure(t *testing.T) {
+	down := newFakeController(t, http.StatusOK)
+	down.Close()
+
+	tests := []struct {
+		name string
+		cfg  Config
+		// wantPasses is how often the endpoint is tried, as counted by its failures
+		wantPasses int
+	}{
+		// without credentials the login fails before the controller is contacted
+		{name: "rejected", wantPasses: 1},
+		{name: "unreachable", cfg: Config{AuthMethod: AuthMethodUpdb, Username: "admin", Password: "secret"}, wantPasses: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewEdge(tt.cfg, []string{down.endpoint()}, Options{
+				Retry: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+			})
+			if err := e.Ping(context.Background()); err == nil {
+				t.Fatal("login succeeded")
+			}
+			if got := e.endpoints[0].failures; got != tt.wantPasses {
+				t.Errorf("endpoint tried %d times, want %d", got, tt.wantPasses)
+			}
+		})
+	}
+}
+
+func TestEdgeBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{64, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		e := NewEdge(Config{}, []string{"https://ctrl:1280"}, Options{Failover: FailoverConfig{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}})
+		ep := e.endpoints[0]
+		ep.failures = tt.failures - 1
+
+		before := time.Now()
+		e.failed(ep, errors.New("connection refused"))
+		if got := ep.openUntil.Sub(before); got < tt.want || got > tt.want+time.Second {
+			t.Errorf("failure %d: circuit open for %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
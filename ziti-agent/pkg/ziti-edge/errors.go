@@ -0,0 +1,148 @@
+package zitiedge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-openapi/runtime"
+	rest_model_edge "github.com/openziti/edge-api/rest_model"
+)
+
+// Kinds of management API failure; test for them with errors.Is
+var (
+	// ErrNotFound means the object does not exist (404)
+	ErrNotFound = errors.New("not found")
+	// ErrConflict means an object with the same unique name already exists
+	ErrConflict = errors.New("conflict")
+	// ErrUnauthorized means the controller rejected the admin identity (401, 403)
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrTransient means the call may succeed if repeated: no response, 429 or 5xx
+	ErrTransient = errors.New("transient")
+)
+
+// generated go-swagger responses render their status as "[METHOD /path][code] ..."
+var statusPattern = regexp.MustCompile(`\]\[(\d{3})\]`)
+
+// Error is a failed management API call, classified by kind
+type Error struct {
+	// Kind is one of ErrNotFound, ErrConflict, ErrUnauthorized and ErrTransient, or nil if the
+	// failure fits none of them, such as a rejected document
+	Kind error
+	// Code is the HTTP status, or 0 if no response was received
+	Code int
+	// API is the error document the controller answered with, if any
+	API *rest_model_edge.APIError
+	Err error
+}
+
+func (e *Error) Error() string {
+	// the generated responses print their payload as a pointer, so the controller's own
+	// explanation is appended here
+	if e.API == nil || (e.API.Code == "" && e.API.Message == "") {
+		return e.Err.Error()
+	}
+	msg := fmt.Sprintf("%v: %s: %s", e.Err, e.API.Code, e.API.Message)
+	if cause := causeText(e.API); cause != "" {
+		msg += ": " + cause
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// classify wraps err in an Error unless it is nil, already classified, or the caller gave up
+// on the call by ending ctx
+func classify(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	e := &Error{Code: StatusCode(err), API: apiError(err), Err: err}
+	switch {
+	case e.Code == http.StatusNotFound:
+		e.Kind = ErrNotFound
+	case e.Code == http.StatusConflict, e.Code == http.StatusBadRequest && isDuplicate(e.API):
+		e.Kind = ErrConflict
+	case e.Code == http.StatusUnauthorized, e.Code == http.StatusForbidden:
+		e.Kind = ErrUnauthorized
+	case e.Code == 0, e.Code == http.StatusTooManyRequests, e.Code >= 500:
+		e.Kind = ErrTransient
+	}
+	return e
+}
+
+// apiError returns the error document of a generated error response
+func apiError(err error) *rest_model_edge.APIError {
+	var response interface {
+		GetPayload() *rest_model_edge.APIErrorEnvelope
+	}
+	if errors.As(err, &response) && response.GetPayload() != nil {
+		return response.GetPayload().Error
+	}
+	return nil
+}
+
+// isDuplicate recognizes the controller's validation error for a value that must be unique
+func isDuplicate(api *rest_model_edge.APIError) bool {
+	if api == nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(api.Message+" "+api.CauseMessage+" "+causeText(api)), "duplicate")
+}
+
+func causeText(api *rest_model_edge.APIError) string {
+	if api.Cause == nil {
+		return ""
+	}
+	var parts []string
+	for _, part := range []string{api.Cause.Field, api.Cause.Reason, api.Cause.Message} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// StatusCode extracts the HTTP status of a failed management API call, or 0 if the call did not
+// get a response
+func StatusCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified.Code
+	}
+
+	var apiErr *runtime.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+
+	if m := statusPattern.FindStringSubmatch(err.Error()); m != nil {
+		if code, convErr := strconv.Atoi(m[1]); convErr == nil {
+			return code
+		}
+	}
+	return 0
+}
+
+// IsUnauthorized reports whether the controller rejected the API session
+func IsUnauthorized(err error) bool {
+	return StatusCode(err) == http.StatusUnauthorized
+}
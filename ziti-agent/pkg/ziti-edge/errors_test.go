@@ -0,0 +1,97 @@
+package zitiedge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openziti/edge-api/rest_management_api_client/identity"
+	rest_model_edge "github.com/openziti/edge-api/rest_model"
+)
+
+func TestClassify(t *testing.T) {
+	duplicate := identity.NewCreateIdentityBadRequest()
+	duplicate.Payload = &rest_model_edge.APIErrorEnvelope{Error: &rest_model_edge.APIError{
+		Code:    "COULD_NOT_VALIDATE",
+		Message: "The supplied request contains an invalid document",
+		Cause: &rest_model_edge.APIErrorCause{APIFieldError: rest_model_edge.APIFieldError{
+			Field:  "name",
+			Reason: "duplicate value 'zt-pod-1234' in unique index on identities store",
+		}},
+	}}
+	invalid := identity.NewCreateIdentityBadRequest()
+	invalid.Payload = &rest_model_edge.APIErrorEnvelope{Error: &rest_model_edge.APIError{
+		Code:    "COULD_NOT_VALIDATE",
+		Message: "The supplied request contains an invalid document",
+	}}
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+		code int
+	}{
+		{"not found", identity.NewDeleteIdentityNotFound(), ErrNotFound, 404},
+		{"conflict", identity.NewDeleteIdentityConflict(), ErrConflict, 409},
+		{"duplicate name", duplicate, ErrConflict, 400},
+		{"invalid document", invalid, nil, 400},
+		{"unauthorized", identity.NewCreateIdentityUnauthorized(), ErrUnauthorized, 401},
+		{"rate limited", identity.NewCreateIdentityTooManyRequests(), ErrTransient, 429},
+		{"unavailable", identity.NewCreateIdentityServiceUnavailable(), ErrTransient, 503},
+		{"no response", &url.Error{Op: "Post", URL: "https://ctrl:1280", Err: errors.New("connection refused")}, ErrTransient, 0},
+		{"wrapped", fmt.Errorf("failed to reach any management API endpoint, last error: %w", identity.NewCreateIdentityServiceUnavailable()), ErrTransient, 503},
+	}
+	for _, tt := range tests {
+		err := classify(context.Background(), tt.err)
+		var classified *Error
+		if !errors.As(err, &classified) {
+			t.Fatalf("%s: %v was not classified", tt.name, err)
+		}
+		if classified.Kind != tt.want {
+			t.Errorf("%s: kind %v, want %v", tt.name, classified.Kind, tt.want)
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: errors.Is(%v) = false", tt.name, tt.want)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: original error not wrapped", tt.name)
+		}
+		if got := StatusCode(err); got != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, got, tt.code)
+		}
+	}
+
+	if msg := classify(context.Background(), duplicate).Error(); !strings.Contains(msg, "duplicate value") {
+		t.Errorf("error message %q lacks the controller's explanation", msg)
+	}
+}
+
+func TestClassifyAbandoned(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := classify(ctx, &url.Error{Op: "Post", URL: "https://ctrl:1280", Err: context.Canceled})
+	if errors.Is(err, ErrTransient) {
+		t.Errorf("a call the caller gave up on is not transient: %v", err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}.withDefaults()
+	if policy.MaxAttempts != defaultRetryAttempts {
+		t.Errorf("max attempts %d, want the default %d", policy.MaxAttempts, defaultRetryAttempts)
+	}
+
+	for retry, ceiling := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		ceiling *= time.Millisecond
+		for range 100 {
+			if got := policy.backoff(retry); got < ceiling/2 || got > ceiling {
+				t.Fatalf("retry %d: backoff %s outside [%s, %s]", retry, got, ceiling/2, ceiling)
+			}
+		}
+	}
+}
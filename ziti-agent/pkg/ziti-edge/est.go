@@ -0,0 +1,178 @@
+package zitiedge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/openziti/edge-api/rest_util"
+	"k8s.io/klog/v2"
+)
+
+// Fingerprint returns the SHA-256 fingerprint of cert as lower case hex
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint accepts the colon separated, upper case form printed by openssl
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+}
+
+// ErrUnpinnedCAs is returned by LoadControllerCAs when no fingerprint is pinned and trusting the
+// first bundle fetched was not allowed
+var ErrUnpinnedCAs = errors.New("no controller CA fingerprint pinned")
+
+// LoadControllerCAs returns the PEM bundle of CAs the controller publishes on its EST endpoint,
+// the way the Ziti CLI bootstraps trust. The bundle is fetched without verifying the controller,
+// so only the CA with the SHA-256 fingerprint and the certificates it signed are kept. Without a
+// fingerprint, whatever bundle is fetched first is trusted, which is refused unless allowUnpinned
+// is set. The bundle is fetched from the controller that is later verified with tls, so that the
+// preset and VerifyURL apply. When cacheFile is set, a cached bundle matching the pin is used
+// instead of fetching, and a fetched one is written there.
+func LoadControllerCAs(endpoints []string, tls TLSVerification, fingerprint, cacheFile string, allowUnpinned bool) ([]byte, error) {
+	fingerprint = normalizeFingerprint(fingerprint)
+	if fingerprint == "" && !allowUnpinned {
+		return nil, ErrUnpinnedCAs
+	}
+
+	if cacheFile != "" {
+		bundle, err := readCachedCAs(cacheFile, fingerprint)
+		if err == nil {
+			klog.V(4).Infof("Using controller CA bundle cached in %s", cacheFile)
+			return bundle, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			klog.Warningf("Ignoring cached controller CA bundle: %v", err)
+		}
+	}
+
+	var errs []error
+	for _, endpoint := range endpoints {
+		controllerURL, err := controllerBaseURL(endpoint, tls)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		certs, err := rest_util.GetControllerWellKnownCas(controllerURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", controllerURL, err))
+			continue
+		}
+		if fingerprint == "" {
+			klog.Warningf("Trusting the CA bundle of %s on first use without a pinned fingerprint; set one to guard against interception", controllerURL)
+		} else if certs, err = pinnedCAs(certs, fingerprint); err != nil {
+			return nil, fmt.Errorf("%s: %w", controllerURL, err)
+		}
+
+		bundle := encodeCAs(certs)
+		klog.V(2).Infof("Fetched %d CA certificates from %s", len(certs), controllerURL)
+		if cacheFile != "" {
+			if err := os.WriteFile(cacheFile, bundle, 0o600); err != nil {
+				klog.Warningf("Failed to cache controller CA bundle: %v", err)
+			}
+		}
+		return bundle, nil
+	}
+	return nil, fmt.Errorf("failed to fetch controller CA bundle: %w", errors.Join(errs...))
+}
+
+// pinnedCAs keeps the CA with the pinned fingerprint and the certificates that chain to it
+func pinnedCAs(certs []*x509.Certificate, fingerprint string) ([]*x509.Certificate, error) {
+	var pinned *x509.Certificate
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs {
+		if Fingerprint(cert) == fingerprint {
+			pinned = cert
+		}
+		intermediates.AddCert(cert)
+	}
+	if pinned == nil {
+		return nil, fmt.Errorf("no CA with fingerprint %s in the controller CA bundle", fingerprint)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pinned)
+	kept := []*x509.Certificate{pinned}
+	for _, cert := range certs {
+		if cert == pinned {
+			continue
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+		if _, err := cert.Verify(opts); err != nil {
+			klog.Warningf("Dropping CA %v from the controller CA bundle, it does not chain to the pinned CA: %v", cert.Subject, err)
+			continue
+		}
+		kept = append(kept, cert)
+	}
+	return kept, nil
+}
+
+// readCachedCAs returns the cached bundle if it holds the pinned CA, keeping only the certificates
+// that chain to it as a fetched bundle does
+func readCachedCAs(cacheFile, fingerprint string) ([]byte, error) {
+	bundle, err := os.ReadFile(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := decodeCAs(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cacheFile, err)
+	}
+	if fingerprint == "" {
+		return bundle, nil
+	}
+	kept, err := pinnedCAs(certs, fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cacheFile, err)
+	}
+	return encodeCAs(kept), nil
+}
+
+func encodeCAs(certs []*x509.Certificate) []byte {
+	var bundle bytes.Buffer
+	for _, cert := range certs {
+		_ = pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}) // writing to a buffer cannot fail
+	}
+	return bundle.Bytes()
+}
+
+func decodeCAs(bundle []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates in CA bundle")
+	}
+	return certs, nil
+}
+
+// controllerBaseURL returns the URL of the controller that serves the client API for a management
+// API endpoint, the same one the controller is verified with before logging in
+func controllerBaseURL(endpoint string, tls TLSVerification) (string, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse management API URL: %w", err)
+	}
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return "", fmt.Errorf("management API URL %q has no scheme or host", endpoint)
+	}
+	base, err := tls.apiBaseURL(endpoint)
+	if err != nil {
+		return "", err
+	}
+	return tls.verifyURL(base), nil
+}
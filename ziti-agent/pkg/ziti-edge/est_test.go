@@ -0,0 +1,159 @@
+package zitiedge
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA creates a CA certificate, self-signed when parent is nil
+func testCA(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestPinnedCAs(t *testing.T) {
+	root, rootKey := testCA(t, "root", nil, nil)
+	intermediate, _ := testCA(t, "intermediate", root, rootKey)
+	rogue, _ := testCA(t, "rogue", nil, nil)
+
+	pin := normalizeFingerprint(strings.ToUpper(Fingerprint(root)))
+	kept, err := pinnedCAs([]*x509.Certificate{intermediate, rogue, root}, pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 2 || kept[0] != root || kept[1] != intermediate {
+		t.Errorf("kept %d certificates, want the pinned root and its intermediate", len(kept))
+	}
+
+	if _, err := pinnedCAs([]*x509.Certificate{rogue}, pin); err == nil {
+		t.Error("bundle without the pinned CA accepted")
+	}
+}
+
+func TestCachedCAs(t *testing.T) {
+	root, _ := testCA(t, "root", nil, nil)
+	other, _ := testCA(t, "other", nil, nil)
+	cacheFile := filepath.Join(t.TempDir(), "cacerts.pem")
+	if err := os.WriteFile(cacheFile, encodeCAs([]*x509.Certificate{root}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pin := range []string{"", Fingerprint(root)} {
+		if _, err := readCachedCAs(cacheFile, pin); err != nil {
+			t.Errorf("pin %q: %v", pin, err)
+		}
+	}
+	if _, err := readCachedCAs(cacheFile, Fingerprint(other)); err == nil {
+		t.Error("cached bundle used although the pin changed")
+	}
+
+	// a CA added to the cache that does not chain to the pin is dropped
+	if err := os.WriteFile(cacheFile, encodeCAs([]*x509.Certificate{other, root}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := readCachedCAs(cacheFile, Fingerprint(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := decodeCAs(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(root) {
+		t.Errorf("cached bundle kept %d certificates, want only the pinned CA", len(certs))
+	}
+}
+
+func TestUnpinnedCAs(t *testing.T) {
+	root, _ := testCA(t, "root", nil, nil)
+	cacheFile := filepath.Join(t.TempDir(), "cacerts.pem")
+	if err := os.WriteFile(cacheFile, encodeCAs([]*x509.Certificate{root}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	endpoints := []string{"https://ctrl.example.com:1280/edge/management/v1"}
+
+	// trust on first use is refused before anything is fetched or read from the cache
+	if _, err := LoadControllerCAs(endpoints, TLSVerification{}, "", cacheFile, false); !errors.Is(err, ErrUnpinnedCAs) {
+		t.Errorf("got error %v, want %v", err, ErrUnpinnedCAs)
+	}
+	if _, err := LoadControllerCAs(endpoints, TLSVerification{}, "", cacheFile, true); err != nil {
+		t.Errorf("unpinned bundle refused although allowed: %v", err)
+	}
+	if _, err := LoadControllerCAs(endpoints, TLSVerification{}, Fingerprint(root), cacheFile, false); err != nil {
+		t.Errorf("pinned bundle refused: %v", err)
+	}
+}
+
+func TestControllerBaseURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		tls      TLSVerification
+		endpoint string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "plain",
+			endpoint: "https://ctrl.example.com:1280/edge/management/v1",
+			want:     "https://ctrl.example.com:1280",
+		},
+		{
+			name:     "netfoundry preset",
+			tls:      TLSVerification{Preset: TLSPresetNetFoundry},
+			endpoint: "https://abc-p.production.netfoundry.io:443/edge/management/v1",
+			want:     "https://abc.production.netfoundry.io:443",
+		},
+		{
+			name:     "verify url override",
+			tls:      TLSVerification{VerifyURL: "https://ctrl-client.example.com:1280/"},
+			endpoint: "https://lb.example.com/edge/management/v1",
+			want:     "https://ctrl-client.example.com:1280",
+		},
+		{name: "no host", endpoint: "/edge/management/v1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := controllerBaseURL(tt.endpoint, tt.tls)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("EST base URL %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
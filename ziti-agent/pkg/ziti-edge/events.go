@@ -0,0 +1,405 @@
+package zitiedge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/openziti/channel/v2"
+	"github.com/openziti/channel/v2/websockets"
+	"github.com/openziti/edge-api/rest_management_api_client"
+	"github.com/openziti/edge-api/rest_management_api_client/current_api_session"
+	"github.com/openziti/identity"
+	"k8s.io/klog/v2"
+)
+
+// Namespaces of the events published by an EventStream, whichever names the controller uses
+const (
+	EventNamespaceSession    = "session"
+	EventNamespaceAPISession = "apiSession"
+	EventNamespaceRouter     = "router"
+	// EventNamespaceStream carries the state of the stream itself
+	EventNamespaceStream = "stream"
+)
+
+// Types of the events published by an EventStream
+const (
+	EventTypeCreated       = "created"
+	EventTypeDeleted       = "deleted"
+	EventTypeRouterOnline  = "router-online"
+	EventTypeRouterOffline = "router-offline"
+	// EventTypeResumed is published after the stream was lost and opened again; events that
+	// happened in between are not replayed, so subscribers should reconcile the state they track
+	EventTypeResumed = "resumed"
+)
+
+// Content types of the fabric management channel that stream events, as defined by the mgmt_pb
+// protocol of the controller
+const (
+	streamEventsRequestType = 10040
+	streamEventsEventType   = 10041
+)
+
+const (
+	eventStreamPath        = "/fabric/v1/ws-api"
+	eventStreamDialTimeout = 10 * time.Second
+	// eventStreamStableAfter is how long a stream must stay open for the reconnect backoff to
+	// start over
+	eventStreamStableAfter = time.Minute
+)
+
+// legacyEventNamespaces maps the event types of controllers before v1.0 to the current ones
+var legacyEventNamespaces = map[string]string{
+	"edge.sessions":    EventNamespaceSession,
+	"edge.apiSessions": EventNamespaceAPISession,
+	"fabric.routers":   EventNamespaceRouter,
+}
+
+// Event is a controller event about an identity or an edge router
+type Event struct {
+	Namespace string    `json:"namespace"`
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	// ID is the session or API session the event is about
+	ID         string `json:"id,omitempty"`
+	IdentityID string `json:"identityId,omitempty"`
+	ServiceID  string `json:"serviceId,omitempty"`
+	RouterID   string `json:"routerId,omitempty"`
+	// Since is when the stream was lost, for EventTypeResumed
+	Since time.Time `json:"since,omitempty"`
+	// Raw is the event as sent by the controller
+	Raw json.RawMessage `json:"-"`
+}
+
+// parseEvent reads the JSON form of a session, API session or router event
+func parseEvent(data []byte) (Event, error) {
+	var wire struct {
+		Namespace  string    `json:"namespace"`
+		EventType  string    `json:"event_type"`
+		Timestamp  time.Time `json:"timestamp"`
+		ID         string    `json:"id"`
+		IdentityID string    `json:"identity_id"`
+		ServiceID  string    `json:"service_id"`
+		RouterID   string    `json:"router_id"`
+	}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return Event{}, fmt.Errorf("failed to parse controller event: %w", err)
+	}
+	namespace := wire.Namespace
+	if current, ok := legacyEventNamespaces[namespace]; ok {
+		namespace = current
+	}
+	return Event{
+		Namespace:  namespace,
+		Type:       wire.EventType,
+		Timestamp:  wire.Timestamp,
+		ID:         wire.ID,
+		IdentityID: wire.IdentityID,
+		ServiceID:  wire.ServiceID,
+		RouterID:   wire.RouterID,
+		Raw:        data,
+	}, nil
+}
+
+// eventSubscriptions lists the event types to stream under the names the controller accepts
+func eventSubscriptions(caps Capabilities) []string {
+	if caps.EventTypes {
+		return []string{EventNamespaceSession, EventNamespaceAPISession, EventNamespaceRouter}
+	}
+	return []string{"edge.sessions", "edge.apiSessions", "fabric.routers"}
+}
+
+// EventStream follows the session, API session and router events of the controller over the
+// management event stream of an Edge, and hands them to in-process subscribers. The stream is
+// opened again with backoff whenever it is lost, on whichever endpoint the Edge prefers by then.
+type EventStream struct {
+	edge *Edge
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	connected   bool
+	endpoint    string
+}
+
+type subscriber struct {
+	events     chan Event
+	namespaces []string
+}
+
+// wants reports whether the subscriber asked for events of namespace; stream events go to all
+func (s *subscriber) wants(namespace string) bool {
+	if len(s.namespaces) == 0 || namespace == EventNamespaceStream {
+		return true
+	}
+	for _, ns := range s.namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// NewEventStream returns a stream of the controller events seen by edge. Nothing is opened until
+// Run is called.
+func NewEventStream(edge *Edge) *EventStream {
+	return &EventStream{
+		edge:        edge,
+		subscribers: map[*subscriber]struct{}{},
+	}
+}
+
+// Subscribe returns a channel receiving the events of the given namespaces, or of all namespaces
+// if none is given, and a function that ends the subscription and closes the channel. Events are
+// dropped rather than delivered late when the channel buffer is full.
+func (s *EventStream) Subscribe(buffer int, namespaces ...string) (<-chan Event, func()) {
+	sub := &subscriber{events: make(chan Event, buffer), namespaces: namespaces}
+	s.mu.Lock()
+	s.subscribers[sub] = struct{}{}
+	s.mu.Unlock()
+
+	var once sync.Once
+	return sub.events, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.subscribers, sub)
+			close(sub.events)
+		})
+	}
+}
+
+// publish hands an event to the subscribers that want it
+func (s *EventStream) publish(event Event) {
+	controllerEvents.WithLabelValues(event.Namespace, event.Type).Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sub := range s.subscribers {
+		if !sub.wants(event.Namespace) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			droppedEvents.Inc()
+			klog.V(2).Infof("Dropped %s %s event for a slow subscriber", event.Namespace, event.Type)
+		}
+	}
+}
+
+// Connected reports whether the stream is open and the management API endpoint it is open on
+func (s *EventStream) Connected() (bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected, s.endpoint
+}
+
+func (s *EventStream) setConnected(connected bool, endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = connected
+	s.endpoint = endpoint
+	if connected {
+		eventStreamConnected.Set(1)
+	} else {
+		eventStreamConnected.Set(0)
+	}
+}
+
+// Run keeps the stream open until ctx is done. After a stream is lost, subscribers receive an
+// EventTypeResumed event once it is open again.
+func (s *EventStream) Run(ctx context.Context) {
+	var (
+		failures int
+		lostAt   time.Time
+	)
+	for ctx.Err() == nil {
+		ch, closed, endpoint, err := s.open(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			delay := s.backoff(failures)
+			klog.Warningf("Failed to open the controller event stream, retrying in %s: %v", delay, err)
+			if sleep(ctx, delay) != nil {
+				return
+			}
+			continue
+		}
+
+		openedAt := time.Now()
+		s.setConnected(true, endpoint)
+		klog.Infof("Streaming controller events from %s", endpoint)
+		if !lostAt.IsZero() {
+			s.publish(Event{Namespace: EventNamespaceStream, Type: EventTypeResumed, Timestamp: openedAt, Since: lostAt})
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-closed:
+		}
+		_ = ch.Close()
+		s.setConnected(false, "")
+		if ctx.Err() != nil {
+			return
+		}
+
+		lostAt = time.Now()
+		if lostAt.Sub(openedAt) >= eventStreamStableAfter {
+			failures = 0
+		}
+		failures++
+		delay := s.backoff(failures)
+		klog.Warningf("Controller event stream from %s was closed, reopening in %s", endpoint, delay)
+		if sleep(ctx, delay) != nil {
+			return
+		}
+	}
+}
+
+// backoff is the pause after consecutive failures, bounded like the endpoint circuit breaker
+func (s *EventStream) backoff(failures int) time.Duration {
+	failover := s.edge.failover
+	delay := failover.MinBackoff << min(failures-1, 16)
+	if delay > failover.MaxBackoff || delay <= 0 {
+		delay = failover.MaxBackoff
+	}
+	return delay
+}
+
+// open dials the event stream on the endpoint of a valid API session and subscribes to events.
+// The returned channel is closed when the stream is.
+func (s *EventStream) open(ctx context.Context) (channel.Channel, <-chan struct{}, string, error) {
+	endpoint, token, err := s.edge.apiSession(ctx)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	caps := s.edge.Capabilities()
+
+	cfg := s.edge.cfg
+	baseURL, err := cfg.TLS.apiBaseURL(endpoint)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	tlsConfig, err := cfg.TLS.tlsConfigFunc()()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	tlsConfig.RootCAs = &cfg.CAS
+	dialer := &websocket.Dialer{
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: eventStreamDialTimeout,
+	}
+	if cfg.Overlay != nil {
+		dialer.NetDialContext = cfg.Overlay.dialContext
+	}
+
+	streamURL := "wss" + strings.TrimPrefix(baseURL, "https") + eventStreamPath
+	dialCtx, cancel := context.WithTimeout(ctx, eventStreamDialTimeout)
+	defer cancel()
+	conn, resp, err := dialer.DialContext(dialCtx, streamURL, http.Header{"zt-session": []string{token}})
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%w (HTTP %s)", err, resp.Status)
+		}
+		return nil, nil, "", fmt.Errorf("failed to connect to %s: %w", streamURL, err)
+	}
+
+	closed := make(chan struct{})
+	bind := channel.BindHandlerF(func(binding channel.Binding) error {
+		binding.AddCloseHandler(channel.CloseHandlerF(func(channel.Channel) {
+			close(closed)
+		}))
+		binding.AddReceiveHandlerF(streamEventsEventType, func(m *channel.Message, _ channel.Channel) {
+			event, err := parseEvent(m.Body)
+			if err != nil {
+				klog.Warning(err)
+				return
+			}
+			s.publish(event)
+		})
+		return nil
+	})
+	ch, err := channel.NewChannel("mgmt", websockets.NewUnderlayFactory(&identity.TokenId{Token: "mgmt"}, conn, nil), bind, nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, "", fmt.Errorf("failed to open management channel on %s: %w", streamURL, err)
+	}
+
+	if err := subscribeEvents(ch, eventSubscriptions(caps)); err != nil {
+		_ = ch.Close()
+		return nil, nil, "", fmt.Errorf("failed to subscribe to events on %s: %w", endpoint, err)
+	}
+	return ch, closed, endpoint, nil
+}
+
+// subscribeEvents asks the controller to stream the given event types as JSON
+func subscribeEvents(ch channel.Channel, types []string) error {
+	type subscription struct {
+		Type string `json:"type"`
+	}
+	request := struct {
+		Format        string         `json:"format"`
+		Subscriptions []subscription `json:"subscriptions"`
+	}{Format: "json"}
+	for _, t := range types {
+		request.Subscriptions = append(request.Subscriptions, subscription{Type: t})
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	reply, err := channel.NewMessage(streamEventsRequestType, body).WithTimeout(eventStreamDialTimeout).SendForReply(ch)
+	if err != nil {
+		return err
+	}
+	if reply.ContentType != channel.ContentTypeResultType {
+		return fmt.Errorf("unexpected reply of content type %d", reply.ContentType)
+	}
+	if result := channel.UnmarshalResult(reply); !result.Success {
+		return errors.New(result.Message)
+	}
+	return nil
+}
+
+// apiSession returns the endpoint and token of an API session the controller accepts
+func (e *Edge) apiSession(ctx context.Context) (string, string, error) {
+	var (
+		client *rest_management_api_client.ZitiEdgeManagement
+		token  string
+	)
+	err := e.do(ctx, "GetCurrentAPISession", func(ctx context.Context, c *rest_management_api_client.ZitiEdgeManagement) error {
+		resp, err := c.CurrentAPISession.GetCurrentAPISession(withContext(ctx, current_api_session.NewGetCurrentAPISessionParams()), nil)
+		if err != nil {
+			return err
+		}
+		if data := resp.GetPayload().Data; data != nil && data.Token != nil {
+			token = *data.Token
+		}
+		client = c
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if token == "" {
+		return "", "", errors.New("controller did not return the API session token")
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, ep := range e.endpoints {
+		if ep.client == client {
+			return ep.url, token, nil
+		}
+	}
+	return "", "", errors.New("API session was dropped before the event stream was opened")
+}
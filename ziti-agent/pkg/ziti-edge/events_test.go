@@ -0,0 +1,97 @@
+package zitiedge
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Event
+	}{
+		{
+			name: "legacy router",
+			data: `{"namespace":"fabric.routers","event_type":"router-offline","timestamp":"2024-05-01T10:00:00Z","router_id":"r1"}`,
+			want: Event{Namespace: EventNamespaceRouter, Type: EventTypeRouterOffline, Timestamp: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), RouterID: "r1"},
+		},
+		{
+			name: "session",
+			data: `{"namespace":"session","event_type":"created","timestamp":"2024-05-01T10:00:00Z","id":"s1","identity_id":"i1","service_id":"svc1"}`,
+			want: Event{Namespace: EventNamespaceSession, Type: EventTypeCreated, Timestamp: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), ID: "s1", IdentityID: "i1", ServiceID: "svc1"},
+		},
+		{
+			name: "legacy api session",
+			data: `{"namespace":"edge.apiSessions","event_type":"deleted","timestamp":"2024-05-01T10:00:00Z","id":"a1","identity_id":"i1"}`,
+			want: Event{Namespace: EventNamespaceAPISession, Type: EventTypeDeleted, Timestamp: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), ID: "a1", IdentityID: "i1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEvent([]byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got.Raw) != tt.data {
+				t.Errorf("raw event %s", got.Raw)
+			}
+			got.Raw = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseEvent([]byte("not json")); err == nil {
+		t.Error("expected an error for a malformed event")
+	}
+}
+
+func TestEventSubscriptions(t *testing.T) {
+	if got := eventSubscriptions(newCapabilities("v0.32.1", nil)); !slices.Contains(got, "fabric.routers") {
+		t.Errorf("legacy controller subscriptions %v", got)
+	}
+	if got := eventSubscriptions(newCapabilities("v1.1.15", nil)); !slices.Contains(got, EventNamespaceRouter) {
+		t.Errorf("current controller subscriptions %v", got)
+	}
+	if got := eventSubscriptions(Capabilities{}); !slices.Contains(got, "fabric.routers") {
+		t.Errorf("unknown controller subscriptions %v", got)
+	}
+}
+
+func TestEventStreamPublish(t *testing.T) {
+	s := NewEventStream(nil)
+	routers, unsubscribeRouters := s.Subscribe(1, EventNamespaceRouter)
+	all, unsubscribeAll := s.Subscribe(4)
+	defer unsubscribeAll()
+
+	s.publish(Event{Namespace: EventNamespaceSession, Type: EventTypeCreated})
+	s.publish(Event{Namespace: EventNamespaceRouter, Type: EventTypeRouterOnline, RouterID: "r1"})
+	// the router subscriber's buffer is full, so this one is dropped for it only
+	s.publish(Event{Namespace: EventNamespaceRouter, Type: EventTypeRouterOffline, RouterID: "r1"})
+
+	if event := <-routers; event.Type != EventTypeRouterOnline {
+		t.Errorf("router subscriber got %+v", event)
+	}
+	select {
+	case event := <-routers:
+		t.Errorf("router subscriber got %+v after its buffer was full", event)
+	default:
+	}
+	if len(all) != 3 {
+		t.Errorf("subscriber to all namespaces got %d events, want 3", len(all))
+	}
+
+	unsubscribeRouters()
+	unsubscribeRouters()
+	if _, ok := <-routers; ok {
+		t.Error("channel still open after unsubscribing")
+	}
+	s.publish(Event{Namespace: EventNamespaceStream, Type: EventTypeResumed})
+	if len(all) != 4 {
+		t.Errorf("subscriber to all namespaces got %d events, want 4", len(all))
+	}
+}
@@ -3,10 +3,13 @@ package zitiedge
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"time"
 
+	"github.com/go-openapi/strfmt"
 	"github.com/openziti/edge-api/rest_management_api_client"
+	"github.com/openziti/edge-api/rest_management_api_client/authenticator"
+	"github.com/openziti/edge-api/rest_management_api_client/enrollment"
 	"github.com/openziti/edge-api/rest_management_api_client/identity"
 	rest_model_edge "github.com/openziti/edge-api/rest_model"
 	"github.com/openziti/sdk-golang/ziti"
@@ -14,7 +17,16 @@ import (
 	"k8s.io/klog/v2"
 )
 
-func CreateIdentity(name string, roleAttributes rest_model_edge.Attributes, identityType rest_model_edge.IdentityType, edge *rest_management_api_client.ZitiEdgeManagement) (*identity.CreateIdentityCreated, error) {
+// IdentityOptions are optional fields of a created identity; empty ones are left unset. Check
+// Edge.Capabilities before setting them, older controllers reject the fields they do not know.
+type IdentityOptions struct {
+	AuthPolicyID string
+	ExternalID   string
+	// Tags record where the identity comes from, so that it can be recognized when it is met again
+	Tags map[string]string
+}
+
+func CreateIdentity(ctx context.Context, name string, roleAttributes rest_model_edge.Attributes, identityType rest_model_edge.IdentityType, opts IdentityOptions, edge *Edge) (*identity.CreateIdentityCreated, error) {
 	isAdmin := false
 	req := identity.NewCreateIdentityParams()
 	req.Identity = &rest_model_edge.IdentityCreate{
@@ -22,33 +34,61 @@ func CreateIdentity(name string, roleAttributes rest_model_edge.Attributes, iden
 		IsAdmin:             &isAdmin,
 		Name:                &name,
 		AppData:             nil,
+		AuthPolicyID:        optional(opts.AuthPolicyID),
 		RoleAttributes:      &roleAttributes,
-		ExternalID:          nil,
+		ExternalID:          optional(opts.ExternalID),
 		ServiceHostingCosts: nil,
-		Tags:                nil,
+		Tags:                NewTags(opts.Tags),
 		Type:                &identityType,
 	}
-	req.SetTimeout(30 * time.Second)
 	requestJson, err := json.Marshal(&req)
 	if err != nil {
 		return nil, err
 	}
 	klog.V(5).Infof("Creating Ziti identity with request JSON: %v", string(requestJson))
-	resp, err := edge.Identity.CreateIdentity(req, nil)
+	var resp *identity.CreateIdentityCreated
+	err = edge.do(ctx, "CreateIdentity", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) (err error) {
+		resp, err = client.Identity.CreateIdentity(withContext(ctx, req), nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
-func PatchIdentity(zId string, roleAttributes rest_model_edge.Attributes, edge *rest_management_api_client.ZitiEdgeManagement) (*identity.PatchIdentityOK, error) {
+// optional returns nil for an empty string so that the field is omitted from the request
+func optional(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// NewTags returns nil for no tags so that the field is omitted from the request
+func NewTags(values map[string]string) *rest_model_edge.Tags {
+	if len(values) == 0 {
+		return nil
+	}
+	t := &rest_model_edge.Tags{SubTags: rest_model_edge.SubTags{}}
+	for k, v := range values {
+		t.SubTags[k] = v
+	}
+	return t
+}
+
+func PatchIdentity(ctx context.Context, zId string, roleAttributes rest_model_edge.Attributes, edge *Edge) (*identity.PatchIdentityOK, error) {
 	req := identity.PatchIdentityParams{
 		ID: zId,
 		Identity: &rest_model_edge.IdentityPatch{
 			RoleAttributes: &roleAttributes,
 		},
 	}
-	resp, err := edge.Identity.PatchIdentity(&req, nil)
+	var resp *identity.PatchIdentityOK
+	err := edge.do(ctx, "PatchIdentity", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) (err error) {
+		resp, err = client.Identity.PatchIdentity(withContext(ctx, &req), nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -56,44 +96,50 @@ func PatchIdentity(zId string, roleAttributes rest_model_edge.Attributes, edge *
 }
 
 // get nil or a list of exactly one identity by name
-func GetIdentityByName(name string, edge *rest_management_api_client.ZitiEdgeManagement) (*identity.ListIdentitiesOK, error) {
-	filter := fmt.Sprintf("name=\"%s\"", name)
+func GetIdentityByName(ctx context.Context, name string, edge *Edge) (*identity.ListIdentitiesOK, error) {
+	filter := Eq("name", name).String()
 	limit := int64(0)
 	offset := int64(0)
 	req := &identity.ListIdentitiesParams{
-		Filter:  &filter,
-		Limit:   &limit,
-		Offset:  &offset,
-		Context: context.Background(),
+		Filter: &filter,
+		Limit:  &limit,
+		Offset: &offset,
 	}
-	req.SetTimeout(30 * time.Second)
-	resp, err := edge.Identity.ListIdentities(req, nil)
+	var resp *identity.ListIdentitiesOK
+	err := edge.do(ctx, "GetIdentityByName", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) (err error) {
+		resp, err = client.Identity.ListIdentities(withContext(ctx, req), nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
-func GetIdentityById(zId string, edge *rest_management_api_client.ZitiEdgeManagement) (*identity.DetailIdentityOK, error) {
+func GetIdentityById(ctx context.Context, zId string, edge *Edge) (*identity.DetailIdentityOK, error) {
 	req := &identity.DetailIdentityParams{
-		ID:      zId,
-		Context: context.Background(),
+		ID: zId,
 	}
-	req.SetTimeout(30 * time.Second)
-	resp, err := edge.Identity.DetailIdentity(req, nil)
+	var resp *identity.DetailIdentityOK
+	err := edge.do(ctx, "GetIdentityById", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) (err error) {
+		resp, err = client.Identity.DetailIdentity(withContext(ctx, req), nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
-func GetIdentityEnrollmentJWT(zId string, edge *rest_management_api_client.ZitiEdgeManagement) (*string, error) {
+func GetIdentityEnrollmentJWT(ctx context.Context, zId string, edge *Edge) (*string, error) {
 	p := &identity.DetailIdentityParams{
-		Context: context.Background(),
-		ID:      zId,
+		ID: zId,
 	}
-	p.SetTimeout(30 * time.Second)
-	resp, err := edge.Identity.DetailIdentity(p, nil)
+	var resp *identity.DetailIdentityOK
+	err := edge.do(ctx, "GetIdentityEnrollmentJWT", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) (err error) {
+		resp, err = client.Identity.DetailIdentity(withContext(ctx, p), nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -110,13 +156,14 @@ func GetIdentityEnrollmentJWT(zId string, edge *rest_management_api_client.ZitiE
 	return &jwt.Raw, nil
 }
 
-func DeleteIdentity(zId string, edge *rest_management_api_client.ZitiEdgeManagement) error {
+func DeleteIdentity(ctx context.Context, zId string, edge *Edge) error {
 	req := &identity.DeleteIdentityParams{
-		ID:      zId,
-		Context: context.Background(),
+		ID: zId,
 	}
-	req.SetTimeout(30 * time.Second)
-	_, err := edge.Identity.DeleteIdentity(req, nil)
+	err := edge.do(ctx, "DeleteIdentity", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error {
+		_, err := client.Identity.DeleteIdentity(withContext(ctx, req), nil)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -124,6 +171,69 @@ func DeleteIdentity(zId string, edge *rest_management_api_client.ZitiEdgeManagem
 	return nil
 }
 
+// DisableIdentity keeps an identity from authenticating until it is enabled again
+func DisableIdentity(ctx context.Context, zId string, edge *Edge) error {
+	indefinitely := int64(0)
+	req := &identity.DisableIdentityParams{
+		ID:      zId,
+		Disable: &rest_model_edge.DisableParams{DurationMinutes: &indefinitely},
+	}
+	err := edge.do(ctx, "DisableIdentity", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error {
+		_, err := client.Identity.DisableIdentity(withContext(ctx, req), nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	klog.V(5).Infof("Ziti identity '%v' was disabled", zId)
+	return nil
+}
+
+// ReissueEnrollment gives an identity a new one-time token enrollment valid until expiresAt. A
+// pending enrollment is refreshed; if the token was consumed, the certificate it was exchanged
+// for is revoked so that the identity can be enrolled again.
+func ReissueEnrollment(ctx context.Context, detail *rest_model_edge.IdentityDetail, expiresAt time.Time, edge *Edge) error {
+	if detail == nil || detail.ID == nil {
+		return errors.New("no identity to re-issue the enrollment of")
+	}
+	expires := strfmt.DateTime(expiresAt)
+
+	if detail.Enrollment != nil && detail.Enrollment.Ott != nil && detail.Enrollment.Ott.ID != "" {
+		req := &enrollment.RefreshEnrollmentParams{
+			ID:      detail.Enrollment.Ott.ID,
+			Refresh: &rest_model_edge.EnrollmentRefresh{ExpiresAt: &expires},
+		}
+		return edge.do(ctx, "RefreshEnrollment", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error {
+			_, err := client.Enrollment.RefreshEnrollment(withContext(ctx, req), nil)
+			return err
+		})
+	}
+
+	if detail.Authenticators != nil && detail.Authenticators.Cert != nil && detail.Authenticators.Cert.ID != "" {
+		req := &authenticator.ReEnrollAuthenticatorParams{
+			ID:       detail.Authenticators.Cert.ID,
+			ReEnroll: &rest_model_edge.ReEnroll{ExpiresAt: &expires},
+		}
+		return edge.do(ctx, "ReEnrollAuthenticator", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error {
+			_, err := client.Authenticator.ReEnrollAuthenticator(withContext(ctx, req), nil)
+			return err
+		})
+	}
+
+	method := rest_model_edge.EnrollmentCreateMethodOtt
+	req := &enrollment.CreateEnrollmentParams{
+		Enrollment: &rest_model_edge.EnrollmentCreate{
+			ExpiresAt:  &expires,
+			IdentityID: detail.ID,
+			Method:     &method,
+		},
+	}
+	return edge.do(ctx, "CreateEnrollment", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error {
+		_, err := client.Enrollment.CreateEnrollment(withContext(ctx, req), nil)
+		return err
+	})
+}
+
 func EnrollIdentityWithJwt(jwtToken string) (*ziti.Config, error) {
 	tkn, _, err := enroll.ParseToken(jwtToken)
 	if err != nil {
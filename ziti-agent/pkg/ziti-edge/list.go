@@ -0,0 +1,102 @@
+package zitiedge
+
+import (
+	"context"
+	"iter"
+
+	"github.com/openziti/edge-api/rest_management_api_client"
+	"github.com/openziti/edge-api/rest_management_api_client/edge_router"
+	"github.com/openziti/edge-api/rest_management_api_client/identity"
+	"github.com/openziti/edge-api/rest_management_api_client/service"
+	"github.com/openziti/edge-api/rest_management_api_client/service_policy"
+	rest_model_edge "github.com/openziti/edge-api/rest_model"
+)
+
+// pageSize is the most objects the controller returns per list request
+const pageSize = 500
+
+// fetchPage lists one page of objects matching filter
+type fetchPage[T any] func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement, filter string, limit, offset int64) ([]T, *rest_model_edge.Meta, error)
+
+// paginate streams every object matching query, one page request at a time. Pages are ordered by
+// id so that objects created while listing do not shift the ones not yet seen; objects deleted
+// meanwhile may cause later ones to be skipped, which suits sweeps that run again.
+func paginate[T any](ctx context.Context, edge *Edge, function string, query Query, fetch fetchPage[T]) iter.Seq2[T, error] {
+	filter := query.String() + " sort by id"
+	return func(yield func(T, error) bool) {
+		for offset := int64(0); ; {
+			var (
+				items []T
+				meta  *rest_model_edge.Meta
+			)
+			err := edge.do(ctx, function, func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) (err error) {
+				items, meta, err = fetch(ctx, client, filter, pageSize, offset)
+				return err
+			})
+			if err != nil {
+				var zero T
+				yield(zero, err)
+				return
+			}
+
+			for _, item := range items {
+				if !yield(item, nil) {
+					return
+				}
+			}
+
+			offset += int64(len(items))
+			if len(items) < pageSize || (meta != nil && meta.Pagination != nil && meta.Pagination.TotalCount != nil && offset >= *meta.Pagination.TotalCount) {
+				return
+			}
+		}
+	}
+}
+
+// ListIdentities streams every identity matching query
+func ListIdentities(ctx context.Context, query Query, edge *Edge) iter.Seq2[*rest_model_edge.IdentityDetail, error] {
+	return paginate(ctx, edge, "ListIdentities", query, func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement, filter string, limit, offset int64) ([]*rest_model_edge.IdentityDetail, *rest_model_edge.Meta, error) {
+		req := &identity.ListIdentitiesParams{Filter: &filter, Limit: &limit, Offset: &offset}
+		resp, err := client.Identity.ListIdentities(withContext(ctx, req), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return resp.GetPayload().Data, resp.GetPayload().Meta, nil
+	})
+}
+
+// ListEdgeRouters streams every edge router matching query
+func ListEdgeRouters(ctx context.Context, query Query, edge *Edge) iter.Seq2[*rest_model_edge.EdgeRouterDetail, error] {
+	return paginate(ctx, edge, "ListEdgeRouters", query, func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement, filter string, limit, offset int64) ([]*rest_model_edge.EdgeRouterDetail, *rest_model_edge.Meta, error) {
+		req := &edge_router.ListEdgeRoutersParams{Filter: &filter, Limit: &limit, Offset: &offset}
+		resp, err := client.EdgeRouter.ListEdgeRouters(withContext(ctx, req), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return resp.GetPayload().Data, resp.GetPayload().Meta, nil
+	})
+}
+
+// ListServices streams every service matching query
+func ListServices(ctx context.Context, query Query, edge *Edge) iter.Seq2[*rest_model_edge.ServiceDetail, error] {
+	return paginate(ctx, edge, "ListServices", query, func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement, filter string, limit, offset int64) ([]*rest_model_edge.ServiceDetail, *rest_model_edge.Meta, error) {
+		req := &service.ListServicesParams{Filter: &filter, Limit: &limit, Offset: &offset}
+		resp, err := client.Service.ListServices(withContext(ctx, req), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return resp.GetPayload().Data, resp.GetPayload().Meta, nil
+	})
+}
+
+// ListServicePolicies streams every service policy matching query
+func ListServicePolicies(ctx context.Context, query Query, edge *Edge) iter.Seq2[*rest_model_edge.ServicePolicyDetail, error] {
+	return paginate(ctx, edge, "ListServicePolicies", query, func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement, filter string, limit, offset int64) ([]*rest_model_edge.ServicePolicyDetail, *rest_model_edge.Meta, error) {
+		req := &service_policy.ListServicePoliciesParams{Filter: &filter, Limit: &limit, Offset: &offset}
+		resp, err := client.ServicePolicy.ListServicePolicies(withContext(ctx, req), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return resp.GetPayload().Data, resp.GetPayload().Meta, nil
+	})
+}
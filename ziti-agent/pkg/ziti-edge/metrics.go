@@ -0,0 +1,157 @@
+package zitiedge
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	apiCalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "mgmt_api",
+			Name:      "calls_total",
+			Help:      "Ziti management API calls by zitiedge function and result.",
+		},
+		[]string{"function", "result"},
+	)
+
+	apiCallDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "mgmt_api",
+			Name:      "call_duration_seconds",
+			Help:      "Latency of Ziti management API calls by zitiedge function, including any re-login.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"function"},
+	)
+
+	apiErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "mgmt_api",
+			Name:      "errors_total",
+			Help:      "Failed Ziti management API calls by zitiedge function and HTTP status class (\"none\" if no response was received).",
+		},
+		[]string{"function", "status_class"},
+	)
+
+	activeEndpoint = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "mgmt_api",
+			Name:      "active_endpoint",
+			Help:      "1 for the management API endpoint the current session is logged in to, 0 for the other configured endpoints.",
+		},
+		[]string{"endpoint"},
+	)
+
+	endpointAvailable = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "mgmt_api",
+			Name:      "endpoint_available",
+			Help:      "0 while a management API endpoint is skipped after failures (circuit open), 1 otherwise.",
+		},
+		[]string{"endpoint"},
+	)
+
+	controllerVersion = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "mgmt_api",
+			Name:      "controller_info",
+			Help:      "1 labelled with the controller version of each management API endpoint logged in to (\"unknown\" if it could not be read).",
+		},
+		[]string{"endpoint", "version"},
+	)
+
+	eventStreamConnected = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "mgmt_api",
+			Name:      "event_stream_connected",
+			Help:      "1 while the controller event stream is open, 0 otherwise.",
+		},
+	)
+
+	controllerEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "mgmt_api",
+			Name:      "events_total",
+			Help:      "Controller events received on the event stream by namespace and type.",
+		},
+		[]string{"namespace", "type"},
+	)
+
+	droppedEvents = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "ziti_agent",
+			Subsystem: "mgmt_api",
+			Name:      "events_dropped_total",
+			Help:      "Controller events not delivered to a subscriber whose buffer was full.",
+		},
+	)
+)
+
+// RegisterMetrics registers the management API collectors with reg
+func RegisterMetrics(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{apiCalls, apiCallDuration, apiErrors, activeEndpoint, endpointAvailable, controllerVersion, eventStreamConnected, controllerEvents, droppedEvents} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observeCall records the outcome of one call to a zitiedge function
+func observeCall(function string, start time.Time, err error) {
+	apiCallDuration.WithLabelValues(function).Observe(time.Since(start).Seconds())
+	if err != nil {
+		apiCalls.WithLabelValues(function, "error").Inc()
+		apiErrors.WithLabelValues(function, statusClass(err)).Inc()
+		return
+	}
+	apiCalls.WithLabelValues(function, "success").Inc()
+}
+
+// setActiveEndpoint marks which of the endpoints the session is using
+func setActiveEndpoint(endpoints []string, active string) {
+	for _, endpoint := range endpoints {
+		if endpoint == active {
+			activeEndpoint.WithLabelValues(endpoint).Set(1)
+		} else {
+			activeEndpoint.WithLabelValues(endpoint).Set(0)
+		}
+	}
+}
+
+// setControllerVersion records the controller version behind an endpoint, replacing the one seen
+// at an earlier login
+func setControllerVersion(endpoint, version string) {
+	if version == "" {
+		version = "unknown"
+	}
+	controllerVersion.DeletePartialMatch(prometheus.Labels{"endpoint": endpoint})
+	controllerVersion.WithLabelValues(endpoint, version).Set(1)
+}
+
+// forgetEndpoint drops the series of an endpoint that is no longer used
+func forgetEndpoint(endpoint string) {
+	activeEndpoint.DeleteLabelValues(endpoint)
+	endpointAvailable.DeleteLabelValues(endpoint)
+	controllerVersion.DeletePartialMatch(prometheus.Labels{"endpoint": endpoint})
+}
+
+// statusClass buckets an error by the HTTP status the controller answered with
+func statusClass(err error) string {
+	code := StatusCode(err)
+	if code == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
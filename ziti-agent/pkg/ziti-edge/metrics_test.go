@@ -0,0 +1,40 @@
+package zitiedge
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveCall(t *testing.T) {
+	apiCalls.Reset()
+	apiCallDuration.Reset()
+	apiErrors.Reset()
+
+	controller := newFakeController(t, http.StatusServiceUnavailable)
+	e := newTestEdge(t, FailoverConfig{}, controller)
+	if err := e.Ping(context.Background()); err == nil {
+		t.Fatal("call to an unavailable controller succeeded")
+	}
+
+	expected := `
+# HELP ziti_agent_mgmt_api_calls_total Ziti management API calls by zitiedge function and result.
+# TYPE ziti_agent_mgmt_api_calls_total counter
+ziti_agent_mgmt_api_calls_total{function="Ping",result="error"} 1
+# HELP ziti_agent_mgmt_api_errors_total Failed Ziti management API calls by zitiedge function and HTTP status class ("none" if no response was received).
+# TYPE ziti_agent_mgmt_api_errors_total counter
+ziti_agent_mgmt_api_errors_total{function="Ping",status_class="5xx"} 1
+`
+	if err := testutil.CollectAndCompare(apiCalls, strings.NewReader(expected), "ziti_agent_mgmt_api_calls_total"); err != nil {
+		t.Error(err)
+	}
+	if err := testutil.CollectAndCompare(apiErrors, strings.NewReader(expected), "ziti_agent_mgmt_api_errors_total"); err != nil {
+		t.Error(err)
+	}
+	if n := testutil.CollectAndCount(apiCallDuration); n != 1 {
+		t.Errorf("%d call duration series, want 1", n)
+	}
+}
@@ -0,0 +1,69 @@
+package zitiedge
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/openziti/edge-api/rest_util"
+	"github.com/openziti/sdk-golang/ziti"
+)
+
+// defaultOverlayConnectTimeout matches the connect timeout of ziti.Context.Dial
+const defaultOverlayConnectTimeout = 5 * time.Second
+
+// Overlay reaches the management API by dialing a Ziti service instead of the controller address,
+// so that the management API does not have to be reachable from the cluster network. TLS to the
+// controller still runs over the dialed connection and is verified as usual.
+type Overlay struct {
+	// Context is logged in with an identity that may dial Service
+	Context ziti.Context
+	// Service fronts the management API
+	Service string
+}
+
+// dialContext ignores the address; every connection goes to the service
+func (o *Overlay) dialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	timeout := defaultOverlayConnectTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if o.Service == "" {
+		return nil, errors.New("no Ziti service to reach the management API over")
+	}
+	return o.Context.DialWithOptions(o.Service, &ziti.DialOptions{ConnectTimeout: timeout})
+}
+
+// httpClientFunc builds HTTP clients that dial the service
+func (o *Overlay) httpClientFunc() rest_util.HttpClientFunc {
+	return func(tlsConfig *tls.Config) (*http.Client, error) {
+		httpClient, err := rest_util.NewHttpClientWithTlsConfig(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		base, ok := httpClient.Transport.(*http.Transport)
+		if !ok {
+			return nil, fmt.Errorf("cannot dial over the overlay with transport %T", httpClient.Transport)
+		}
+		transport := base.Clone()
+		transport.Proxy = nil
+		transport.DialContext = o.dialContext
+		httpClient.Transport = transport
+		return httpClient, nil
+	}
+}
+
+// httpClientFunc builds the HTTP clients of management API requests
+func (cfg *Config) httpClientFunc() rest_util.HttpClientFunc {
+	if cfg.Overlay != nil {
+		return cfg.Overlay.httpClientFunc()
+	}
+	return rest_util.NewHttpClientWithTlsConfig
+}
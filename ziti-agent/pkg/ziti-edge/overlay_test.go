@@ -0,0 +1,146 @@
+package zitiedge
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/openziti/sdk-golang/ziti"
+	"github.com/openziti/sdk-golang/ziti/edge"
+)
+
+// fakeZitiContext dials services by connecting to addr, recording what was dialed
+type fakeZitiContext struct {
+	ziti.Context
+	addr     string
+	services []string
+	timeouts []time.Duration
+}
+
+func (c *fakeZitiContext) DialWithOptions(service string, options *ziti.DialOptions) (edge.Conn, error) {
+	c.services = append(c.services, service)
+	c.timeouts = append(c.timeouts, options.ConnectTimeout)
+	if c.addr == "" {
+		return nil, errors.New("service unavailable")
+	}
+	conn, err := net.Dial("tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeEdgeConn{Conn: conn}, nil
+}
+
+// fakeEdgeConn is a plain connection standing in for a Ziti one; the net.Conn methods take
+// precedence over those of the deeper, nil edge.Conn
+type fakeEdgeConn struct {
+	net.Conn
+	edgeConn
+}
+
+type edgeConn struct{ edge.Conn }
+
+func TestOverlayDialContext(t *testing.T) {
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	short, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		service     string
+		wantDial    bool
+		wantTimeout time.Duration
+	}{
+		{name: "default timeout", ctx: context.Background(), service: "mgmt", wantDial: true, wantTimeout: defaultOverlayConnectTimeout},
+		{name: "deadline", ctx: short, service: "mgmt", wantDial: true, wantTimeout: time.Second},
+		{name: "canceled", ctx: expired, service: "mgmt"},
+		{name: "no service", ctx: context.Background()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			zitiCtx := &fakeZitiContext{}
+			o := &Overlay{Context: zitiCtx, Service: tt.service}
+			// the fake context has nothing to connect to, so every dial fails
+			if _, err := o.dialContext(tt.ctx, "tcp", "ctrl.example.com:443"); err == nil {
+				t.Fatal("dial succeeded")
+			}
+			if !tt.wantDial {
+				if len(zitiCtx.services) != 0 {
+					t.Errorf("dialed %v", zitiCtx.services)
+				}
+				return
+			}
+			if len(zitiCtx.services) != 1 || zitiCtx.services[0] != tt.service {
+				t.Fatalf("dialed %v, want the service %s", zitiCtx.services, tt.service)
+			}
+			if got := zitiCtx.timeouts[0]; got > tt.wantTimeout || got < tt.wantTimeout-100*time.Millisecond {
+				t.Errorf("connect timeout %s, want %s", got, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestOverlayTransport(t *testing.T) {
+	var paths []string
+	controller := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"data":{"id":"session","token":"token"},"meta":{}}`))
+	}))
+	defer controller.Close()
+
+	zitiCtx := &fakeZitiContext{addr: controller.Listener.Addr().String()}
+	cfg := Config{
+		AuthMethod: AuthMethodUpdb,
+		Username:   "admin",
+		Password:   "secret",
+		Overlay:    &Overlay{Context: zitiCtx, Service: "mgmt"},
+	}
+	// the test certificate is for example.com
+	cfg.TLS.ServerName = "example.com"
+	cfg.CAS = *x509.NewCertPool()
+	cfg.CAS.AddCert(controller.Certificate())
+
+	auth, err := cfg.authenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the controller's name does not resolve; the request only arrives through the service
+	mgmtAPIURL, err := url.Parse("https://ctrl.invalid/edge/management/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := auth.Authenticate(mgmtAPIURL)
+	if err != nil {
+		t.Fatalf("login over the overlay: %v", err)
+	}
+	if session.Token == nil || *session.Token != "token" {
+		t.Errorf("API session %+v, want the controller's", session)
+	}
+	if len(zitiCtx.services) != 1 || zitiCtx.services[0] != "mgmt" {
+		t.Errorf("dialed %v, want the service mgmt", zitiCtx.services)
+	}
+	if len(paths) != 1 || paths[0] != "/edge/management/v1/authenticate" {
+		t.Errorf("controller received %v, want the login", paths)
+	}
+
+	// without an overlay the transport dials the address, which does not resolve
+	cfg.Overlay = nil
+	auth, err = cfg.authenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authenticate(mgmtAPIURL); err == nil {
+		t.Error("login succeeded without the overlay")
+	}
+	if len(zitiCtx.services) != 1 {
+		t.Errorf("dialed the service without an overlay")
+	}
+}
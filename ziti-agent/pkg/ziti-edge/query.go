@@ -0,0 +1,86 @@
+package zitiedge
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Query is a ZitiQL filter expression built from escaped values. The zero Query matches
+// everything.
+//
+// Field names are written as given and must not come from user input; values are always quoted.
+type Query struct {
+	expr string
+}
+
+// Eq matches objects whose field equals value
+func Eq(field, value string) Query {
+	return Query{expr: field + " = " + quote(value)}
+}
+
+// Contains matches objects whose string field contains value
+func Contains(field, value string) Query {
+	return Query{expr: field + " contains " + quote(value)}
+}
+
+// In matches objects whose field equals one of values; with no values it matches nothing
+func In(field string, values ...string) Query {
+	if len(values) == 0 {
+		return Query{expr: "false"}
+	}
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = quote(value)
+	}
+	return Query{expr: field + " in [" + strings.Join(quoted, ", ") + "]"}
+}
+
+// HasAttribute matches objects whose role attributes include attribute
+func HasAttribute(attribute string) Query {
+	return Query{expr: "anyOf(roleAttributes) = " + quote(attribute)}
+}
+
+// And matches objects that match both queries
+func (q Query) And(other Query) Query {
+	return q.join("and", other)
+}
+
+// Or matches objects that match either query
+func (q Query) Or(other Query) Query {
+	if q.expr == "" || other.expr == "" {
+		return Query{}
+	}
+	return q.join("or", other)
+}
+
+// Not matches objects that do not match q
+func Not(q Query) Query {
+	if q.expr == "" {
+		return Query{expr: "false"}
+	}
+	return Query{expr: "not (" + q.expr + ")"}
+}
+
+func (q Query) join(op string, other Query) Query {
+	switch {
+	case q.expr == "":
+		return other
+	case other.expr == "":
+		return q
+	}
+	return Query{expr: "(" + q.expr + ") " + op + " (" + other.expr + ")"}
+}
+
+// String renders the filter, "true" for the zero Query
+func (q Query) String() string {
+	if q.expr == "" {
+		return "true"
+	}
+	return q.expr
+}
+
+// quote renders value as a ZitiQL string literal, whose escapes are those of JSON
+func quote(value string) string {
+	quoted, _ := json.Marshal(value) // marshalling a string cannot fail
+	return string(quoted)
+}
@@ -0,0 +1,106 @@
+package zitiedge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/openziti/edge-api/rest_management_api_client"
+	"github.com/openziti/edge-api/rest_management_api_client/identity"
+	rest_model_edge "github.com/openziti/edge-api/rest_model"
+)
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		query Query
+		want  string
+	}{
+		{Query{}, `true`},
+		{Eq("name", "zt-pod"), `name = "zt-pod"`},
+		{Eq("name", `evil" or true or name = "`), `name = "evil\" or true or name = \""`},
+		{Eq("name", `back\slash`), `name = "back\\slash"`},
+		{Eq("name", "zt").And(Contains("tags.namespace", "default")), `(name = "zt") and (tags.namespace contains "default")`},
+		{Eq("a", "1").Or(Eq("b", "2")).And(Not(Eq("c", "3"))), `((a = "1") or (b = "2")) and (not (c = "3"))`},
+		{Query{}.And(Eq("name", "zt")), `name = "zt"`},
+		{Query{}.Or(Eq("name", "zt")), `true`},
+		{In("id", "a", "b"), `id in ["a", "b"]`},
+		{In("id"), `false`},
+		{HasAttribute("web"), `anyOf(roleAttributes) = "web"`},
+	}
+	for _, tt := range tests {
+		if got := tt.query.String(); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
+
+// pagedEdge returns an Edge with a session already in place, so calls go straight to the fetcher
+func pagedEdge() *Edge {
+	e := NewEdge(Config{}, []string{"https://ctrl.test:1280/edge/management/v1"}, Options{})
+	e.endpoints[0].client = &rest_management_api_client.ZitiEdgeManagement{}
+	return e
+}
+
+func TestPaginate(t *testing.T) {
+	total := int64(2*pageSize + 7)
+	var offsets []int64
+	fetch := func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement, filter string, limit, offset int64) ([]int64, *rest_model_edge.Meta, error) {
+		if filter != `name contains "zt" sort by id` {
+			t.Errorf("unexpected filter %s", filter)
+		}
+		offsets = append(offsets, offset)
+		var items []int64
+		for i := offset; i < min(offset+limit, total); i++ {
+			items = append(items, i)
+		}
+		return items, &rest_model_edge.Meta{Pagination: &rest_model_edge.Pagination{TotalCount: &total}}, nil
+	}
+
+	var seen int64
+	for item, err := range paginate(context.Background(), pagedEdge(), "ListTest", Contains("name", "zt"), fetch) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item != seen {
+			t.Fatalf("got item %d, want %d", item, seen)
+		}
+		seen++
+	}
+	if seen != total {
+		t.Errorf("saw %d items, want %d", seen, total)
+	}
+	if fmt.Sprint(offsets) != fmt.Sprint([]int64{0, pageSize, 2 * pageSize}) {
+		t.Errorf("fetched offsets %v", offsets)
+	}
+
+	// stopping early must not fetch further pages
+	offsets = nil
+	for item := range paginate(context.Background(), pagedEdge(), "ListTest", Contains("name", "zt"), fetch) {
+		if item == 10 {
+			break
+		}
+	}
+	if len(offsets) != 1 {
+		t.Errorf("fetched %d pages after stopping in the first", len(offsets))
+	}
+}
+
+func TestPaginateError(t *testing.T) {
+	// an answer from the controller, so the endpoint is not failed over or retried
+	failure := identity.NewListIdentitiesBadRequest()
+	fetch := func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement, filter string, limit, offset int64) ([]int64, *rest_model_edge.Meta, error) {
+		return nil, nil, failure
+	}
+
+	var errs int
+	for _, err := range paginate(context.Background(), pagedEdge(), "ListTest", Query{}, fetch) {
+		if !errors.Is(err, failure) {
+			t.Fatalf("got %v, want %v", err, failure)
+		}
+		errs++
+	}
+	if errs != 1 {
+		t.Errorf("got %d errors, want 1", errs)
+	}
+}
@@ -0,0 +1,58 @@
+package zitiedge
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	defaultRetryAttempts       = 3
+	defaultRetryInitialBackoff = 200 * time.Millisecond
+	defaultRetryMaxBackoff     = 2 * time.Second
+)
+
+// RetryPolicy repeats calls that failed with ErrTransient on every endpoint. The pause before
+// each repeat doubles from InitialBackoff up to MaxBackoff and is jittered, so that webhook
+// replicas do not retry in lockstep. Zero values select the defaults.
+type RetryPolicy struct {
+	// MaxAttempts counts the first try; 1 turns retries off
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultRetryAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaultRetryInitialBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = max(defaultRetryMaxBackoff, p.InitialBackoff)
+	}
+	return p
+}
+
+// backoff returns the pause before the given retry, counted from 0, drawn from the upper half of
+// the exponential delay
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.InitialBackoff << min(retry, 16)
+	if delay > p.MaxBackoff || delay <= 0 {
+		delay = p.MaxBackoff
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// sleep waits for d or until ctx is done, whichever comes first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
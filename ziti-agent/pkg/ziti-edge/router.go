@@ -2,8 +2,6 @@ package zitiedge
 
 import (
 	"context"
-	"fmt"
-	"time"
 
 	"github.com/openziti/edge-api/rest_management_api_client"
 	"github.com/openziti/edge-api/rest_management_api_client/edge_router"
@@ -13,11 +11,14 @@ import (
 	"k8s.io/klog/v2"
 )
 
-func CreateEdgeRouter(options *rest_model_edge.EdgeRouterCreate, edge *rest_management_api_client.ZitiEdgeManagement) (*edge_router.CreateEdgeRouterCreated, error) {
+func CreateEdgeRouter(ctx context.Context, options *rest_model_edge.EdgeRouterCreate, edge *Edge) (*edge_router.CreateEdgeRouterCreated, error) {
 	req := edge_router.NewCreateEdgeRouterParams()
 	req.EdgeRouter = options
-	req.SetTimeout(30 * time.Second)
-	resp, err := edge.EdgeRouter.CreateEdgeRouter(req, nil)
+	var resp *edge_router.CreateEdgeRouterCreated
+	err := edge.do(ctx, "CreateEdgeRouter", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) (err error) {
+		resp, err = client.EdgeRouter.CreateEdgeRouter(withContext(ctx, req), nil)
+		return err
+	})
 	if err != nil {
 		if options != nil {
 			klog.Infof("Router Name: %v", *options.Name)
@@ -28,45 +29,53 @@ func CreateEdgeRouter(options *rest_model_edge.EdgeRouterCreate, edge *rest_mana
 	return resp, nil
 }
 
-func PatchEdgeRouter(zId string, roleAttributes rest_model_edge.Attributes, edge *rest_management_api_client.ZitiEdgeManagement) (*edge_router.PatchEdgeRouterOK, error) {
+func PatchEdgeRouter(ctx context.Context, zId string, roleAttributes rest_model_edge.Attributes, edge *Edge) (*edge_router.PatchEdgeRouterOK, error) {
 	req := edge_router.PatchEdgeRouterParams{
 		ID: zId,
 		EdgeRouter: &rest_model_edge.EdgeRouterPatch{
 			RoleAttributes: &roleAttributes,
 		},
 	}
-	resp, err := edge.EdgeRouter.PatchEdgeRouter(&req, nil)
+	var resp *edge_router.PatchEdgeRouterOK
+	err := edge.do(ctx, "PatchEdgeRouter", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) (err error) {
+		resp, err = client.EdgeRouter.PatchEdgeRouter(withContext(ctx, &req), nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return resp, err
 }
 
-func GetEdgeRouterByName(name string, edge *rest_management_api_client.ZitiEdgeManagement) (*edge_router.ListEdgeRoutersOK, error) {
-	filter := fmt.Sprintf("name=\"%v\"", name)
+func GetEdgeRouterByName(ctx context.Context, name string, edge *Edge) (*edge_router.ListEdgeRoutersOK, error) {
+	filter := Eq("name", name).String()
 	limit := int64(0)
 	offset := int64(0)
 	req := &edge_router.ListEdgeRoutersParams{
-		Filter:  &filter,
-		Limit:   &limit,
-		Offset:  &offset,
-		Context: context.Background(),
+		Filter: &filter,
+		Limit:  &limit,
+		Offset: &offset,
 	}
-	req.SetTimeout(30 * time.Second)
-	resp, err := edge.EdgeRouter.ListEdgeRouters(req, nil)
+	var resp *edge_router.ListEdgeRoutersOK
+	err := edge.do(ctx, "GetEdgeRouterByName", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) (err error) {
+		resp, err = client.EdgeRouter.ListEdgeRouters(withContext(ctx, req), nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
-func GetEdgeRouterDetail(zId string, edge *rest_management_api_client.ZitiEdgeManagement) (*edge_router.DetailEdgeRouterOK, error) {
+func GetEdgeRouterDetail(ctx context.Context, zId string, edge *Edge) (*edge_router.DetailEdgeRouterOK, error) {
 	p := &edge_router.DetailEdgeRouterParams{
-		Context: context.Background(),
-		ID:      zId,
+		ID: zId,
 	}
-	p.SetTimeout(30 * time.Second)
-	resp, err := edge.EdgeRouter.DetailEdgeRouter(p, nil)
+	var resp *edge_router.DetailEdgeRouterOK
+	err := edge.do(ctx, "GetEdgeRouterDetail", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) (err error) {
+		resp, err = client.EdgeRouter.DetailEdgeRouter(withContext(ctx, p), nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -74,13 +83,15 @@ func GetEdgeRouterDetail(zId string, edge *rest_management_api_client.ZitiEdgeMa
 	return resp, nil
 }
 
-func EnrollEdgeRouter(zId string, edge *rest_management_api_client.ZitiEdgeManagement) (*ziti.Config, error) {
+func EnrollEdgeRouter(ctx context.Context, zId string, edge *Edge) (*ziti.Config, error) {
 	p := &edge_router.DetailEdgeRouterParams{
-		Context: context.Background(),
-		ID:      zId,
+		ID: zId,
 	}
-	p.SetTimeout(30 * time.Second)
-	resp, err := edge.EdgeRouter.DetailEdgeRouter(p, nil)
+	var resp *edge_router.DetailEdgeRouterOK
+	err := edge.do(ctx, "EnrollEdgeRouter", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) (err error) {
+		resp, err = client.EdgeRouter.DetailEdgeRouter(withContext(ctx, p), nil)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -99,28 +110,43 @@ func EnrollEdgeRouter(zId string, edge *rest_management_api_client.ZitiEdgeManag
 	return conf, nil
 }
 
-func ReEnrollEdgeRouter(zId string, edge *rest_management_api_client.ZitiEdgeManagement) (string, error) {
+func ReEnrollEdgeRouter(ctx context.Context, zId string, edge *Edge) (string, error) {
 	p := &edge_router.ReEnrollEdgeRouterParams{
-		Context: context.Background(),
-		ID:      zId,
+		ID: zId,
 	}
-	p.SetTimeout(30 * time.Second)
-	_, err := edge.EdgeRouter.ReEnrollEdgeRouter(p, nil)
+	err := edge.do(ctx, "ReEnrollEdgeRouter", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error {
+		_, err := client.EdgeRouter.ReEnrollEdgeRouter(withContext(ctx, p), nil)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 	return "", nil
 }
 
-func DeleteEdgeRouter(zId string, edge *rest_management_api_client.ZitiEdgeManagement) error {
+func DeleteEdgeRouter(ctx context.Context, zId string, edge *Edge) error {
 	req := &edge_router.DeleteEdgeRouterParams{
-		ID:      zId,
-		Context: context.Background(),
+		ID: zId,
 	}
-	req.SetTimeout(30 * time.Second)
-	_, err := edge.EdgeRouter.DeleteEdgeRouter(req, nil)
+	err := edge.do(ctx, "DeleteEdgeRouter", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error {
+		_, err := client.EdgeRouter.DeleteEdgeRouter(withContext(ctx, req), nil)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// DisableEdgeRouter keeps an edge router from connecting until it is enabled again
+func DisableEdgeRouter(ctx context.Context, zId string, edge *Edge) error {
+	disabled := true
+	req := &edge_router.PatchEdgeRouterParams{
+		ID:         zId,
+		EdgeRouter: &rest_model_edge.EdgeRouterPatch{Disabled: &disabled},
+	}
+	return edge.do(ctx, "DisableEdgeRouter", func(ctx context.Context, client *rest_management_api_client.ZitiEdgeManagement) error {
+		_, err := client.EdgeRouter.PatchEdgeRouter(withContext(ctx, req), nil)
+		return err
+	})
+}
@@ -0,0 +1,43 @@
+package zitiedge
+
+import (
+	"context"
+	"time"
+)
+
+const defaultOperationTimeout = 30 * time.Second
+
+// Timeouts bound each attempt of a management API call on one endpoint. The caller's context
+// bounds the call as a whole, across failover and re-login. Zero values select the defaults.
+type Timeouts struct {
+	// Default applies to every zitiedge function without an entry in Operations
+	Default time.Duration
+	// Operations overrides Default by function name, as reported in the call metrics, for
+	// example "CreateIdentity"
+	Operations map[string]time.Duration
+}
+
+// forOperation returns the attempt timeout of the named zitiedge function
+func (t Timeouts) forOperation(function string) time.Duration {
+	if timeout := t.Operations[function]; timeout > 0 {
+		return timeout
+	}
+	if t.Default > 0 {
+		return t.Default
+	}
+	return defaultOperationTimeout
+}
+
+// requestParams is implemented by the generated management API parameter types
+type requestParams interface {
+	SetContext(ctx context.Context)
+	SetTimeout(timeout time.Duration)
+}
+
+// withContext binds params to ctx. The generated fixed timeout is cleared so that the deadline of
+// ctx alone decides when the request is abandoned.
+func withContext[P requestParams](ctx context.Context, params P) P {
+	params.SetContext(ctx)
+	params.SetTimeout(0)
+	return params
+}
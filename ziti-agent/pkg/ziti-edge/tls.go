@@ -0,0 +1,107 @@
+package zitiedge
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/openziti/edge-api/rest_util"
+)
+
+// TLSPresetNetFoundry verifies NetFoundry hosted controllers, whose management API is served on
+// <id>-p.<env>.netfoundry.io while the controller certificate is issued for <id>.<env>.netfoundry.io
+const TLSPresetNetFoundry = "netfoundry"
+
+// TLSVerification controls how the controller is verified before logging in. The zero value
+// verifies the management API endpoint as given against the CA pool.
+type TLSVerification struct {
+	// Preset applies built-in rules for a hosting provider, such as TLSPresetNetFoundry
+	Preset string
+	// VerifyURL is the base URL of the controller to verify instead of the management API endpoint,
+	// e.g. when the endpoint is a load balancer that does not serve the client API
+	VerifyURL string
+	// ServerName is the name the controller certificate must be valid for, also sent as SNI
+	ServerName string
+	// CAFingerprint is the SHA-256 fingerprint of a CA the controller certificate must chain to
+	CAFingerprint string
+}
+
+// apiBaseURL returns the controller URL without its path, with the preset rules applied
+func (v TLSVerification) apiBaseURL(endpoint string) (string, error) {
+	parsedURL, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse management API URL: %w", err)
+	}
+
+	hostname := parsedURL.Hostname()
+	if v.Preset == TLSPresetNetFoundry && strings.HasSuffix(hostname, ".netfoundry.io") && strings.Contains(hostname, "-p.") {
+		hostname = strings.Replace(hostname, "-p.", ".", 1)
+	}
+
+	baseURL := fmt.Sprintf("%s://%s", parsedURL.Scheme, hostname)
+	if port := parsedURL.Port(); port != "" {
+		baseURL += ":" + port
+	}
+	return baseURL, nil
+}
+
+// verifyURL returns the base URL the controller is verified with; rest_util.VerifyController
+// and verifyController append /edge/client/v1/versions to it
+func (v TLSVerification) verifyURL(apiBaseURL string) string {
+	if v.VerifyURL != "" {
+		return strings.TrimSuffix(v.VerifyURL, "/")
+	}
+	return apiBaseURL
+}
+
+// tlsConfigFunc builds the TLS configuration of every connection to the controller
+func (v TLSVerification) tlsConfigFunc() rest_util.TlsConfigFunc {
+	return func() (*tls.Config, error) {
+		tlsConfig, err := rest_util.NewTlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = v.ServerName
+		if v.CAFingerprint != "" {
+			fingerprint := normalizeFingerprint(v.CAFingerprint)
+			tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+				return verifyPinnedChain(state.VerifiedChains, fingerprint)
+			}
+		}
+		return tlsConfig, nil
+	}
+}
+
+// verifyPinnedChain checks that one of the verified chains includes the pinned CA
+func verifyPinnedChain(chains [][]*x509.Certificate, fingerprint string) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if Fingerprint(cert) == fingerprint {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("controller certificate does not chain to the CA with fingerprint %s", fingerprint)
+}
+
+// verifyController checks that the controller at baseURL presents a certificate trusted by the CA
+// pool and the verification rules
+func verifyController(baseURL string, cas *x509.CertPool, v TLSVerification, newHTTPClient rest_util.HttpClientFunc) error {
+	tlsConfig, err := v.tlsConfigFunc()()
+	if err != nil {
+		return err
+	}
+	tlsConfig.RootCAs = cas
+
+	httpClient, err := newHTTPClient(tlsConfig)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Get(baseURL + "/edge/client/v1/versions")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}